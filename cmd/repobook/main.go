@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,7 +21,7 @@ import (
 
 func main() {
 	flag.Usage = func() {
-		_, _ = fmt.Fprintf(os.Stderr, "Usage: repobook <path> [--host HOST] [--port PORT] [--no-open]\n\n")
+		_, _ = fmt.Fprintf(os.Stderr, "Usage: repobook <path> [--host HOST] [--port PORT] [--no-open] [--strip-prefixes] [--all-files] [--include GLOB] [--exclude GLOB] [--watch MODE] [--poll-interval DURATION]\n\n")
 		_, _ = fmt.Fprintf(os.Stderr, "Starts a local Markdown viewer for a repository directory.\n")
 		flag.PrintDefaults()
 	}
@@ -28,6 +29,13 @@ func main() {
 	host := flag.String("host", "127.0.0.1", "Host/interface to bind to")
 	port := flag.Int("port", 0, "Port to listen on (0 = auto)")
 	noOpen := flag.Bool("no-open", false, "Do not open the browser automatically")
+	var include, exclude globList
+	flag.Var(&include, "include", "Only show paths matching this glob, e.g. 'docs/**' (repeatable)")
+	flag.Var(&exclude, "exclude", "Hide paths matching this glob (repeatable)")
+	allFiles := flag.Bool("all-files", false, "Show all non-ignored files in the tree, not only markdown")
+	stripPrefixes := flag.Bool("strip-prefixes", false, "Hide numeric ordering prefixes (e.g. \"01-\") in the tree")
+	watchMode := flag.String("watch", "auto", "How to notice file changes: auto, fsnotify or poll (for network file systems and bind mounts)")
+	pollInterval := flag.Duration("poll-interval", 2*time.Second, "How often --watch=poll scans for changes")
 	flag.Parse()
 
 	if flag.NArg() < 1 {
@@ -60,7 +68,18 @@ func main() {
 		fatal(errors.New("path must be a directory"))
 	}
 
-	s, err := server.New(server.Options{Root: root})
+	s, err := server.New(server.Options{
+		Root:               root,
+		StripNumericPrefix: *stripPrefixes,
+		TreeAllFiles:       *allFiles,
+		Include:            include,
+		Exclude:            exclude,
+		WatchMode:          *watchMode,
+		PollInterval:       *pollInterval,
+		Warn: func(msg string) {
+			_, _ = fmt.Fprintf(os.Stderr, "repobook: warning: %s\n", msg)
+		},
+	})
 	if err != nil {
 		fatal(err)
 	}
@@ -79,6 +98,7 @@ func main() {
 		WriteTimeout: 60 * time.Second,
 		IdleTimeout:  60 * time.Second,
 	}
+	httpServer.RegisterOnShutdown(s.CloseLive)
 
 	go func() {
 		if err := httpServer.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -105,6 +125,21 @@ func main() {
 	_ = s.Close()
 }
 
+// globList collects a repeatable flag. Each value may also hold several
+// comma-separated globs.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(v string) error {
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			*g = append(*g, p)
+		}
+	}
+	return nil
+}
+
 func fatal(err error) {
 	_, _ = fmt.Fprintf(os.Stderr, "repobook: %v\n", err)
 	os.Exit(1)
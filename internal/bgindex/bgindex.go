@@ -0,0 +1,98 @@
+// Package bgindex runs the upkeep of an in-memory index on a background
+// goroutine. Indexes such as search.Index and find.Index are built by a
+// scan of the tree and kept current document by document; Queue coalesces
+// those requests, which arrive from watcher events, and runs them one at a
+// time, so they are cheap to make.
+package bgindex
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Queue holds the pending work of one index and the worker doing it.
+type Queue struct {
+	scan func()
+	load func(rel string)
+
+	ready atomic.Bool
+
+	mu      sync.Mutex
+	pending map[string]struct{} // paths to reload
+	refresh bool                // rescan the whole tree
+	wake    chan struct{}
+	done    chan struct{}
+}
+
+// New starts a worker that calls scan for each Refresh and load for each
+// Update. Requests made while the worker is busy are coalesced: one scan
+// for any number of refreshes, one load per path.
+func New(scan func(), load func(rel string)) *Queue {
+	q := &Queue{
+		scan:    scan,
+		load:    load,
+		pending: make(map[string]struct{}),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go q.worker()
+	return q
+}
+
+// Close stops the worker.
+func (q *Queue) Close() {
+	close(q.done)
+}
+
+// Ready reports whether the first scan has finished.
+func (q *Queue) Ready() bool {
+	return q.ready.Load()
+}
+
+// Update queues a reload of one document (repo-relative path).
+func (q *Queue) Update(rel string) {
+	q.mu.Lock()
+	q.pending[rel] = struct{}{}
+	q.mu.Unlock()
+	q.kick()
+}
+
+// Refresh queues a rescan of the tree.
+func (q *Queue) Refresh() {
+	q.mu.Lock()
+	q.refresh = true
+	q.mu.Unlock()
+	q.kick()
+}
+
+func (q *Queue) kick() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) worker() {
+	for {
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		}
+
+		q.mu.Lock()
+		refresh := q.refresh
+		pending := q.pending
+		q.refresh = false
+		q.pending = make(map[string]struct{})
+		q.mu.Unlock()
+
+		if refresh {
+			q.scan()
+			q.ready.Store(true)
+		}
+		for rel := range pending {
+			q.load(rel)
+		}
+	}
+}
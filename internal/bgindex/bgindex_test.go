@@ -0,0 +1,54 @@
+package bgindex
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+)
+
+func TestQueue_RunsAndCoalescesWork(t *testing.T) {
+	var mu sync.Mutex
+	scans := 0
+	var loads []string
+	started, block := make(chan struct{}, 2), make(chan struct{})
+	q := New(func() {
+		started <- struct{}{}
+		<-block
+		mu.Lock()
+		scans++
+		mu.Unlock()
+	}, func(rel string) {
+		mu.Lock()
+		loads = append(loads, rel)
+		mu.Unlock()
+	})
+	defer q.Close()
+
+	if q.Ready() {
+		t.Fatalf("ready before the first scan")
+	}
+	q.Refresh()
+	<-started
+	// While the worker scans, requests pile up and are coalesced.
+	q.Refresh()
+	q.Refresh()
+	q.Update("a.md")
+	q.Update("b.md")
+	q.Update("a.md")
+	close(block)
+
+	bgindextest.WaitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return q.Ready() && scans == 2 && len(loads) == 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(loads)
+	if !reflect.DeepEqual(loads, []string{"a.md", "b.md"}) {
+		t.Fatalf("loads = %q", loads)
+	}
+}
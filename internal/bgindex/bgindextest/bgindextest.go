@@ -0,0 +1,49 @@
+// Package bgindextest has helpers for testing indexes kept by bgindex.
+package bgindextest
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Index is what the helpers need of an index.
+type Index interface {
+	Refresh()
+	Ready() bool
+	Close()
+}
+
+// Ready refreshes idx, waits for the first scan to finish and closes idx
+// when the test ends.
+func Ready(t *testing.T, idx Index) {
+	t.Helper()
+	t.Cleanup(idx.Close)
+	idx.Refresh()
+	WaitFor(t, idx.Ready)
+}
+
+// WaitFor waits up to three seconds for cond to hold.
+func WaitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// WriteDoc writes body to rel under root, creating directories.
+func WriteDoc(t *testing.T, root, rel, body string) {
+	t.Helper()
+	abs := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(abs, []byte(body), 0o644); err != nil {
+		t.Fatalf("write %s: %v", rel, err)
+	}
+}
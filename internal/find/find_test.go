@@ -0,0 +1,128 @@
+package find
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"repobook/internal/bgindex/bgindextest"
+	"repobook/internal/ignore"
+)
+
+func TestFuzzy_MatchesSubsequence(t *testing.T) {
+	score, pos, ok := Fuzzy("gdm", "docs/guide.md")
+	if !ok {
+		t.Fatalf("expected a match")
+	}
+	if want := []int{5, 8, 11}; !reflect.DeepEqual(pos, want) {
+		t.Fatalf("expected positions %v, got %v", want, pos)
+	}
+	if score <= 0 {
+		t.Fatalf("expected a positive score, got %d", score)
+	}
+
+	if _, _, ok := Fuzzy("xyz", "docs/guide.md"); ok {
+		t.Fatalf("expected no match")
+	}
+	// Upper case in the pattern makes matching case-sensitive.
+	if _, _, ok := Fuzzy("Guide", "docs/guide.md"); ok {
+		t.Fatalf("expected a case-sensitive miss")
+	}
+}
+
+func TestFuzzy_PrefersBoundariesAndRuns(t *testing.T) {
+	better := func(pattern, a, b string) {
+		t.Helper()
+		sa, _, oka := Fuzzy(pattern, a)
+		sb, _, okb := Fuzzy(pattern, b)
+		if !oka || !okb {
+			t.Fatalf("%q should match both %q and %q", pattern, a, b)
+		}
+		if sa <= sb {
+			t.Fatalf("%q: expected %q (%d) to beat %q (%d)", pattern, a, sa, b, sb)
+		}
+	}
+	better("guide", "docs/guide.md", "docs/large-uide.md")
+	better("dg", "docs/guide.md", "docs/bridge.md")
+	better("rb", "docs/RepoBook.md", "docs/rebuild.md")
+	better("inst", "install.md", "reinstall.md")
+}
+
+func TestIndex_FindRanksFilesAndHeadings(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "docs/guide.md", "# User Guide\n\n## Installation\n\ntext\n\n## Troubleshooting\n")
+	bgindextest.WriteDoc(t, root, "docs/reference/api.md", "# API Reference\n\n## Install endpoint\n")
+	bgindextest.WriteDoc(t, root, "private/secret.md", "# Secret Guide\n")
+	bgindextest.WriteDoc(t, root, ".gitignore", "private/\n")
+
+	idx := newReadyIndex(t, root)
+
+	res := idx.Find("guide", 10)
+	if len(res.Results) == 0 || res.Results[0].Kind != KindFile || res.Results[0].Path != "docs/guide.md" {
+		t.Fatalf("expected the guide document first, got %+v", res.Results)
+	}
+	for _, r := range res.Results {
+		if r.Path == "private/secret.md" {
+			t.Fatalf("ignored document offered: %+v", r)
+		}
+	}
+
+	res = idx.Find("trbl", 10)
+	if len(res.Results) == 0 {
+		t.Fatalf("expected a heading match")
+	}
+	r := res.Results[0]
+	if r.Kind != KindHeading || r.Heading != "Troubleshooting" || r.Anchor != "troubleshooting" || r.Line != 7 {
+		t.Fatalf("expected the Troubleshooting heading, got %+v", r)
+	}
+	if r.Title != "User Guide" || len(r.Positions.Label) != 4 {
+		t.Fatalf("expected document title and label positions, got %+v", r)
+	}
+
+	// Terms can match the path and the label separately.
+	res = idx.Find("ref install", 10)
+	if len(res.Results) == 0 || res.Results[0].Anchor != "install-endpoint" {
+		t.Fatalf("expected the API Install heading first, got %+v", res.Results)
+	}
+	if p := res.Results[0].Positions; len(p.Path) == 0 || len(p.Label) == 0 {
+		t.Fatalf("expected positions in both path and label, got %+v", p)
+	}
+}
+
+func TestIndex_UpdateAndRefresh(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "# Alpha\n")
+	idx := newReadyIndex(t, root)
+
+	bgindextest.WriteDoc(t, root, "a.md", "# Alpha\n\n## Zebra crossing\n")
+	// Make sure the mtime changes on coarse filesystems.
+	future := time.Now().Add(2 * time.Second)
+	if err := os.Chtimes(filepath.Join(root, "a.md"), future, future); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	idx.Update("a.md")
+	bgindextest.WaitFor(t, func() bool { return len(idx.Find("zebra", 10).Results) == 1 })
+
+	bgindextest.WriteDoc(t, root, "b.md", "# Bravo\n")
+	idx.Refresh()
+	bgindextest.WaitFor(t, func() bool { return len(idx.Find("bravo", 10).Results) > 0 })
+
+	if err := os.Remove(filepath.Join(root, "a.md")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	idx.Update("a.md")
+	bgindextest.WaitFor(t, func() bool { return len(idx.Find("alpha", 10).Results) == 0 })
+}
+
+func newReadyIndex(t *testing.T, root string) *Index {
+	t.Helper()
+	ig, err := ignore.Load(root)
+	if err != nil {
+		t.Fatalf("ignore.Load: %v", err)
+	}
+	idx := NewIndex(root, func() *ignore.Matcher { return ig })
+	bgindextest.Ready(t, idx)
+	return idx
+}
@@ -0,0 +1,189 @@
+package find
+
+import (
+	"unicode"
+)
+
+// Scoring constants, after fzf's algorithm: every matched character is
+// worth scoreMatch, gaps cost, and matches at word boundaries, camelCase
+// humps and runs of consecutive characters earn bonuses.
+const (
+	scoreMatch        = 16
+	scoreGapStart     = -3
+	scoreGapExtension = -1
+
+	bonusBoundary      = scoreMatch / 2
+	bonusBoundaryWhite = bonusBoundary + 2
+	bonusBoundaryDelim = bonusBoundary + 1
+	bonusNonWord       = scoreMatch / 2
+	bonusCamel123      = bonusBoundary + scoreGapExtension
+	bonusConsecutive   = -(scoreGapStart + scoreGapExtension)
+
+	bonusFirstCharMultiplier = 2
+)
+
+type charClass int
+
+const (
+	charWhite charClass = iota
+	charNonWord
+	charDelimiter
+	charLower
+	charUpper
+	charLetter
+	charNumber
+)
+
+func classOf(r rune) charClass {
+	switch {
+	case r >= 'a' && r <= 'z':
+		return charLower
+	case r >= 'A' && r <= 'Z':
+		return charUpper
+	case r >= '0' && r <= '9':
+		return charNumber
+	case r == '/' || r == ',' || r == ':' || r == ';' || r == '|':
+		return charDelimiter
+	case unicode.IsSpace(r):
+		return charWhite
+	case unicode.IsLower(r):
+		return charLower
+	case unicode.IsUpper(r):
+		return charUpper
+	case unicode.IsLetter(r):
+		return charLetter
+	case unicode.IsNumber(r):
+		return charNumber
+	}
+	return charNonWord
+}
+
+func bonusFor(prev, cur charClass) int {
+	if cur > charDelimiter {
+		switch prev {
+		case charWhite:
+			return bonusBoundaryWhite
+		case charDelimiter:
+			return bonusBoundaryDelim
+		case charNonWord:
+			return bonusBoundary
+		}
+	}
+	if prev == charLower && cur == charUpper || prev != charNumber && cur == charNumber {
+		return bonusCamel123
+	}
+	switch cur {
+	case charNonWord, charDelimiter:
+		return bonusNonWord
+	case charWhite:
+		return bonusBoundaryWhite
+	}
+	return 0
+}
+
+// Fuzzy matches pattern against text as an in-order subsequence and scores
+// the match: higher is better. It returns the rune indexes of the matched
+// characters in text. Matching ignores case unless pattern has an upper-case
+// letter.
+//
+// Like fzf's v1 algorithm, it finds the first occurrence of the subsequence,
+// then scans backwards from its end for the shortest window, and scores
+// that window.
+func Fuzzy(pattern, text string) (int, []int, bool) {
+	pat := []rune(pattern)
+	if len(pat) == 0 {
+		return 0, nil, true
+	}
+	caseSensitive := false
+	for _, r := range pat {
+		if unicode.IsUpper(r) {
+			caseSensitive = true
+			break
+		}
+	}
+	fold := func(r rune) rune {
+		if caseSensitive {
+			return r
+		}
+		return unicode.ToLower(r)
+	}
+
+	txt := []rune(text)
+	pidx, start, end := 0, -1, -1
+	for i, r := range txt {
+		if fold(r) == fold(pat[pidx]) {
+			if start < 0 {
+				start = i
+			}
+			pidx++
+			if pidx == len(pat) {
+				end = i + 1
+				break
+			}
+		}
+	}
+	if end < 0 {
+		return 0, nil, false
+	}
+
+	// Narrow the window from the right.
+	pidx = len(pat) - 1
+	for i := end - 1; i >= start; i-- {
+		if fold(txt[i]) == fold(pat[pidx]) {
+			pidx--
+			if pidx < 0 {
+				start = i
+				break
+			}
+		}
+	}
+
+	score, positions := scoreWindow(txt, pat, start, end, fold)
+	return score, positions, true
+}
+
+func scoreWindow(txt, pat []rune, start, end int, fold func(rune) rune) (int, []int) {
+	positions := make([]int, 0, len(pat))
+	score, pidx, consecutive, firstBonus := 0, 0, 0, 0
+	inGap := false
+	prev := charWhite
+	if start > 0 {
+		prev = classOf(txt[start-1])
+	}
+	for i := start; i < end; i++ {
+		r := txt[i]
+		class := classOf(r)
+		if pidx < len(pat) && fold(r) == fold(pat[pidx]) {
+			score += scoreMatch
+			bonus := bonusFor(prev, class)
+			if consecutive == 0 {
+				firstBonus = bonus
+			} else {
+				if bonus >= bonusBoundary && bonus > firstBonus {
+					firstBonus = bonus
+				}
+				bonus = max(bonus, firstBonus, bonusConsecutive)
+			}
+			if pidx == 0 {
+				score += bonus * bonusFirstCharMultiplier
+			} else {
+				score += bonus
+			}
+			positions = append(positions, i)
+			inGap = false
+			consecutive++
+			pidx++
+		} else {
+			if inGap {
+				score += scoreGapExtension
+			} else {
+				score += scoreGapStart
+			}
+			inGap = true
+			consecutive = 0
+			firstBonus = 0
+		}
+		prev = class
+	}
+	return score, positions
+}
@@ -0,0 +1,281 @@
+package find
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"repobook/internal/bgindex"
+	"repobook/internal/ignore"
+	"repobook/internal/render"
+	"repobook/internal/scan"
+	"repobook/internal/util"
+)
+
+// Target kinds reported in Target.Kind.
+const (
+	KindFile    = "file"
+	KindHeading = "heading"
+)
+
+// Target is a place quick open can jump to: a document, or a heading within
+// one.
+type Target struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path"`
+	Title   string `json:"title"` // document title
+	Heading string `json:"heading,omitempty"`
+	Anchor  string `json:"anchor,omitempty"`
+	Level   int    `json:"level,omitempty"`
+	Line    int    `json:"line,omitempty"`
+
+	Score     int       `json:"score"`
+	Positions Positions `json:"positions"`
+}
+
+// Positions are the matched rune indexes, for highlighting.
+type Positions struct {
+	Label []int `json:"label,omitempty"` // in Heading, or Title for files
+	Path  []int `json:"path,omitempty"`
+}
+
+type Response struct {
+	Query     string   `json:"query"`
+	Results   []Target `json:"results"`
+	Truncated bool     `json:"truncated"`
+}
+
+// label is the text a target is known by besides its path.
+func (t *Target) label() string {
+	if t.Kind == KindHeading {
+		return t.Heading
+	}
+	return t.Title
+}
+
+// Index caches the targets of every markdown document in a tree. It is
+// filled from the scanner and kept current with Update and Refresh, which
+// queue work for a background worker (see bgindex) so they are cheap to
+// call from watcher events.
+type Index struct {
+	rootAbs string
+	ignore  func() *ignore.Matcher
+	queue   *bgindex.Queue
+
+	mu     sync.RWMutex
+	byPath map[string]*doc
+}
+
+type doc struct {
+	mtime   int64
+	targets []Target
+}
+
+// NewIndex creates an empty index for rootAbs and starts its worker. Call
+// Refresh to fill it.
+func NewIndex(rootAbs string, ig func() *ignore.Matcher) *Index {
+	idx := &Index{
+		rootAbs: rootAbs,
+		ignore:  ig,
+		byPath:  make(map[string]*doc),
+	}
+	idx.queue = bgindex.New(idx.scan, idx.load)
+	return idx
+}
+
+func (idx *Index) Close() {
+	idx.queue.Close()
+}
+
+// Ready reports whether the first scan has finished.
+func (idx *Index) Ready() bool {
+	return idx.queue.Ready()
+}
+
+// Update queues a re-read of one document (repo-relative path).
+func (idx *Index) Update(rel string) {
+	idx.queue.Update(rel)
+}
+
+// Refresh queues a rescan of the tree.
+func (idx *Index) Refresh() {
+	idx.queue.Refresh()
+}
+
+// scan lists documents with the tree scanner, so quick open offers exactly
+// what the navigation shows.
+func (idx *Index) scan() {
+	tree, err := scan.BuildTree(scan.Options{RootAbs: idx.rootAbs, Ignore: idx.ignore()})
+	if err != nil {
+		return
+	}
+	seen := make(map[string]struct{})
+	var walk func(n scan.Node)
+	walk = func(n scan.Node) {
+		for _, c := range n.Children {
+			if c.Type == "dir" {
+				walk(c)
+				continue
+			}
+			seen[c.Path] = struct{}{}
+			idx.load(c.Path)
+		}
+	}
+	walk(tree)
+
+	idx.mu.Lock()
+	for rel := range idx.byPath {
+		if _, ok := seen[rel]; !ok {
+			delete(idx.byPath, rel)
+		}
+	}
+	idx.mu.Unlock()
+}
+
+// load (re)reads the targets of one document if it changed, or drops it if
+// it is gone or ignored.
+func (idx *Index) load(rel string) {
+	abs, _, err := util.ResolveRepoPath(idx.rootAbs, rel)
+	st, statErr := os.Stat(abs)
+	if err != nil || statErr != nil || st.IsDir() || !util.IsMarkdownFileName(path.Base(rel)) || idx.ignore().IsIgnored(rel, false) {
+		idx.mu.Lock()
+		delete(idx.byPath, rel)
+		idx.mu.Unlock()
+		return
+	}
+
+	mtime := st.ModTime().UnixNano()
+	idx.mu.RLock()
+	d, ok := idx.byPath[rel]
+	unchanged := ok && d.mtime == mtime
+	idx.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	src, err := os.ReadFile(abs)
+	if err != nil {
+		return
+	}
+	d = &doc{mtime: mtime, targets: targetsOf(rel, src)}
+
+	idx.mu.Lock()
+	idx.byPath[rel] = d
+	idx.mu.Unlock()
+}
+
+// targetsOf returns the document target followed by one per heading. The
+// title is the first level-1 heading, or the file name; that heading is
+// covered by the document target and not listed again.
+func targetsOf(rel string, src []byte) []Target {
+	headings := render.Outline(src)
+	title, titleIdx := path.Base(rel), -1
+	for i, h := range headings {
+		if h.Level == 1 {
+			title, titleIdx = h.Title, i
+			break
+		}
+	}
+	out := make([]Target, 0, len(headings)+1)
+	out = append(out, Target{Kind: KindFile, Path: rel, Title: title})
+	for i, h := range headings {
+		if i == titleIdx {
+			continue
+		}
+		out = append(out, Target{
+			Kind:    KindHeading,
+			Path:    rel,
+			Title:   title,
+			Heading: h.Title,
+			Anchor:  h.ID,
+			Level:   h.Level,
+			Line:    h.Line,
+		})
+	}
+	return out
+}
+
+// Find returns the targets matching query, best first. Each
+// whitespace-separated term must fuzzy-match the target's label or its
+// path. For headings, path matches count half so a document outranks its
+// own headings when the query names the file.
+func (idx *Index) Find(query string, limit int) Response {
+	query = strings.TrimSpace(query)
+	resp := Response{Query: query, Results: []Target{}}
+	terms := strings.FieldsFunc(query, unicode.IsSpace)
+	if len(terms) == 0 {
+		return resp
+	}
+	if limit <= 0 {
+		limit = 50
+	}
+
+	idx.mu.RLock()
+	for _, d := range idx.byPath {
+		for _, t := range d.targets {
+			if score, pos, ok := matchTarget(&t, terms); ok {
+				t.Score, t.Positions = score, pos
+				resp.Results = append(resp.Results, t)
+			}
+		}
+	}
+	idx.mu.RUnlock()
+
+	sort.Slice(resp.Results, func(i, j int) bool {
+		a, b := resp.Results[i], resp.Results[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if la, lb := len(a.label())+len(a.Path), len(b.label())+len(b.Path); la != lb {
+			return la < lb
+		}
+		if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Line < b.Line
+	})
+	if len(resp.Results) > limit {
+		resp.Results = resp.Results[:limit]
+		resp.Truncated = true
+	}
+	return resp
+}
+
+func matchTarget(t *Target, terms []string) (int, Positions, bool) {
+	total := 0
+	var pos Positions
+	for _, term := range terms {
+		ls, lp, lok := Fuzzy(term, t.label())
+		ps, pp, pok := Fuzzy(term, t.Path)
+		if pok && t.Kind == KindHeading {
+			ps /= 2
+		}
+		switch {
+		case lok && (!pok || ls >= ps):
+			total += ls
+			pos.Label = append(pos.Label, lp...)
+		case pok:
+			total += ps
+			pos.Path = append(pos.Path, pp...)
+		default:
+			return 0, Positions{}, false
+		}
+	}
+	pos.Label = uniqueSorted(pos.Label)
+	pos.Path = uniqueSorted(pos.Path)
+	return total, pos, true
+}
+
+func uniqueSorted(xs []int) []int {
+	sort.Ints(xs)
+	out := xs[:0]
+	for i, x := range xs {
+		if i == 0 || x != xs[i-1] {
+			out = append(out, x)
+		}
+	}
+	return out
+}
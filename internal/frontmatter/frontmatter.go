@@ -0,0 +1,175 @@
+package frontmatter
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Meta holds the fields of a YAML front matter block.
+//
+// Only a small, commonly used subset of YAML is understood: scalar
+// "key: value" pairs, inline lists ("tags: [a, b]") and block lists
+// ("tags:" followed by "- a" lines). Values are either string or []string.
+// Keys are lower-cased.
+type Meta map[string]any
+
+// maxLines bounds how far we read looking for the closing delimiter so a
+// stray "---" at the top of a large file doesn't make us read all of it.
+const maxLines = 200
+
+// Split separates a leading front matter block from the document body.
+// If src has no front matter, meta is empty and body is src.
+func Split(src []byte) (Meta, []byte) {
+	meta, n, ok := parse(bufio.NewReader(bytes.NewReader(src)))
+	if !ok {
+		return Meta{}, src
+	}
+	return meta, src[n:]
+}
+
+// ReadFile parses only the front matter at the start of the file at abs,
+// without reading the rest of the document.
+func ReadFile(abs string) (Meta, error) {
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	meta, _, ok := parse(bufio.NewReader(f))
+	if !ok {
+		return Meta{}, nil
+	}
+	return meta, nil
+}
+
+// String returns the scalar value for key, or "" if absent. Lists are
+// joined with ", ".
+func (m Meta) String(key string) string {
+	switch v := m[strings.ToLower(key)].(type) {
+	case string:
+		return v
+	case []string:
+		return strings.Join(v, ", ")
+	}
+	return ""
+}
+
+// List returns the values for key. A scalar value is returned as a single
+// element list.
+func (m Meta) List(key string) []string {
+	switch v := m[strings.ToLower(key)].(type) {
+	case string:
+		if v == "" {
+			return nil
+		}
+		return []string{v}
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// Int returns the integer value for key and whether it was present and valid.
+func (m Meta) Int(key string) (int, bool) {
+	s := m.String(key)
+	if s == "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	return n, true
+}
+
+// parse reads a front matter block and returns the number of bytes it
+// occupied, including both delimiter lines.
+func parse(r *bufio.Reader) (Meta, int, bool) {
+	consumed := 0
+	readLine := func() (string, bool) {
+		line, err := r.ReadString('\n')
+		if line == "" && err != nil {
+			return "", false
+		}
+		consumed += len(line)
+		return strings.TrimRight(line, "\r\n"), err == nil || err == io.EOF
+	}
+
+	first, ok := readLine()
+	if !ok || strings.TrimRight(strings.TrimPrefix(first, "\ufeff"), " \t") != "---" {
+		return nil, 0, false
+	}
+
+	meta := Meta{}
+	lastKey := ""
+	for i := 0; i < maxLines; i++ {
+		line, ok := readLine()
+		if !ok {
+			return nil, 0, false
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "---" || trimmed == "..." {
+			return meta, consumed, true
+		}
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+
+		// Block list item belonging to the previous key.
+		if strings.HasPrefix(trimmed, "- ") || trimmed == "-" {
+			if lastKey == "" {
+				continue
+			}
+			item := Unquote(strings.TrimSpace(strings.TrimPrefix(trimmed, "-")))
+			if item == "" {
+				continue
+			}
+			list, _ := meta[lastKey].([]string)
+			meta[lastKey] = append(list, item)
+			continue
+		}
+
+		// Nested mappings are not supported; skip indented lines.
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+
+		key, val, found := strings.Cut(line, ":")
+		if !found {
+			lastKey = ""
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.TrimSpace(val)
+		lastKey = key
+		switch {
+		case val == "":
+			meta[key] = []string(nil)
+		case strings.HasPrefix(val, "[") && strings.HasSuffix(val, "]"):
+			items := make([]string, 0, 4)
+			for _, it := range strings.Split(val[1:len(val)-1], ",") {
+				if it = Unquote(strings.TrimSpace(it)); it != "" {
+					items = append(items, it)
+				}
+			}
+			meta[key] = items
+		default:
+			meta[key] = Unquote(val)
+		}
+	}
+	return nil, 0, false
+}
+
+// Unquote strips one pair of matching single or double quotes around s, as
+// written around YAML scalars.
+func Unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' && s[len(s)-1] == '"' || s[0] == '\'' && s[len(s)-1] == '\'') {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
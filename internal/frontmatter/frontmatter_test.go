@@ -0,0 +1,43 @@
+package frontmatter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplit(t *testing.T) {
+	src := []byte("---\ntitle: \"Intro\"\nweight: 3\ntags: [a, b]\nowners:\n  - alice\n  - bob\n---\n# Body\n")
+	meta, body := Split(src)
+	if got := meta.String("title"); got != "Intro" {
+		t.Fatalf("title: got %q", got)
+	}
+	if n, ok := meta.Int("weight"); !ok || n != 3 {
+		t.Fatalf("weight: got %d %v", n, ok)
+	}
+	if got := meta.List("tags"); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("tags: got %v", got)
+	}
+	if got := meta.List("owners"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Fatalf("owners: got %v", got)
+	}
+	if string(body) != "# Body\n" {
+		t.Fatalf("body: got %q", body)
+	}
+}
+
+func TestSplit_NoFrontMatter(t *testing.T) {
+	src := []byte("# Title\n\n---\n")
+	meta, body := Split(src)
+	if len(meta) != 0 {
+		t.Fatalf("expected no meta, got %v", meta)
+	}
+	if string(body) != string(src) {
+		t.Fatalf("expected body unchanged")
+	}
+
+	// Unterminated blocks are treated as content.
+	meta, body = Split([]byte("---\ntitle: x\n"))
+	if len(meta) != 0 || string(body) != "---\ntitle: x\n" {
+		t.Fatalf("expected unterminated block to be left alone")
+	}
+}
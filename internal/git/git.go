@@ -0,0 +1,77 @@
+// Package git runs the git command line tool against the served tree.
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	ErrNotFound    = errors.New("git not found")
+	ErrNotRepo     = errors.New("not a git repository")
+	ErrBadRevision = errors.New("bad revision")
+)
+
+// Command returns a git command that runs in dir. Paths in its output are
+// printed verbatim rather than quoted.
+func Command(ctx context.Context, dir string, args ...string) (*exec.Cmd, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, ErrNotFound
+	}
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-c", "core.quotepath=false"}, args...)...)
+	cmd.Dir = dir
+	return cmd, nil
+}
+
+// Error turns a failed git run into an error, recognizing ErrNotRepo from
+// git's stderr.
+func Error(err error, stderr string) error {
+	stderr = strings.TrimSpace(stderr)
+	if strings.Contains(stderr, "not a git repository") {
+		return ErrNotRepo
+	}
+	if stderr != "" {
+		return fmt.Errorf("git: %s", stderr)
+	}
+	return fmt.Errorf("git: %w", err)
+}
+
+// revPattern accepts commit hashes, optionally followed by "^" for the first
+// parent. Nothing else is passed on to git, so a revision can never be read
+// as an option.
+var revPattern = regexp.MustCompile(`^[0-9a-f]{7,64}\^?$`)
+
+// ValidRevision reports whether Show accepts rev.
+func ValidRevision(rev string) bool {
+	return revPattern.MatchString(rev)
+}
+
+// Show returns the content of the file at rel, relative to dir, in revision
+// rev. rev is a commit hash, optionally followed by "^". A file missing from
+// the revision yields an error wrapping os.ErrNotExist.
+func Show(ctx context.Context, dir, rev, rel string) ([]byte, error) {
+	if !ValidRevision(rev) {
+		return nil, fmt.Errorf("%w: %q", ErrBadRevision, rev)
+	}
+	cmd, err := Command(ctx, dir, "show", rev+":./"+rel)
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		msg := stderr.String()
+		if strings.Contains(msg, "does not exist") || strings.Contains(msg, "exists on disk, but not in") || strings.Contains(msg, "invalid object name") || strings.Contains(msg, "unknown revision") {
+			return nil, fmt.Errorf("%s at %s: %w", rel, rev, os.ErrNotExist)
+		}
+		return nil, Error(err, msg)
+	}
+	return out, nil
+}
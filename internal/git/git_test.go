@@ -0,0 +1,80 @@
+package git
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShow(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	root := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Ana", "-c", "user.email=ana@example.com"}, args...)...)
+		cmd.Dir = root
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("init", "-q")
+	if err := os.MkdirAll(filepath.Join(root, "docs"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "a.md"), []byte("old\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run("add", ".")
+	run("commit", "-q", "-m", "one")
+	rev := run("rev-parse", "HEAD")
+	if err := os.WriteFile(filepath.Join(root, "docs", "a.md"), []byte("new\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	run("commit", "-q", "-am", "two")
+
+	ctx := context.Background()
+	got, err := Show(ctx, root, rev, "docs/a.md")
+	if err != nil || string(got) != "old\n" {
+		t.Fatalf("Show: got %q, %v", got, err)
+	}
+	// Paths are relative to dir, which may be a subdirectory.
+	if got, err := Show(ctx, filepath.Join(root, "docs"), rev, "a.md"); err != nil || string(got) != "old\n" {
+		t.Fatalf("Show from a subdirectory: got %q, %v", got, err)
+	}
+	if _, err := Show(ctx, root, rev, "docs/missing.md"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist for a missing file, got %v", err)
+	}
+	if _, err := Show(ctx, root, rev+"^", "docs/a.md"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected os.ErrNotExist before the first commit, got %v", err)
+	}
+	if _, err := Show(ctx, t.TempDir(), rev, "docs/a.md"); !errors.Is(err, ErrNotRepo) {
+		t.Fatalf("expected ErrNotRepo outside a repository, got %v", err)
+	}
+}
+
+func TestValidRevision(t *testing.T) {
+	for rev, want := range map[string]bool{
+		"0123abc":        true,
+		"0123abcdef^":    true,
+		"HEAD":           false,
+		"--output=x":     false,
+		"0123abc:secret": false,
+		"0123abc^^":      false,
+		"0123ABC":        false,
+		"abc":            false,
+	} {
+		if got := ValidRevision(rev); got != want {
+			t.Errorf("ValidRevision(%q) = %v, want %v", rev, got, want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package ignore
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// findGitDir walks up from dirAbs looking for a repository. It returns the
+// worktree root and the git directory (following "gitdir:" files used by
+// worktrees and submodules), or "" if dirAbs is not inside a repository.
+func findGitDir(dirAbs string) (workRoot, gitDir string) {
+	cur := dirAbs
+	for {
+		dotGit := filepath.Join(cur, ".git")
+		if st, err := os.Stat(dotGit); err == nil {
+			if st.IsDir() {
+				return cur, dotGit
+			}
+			if b, err := os.ReadFile(dotGit); err == nil {
+				line := strings.TrimSpace(string(b))
+				if gd, ok := strings.CutPrefix(line, "gitdir:"); ok {
+					gd = strings.TrimSpace(gd)
+					if !filepath.IsAbs(gd) {
+						gd = filepath.Join(cur, gd)
+					}
+					return cur, gd
+				}
+			}
+		}
+		parent := filepath.Dir(cur)
+		if parent == cur {
+			return "", ""
+		}
+		cur = parent
+	}
+}
+
+// commonDir resolves the shared git directory of a linked worktree, where
+// info/exclude and config live.
+func commonDir(gitDir string) string {
+	b, err := os.ReadFile(filepath.Join(gitDir, "commondir"))
+	if err != nil {
+		return gitDir
+	}
+	cd := strings.TrimSpace(string(b))
+	if !filepath.IsAbs(cd) {
+		cd = filepath.Join(gitDir, cd)
+	}
+	return filepath.Clean(cd)
+}
+
+// globalExcludesFile returns the path of the user's global ignore file:
+// core.excludesFile if configured, else git's XDG default.
+func globalExcludesFile(gitDir string) string {
+	home, _ := os.UserHomeDir()
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" && home != "" {
+		xdg = filepath.Join(home, ".config")
+	}
+
+	// Later files override earlier ones, as in git.
+	configs := make([]string, 0, 4)
+	if xdg != "" {
+		configs = append(configs, filepath.Join(xdg, "git", "config"))
+	}
+	if g := os.Getenv("GIT_CONFIG_GLOBAL"); g != "" {
+		configs = append(configs, g)
+	} else if home != "" {
+		configs = append(configs, filepath.Join(home, ".gitconfig"))
+	}
+	if gitDir != "" {
+		configs = append(configs, filepath.Join(gitDir, "config"))
+	}
+
+	excludes := ""
+	for _, c := range configs {
+		if v, ok := readCoreExcludesFile(c); ok {
+			excludes = v
+		}
+	}
+	if excludes == "" {
+		if xdg == "" {
+			return ""
+		}
+		return filepath.Join(xdg, "git", "ignore")
+	}
+	if rest, ok := strings.CutPrefix(excludes, "~/"); ok && home != "" {
+		excludes = filepath.Join(home, rest)
+	}
+	return excludes
+}
+
+// readCoreExcludesFile extracts core.excludesFile from a git config file.
+// Only plain "[core]" sections and "key = value" lines are understood.
+func readCoreExcludesFile(p string) (string, bool) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", false
+	}
+	defer func() { _ = f.Close() }()
+
+	inCore := false
+	val, found := "", false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			name := strings.TrimSpace(strings.Trim(line, "[]"))
+			inCore = strings.EqualFold(name, "core")
+			continue
+		}
+		if !inCore {
+			continue
+		}
+		k, v, ok := strings.Cut(line, "=")
+		if !ok || !strings.EqualFold(strings.TrimSpace(k), "excludesfile") {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+			v = v[1 : len(v)-1]
+		}
+		val, found = v, true
+	}
+	return val, found
+}
@@ -1,45 +1,313 @@
 package ignore
 
 import (
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
-
-	gitignore "github.com/sabhiram/go-gitignore"
 )
 
-// Matcher wraps .gitignore matching.
+// Options adds repobook-specific filtering on top of git's ignore rules.
+type Options struct {
+	// Include, if non-empty, limits the book to paths matching at least one
+	// of these gitignore-style globs (relative to the served root), e.g.
+	// "docs/**". A directory matching an include includes its contents.
+	Include []string
+	// Exclude hides paths matching any of these globs, regardless of any
+	// other rule.
+	Exclude []string
+}
+
+// RepobookIgnoreFile is the name of repobook's own ignore file. It uses
+// gitignore syntax and is honored in any directory.
+const RepobookIgnoreFile = ".repobookignore"
+
+// defaultExcludes are heavyweight or tool-specific directories that are never
+// interesting as documentation. They have the lowest precedence, so a
+// repository can re-include them (e.g. "!vendor/").
+var defaultExcludes = []string{
+	"node_modules/",
+	"vendor/",
+	".idea/",
+	".vscode/",
+}
+
+// DefaultExcludes returns the directories excluded by default, as patterns
+// like "node_modules/".
+func DefaultExcludes() []string {
+	return append([]string(nil), defaultExcludes...)
+}
+
+// Matcher decides which paths are part of the book.
+//
+// Git's rules are layered the way git layers them, lowest precedence first:
+// repobook's default excludes, the global excludes file (core.excludesFile),
+// .git/info/exclude, then .gitignore files from the repository root down to
+// the directory of the path being checked. Within and across layers the last
+// matching pattern wins, so a nested "!pattern" can re-include what a parent
+// excluded. As in git, nothing inside an excluded directory can be
+// re-included.
+//
+// On top of that, .repobookignore files (same syntax and nesting) override
+// git's decision for the paths they match, Exclude globs always hide, and
+// Include globs scope the book. The .git directory is always ignored.
 //
-// Note: This is intentionally best-effort. If there is no .gitignore, it simply
-// matches nothing.
+// A Matcher is immutable after Load and safe for concurrent use.
 type Matcher struct {
-	gi *gitignore.GitIgnore
+	// prefix is the served root relative to the git worktree root ("" when
+	// serving the worktree root itself). Rules are keyed by directories
+	// relative to the worktree root so ignore files above the served root
+	// still apply.
+	prefix string
+	git    map[string][]pattern // dir (relative to worktree root) -> patterns
+	book   map[string][]pattern // same, from .repobookignore files
+
+	include []pattern // relative to the served root
+	exclude []pattern
+
+	sources []string // see Sources
 }
 
 func Load(rootAbs string) (*Matcher, error) {
-	p := filepath.Join(rootAbs, ".gitignore")
-	if _, err := os.Stat(p); err != nil {
-		if os.IsNotExist(err) {
-			return &Matcher{}, nil
-		}
+	return LoadWithOptions(rootAbs, Options{})
+}
+
+func LoadWithOptions(rootAbs string, opts Options) (*Matcher, error) {
+	rootAbs, err := filepath.Abs(rootAbs)
+	if err != nil {
 		return nil, err
 	}
 
-	gi, err := gitignore.CompileIgnoreFile(p)
+	m := &Matcher{
+		git:     make(map[string][]pattern),
+		book:    make(map[string][]pattern),
+		include: compileGlobs(opts.Include),
+		exclude: compileGlobs(opts.Exclude),
+	}
+	for _, d := range defaultExcludes {
+		p, _ := compilePattern(d)
+		m.git[""] = append(m.git[""], p)
+	}
+
+	workRoot, gitDir := findGitDir(rootAbs)
+	if workRoot == "" {
+		// Not a repository: still honor .gitignore files, but there is no
+		// info/exclude and git wouldn't apply global excludes either.
+		workRoot = rootAbs
+	} else {
+		rel, err := filepath.Rel(workRoot, rootAbs)
+		if err != nil {
+			return nil, err
+		}
+		if rel = filepath.ToSlash(rel); rel != "." {
+			m.prefix = rel
+		}
+
+		common := commonDir(gitDir)
+		if p := globalExcludesFile(common); p != "" {
+			m.addFile(m.git, "", p)
+			m.sources = append(m.sources, p)
+		}
+		exclude := filepath.Join(common, "info", "exclude")
+		m.addFile(m.git, "", exclude)
+		m.sources = append(m.sources, exclude)
+
+		// Ignore files between the worktree root and the served root.
+		if m.prefix != "" {
+			dir := ""
+			for _, seg := range strings.Split(m.prefix, "/") {
+				dirAbs := filepath.Join(workRoot, filepath.FromSlash(dir))
+				m.addDir(dir, dirAbs)
+				m.sources = append(m.sources, filepath.Join(dirAbs, ".gitignore"), filepath.Join(dirAbs, RepobookIgnoreFile))
+				dir = path.Join(dir, seg)
+			}
+		}
+	}
+
+	// Ignore files inside the served root. Walking is pre-order, so a
+	// directory's own rules are loaded before its children are considered.
+	err = filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			// Best-effort; unreadable directories simply contribute no rules.
+			if d != nil && d.IsDir() && p != rootAbs {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		relOS, err := filepath.Rel(rootAbs, p)
+		if err != nil {
+			return nil
+		}
+		rel := filepath.ToSlash(relOS)
+		if rel == "." {
+			rel = ""
+		}
+		if rel != "" && m.IsIgnored(rel, true) {
+			// Git doesn't read ignore files inside ignored directories.
+			return fs.SkipDir
+		}
+		m.addDir(m.full(rel), p)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &Matcher{gi: gi}, nil
+
+	return m, nil
+}
+
+// addDir loads the ignore files of one directory (relative to the worktree
+// root).
+func (m *Matcher) addDir(dir, dirAbs string) {
+	m.addFile(m.git, dir, filepath.Join(dirAbs, ".gitignore"))
+	m.addFile(m.book, dir, filepath.Join(dirAbs, RepobookIgnoreFile))
+}
+
+// addFile appends the patterns of an ignore file that applies to dir
+// (relative to the worktree root). Missing or unreadable files contribute
+// no rules, like in git.
+func (m *Matcher) addFile(rules map[string][]pattern, dir, abs string) {
+	data, err := os.ReadFile(abs)
+	if err != nil {
+		return
+	}
+	if ps := parsePatterns(data); len(ps) > 0 {
+		rules[dir] = append(rules[dir], ps...)
+	}
 }
 
+// IsIgnored reports whether relSlash (relative to the served root, forward
+// slashes) is ignored, either directly or because a parent directory is.
 func (m *Matcher) IsIgnored(relSlash string, isDir bool) bool {
-	if m == nil || m.gi == nil {
+	if m == nil {
+		return false
+	}
+
+	relSlash = strings.Trim(relSlash, "/")
+	if relSlash == "" {
+		return false
+	}
+	segs := strings.Split(relSlash, "/")
+	for i := 1; i <= len(segs); i++ {
+		if segs[i-1] == ".git" {
+			return true
+		}
+		p := strings.Join(segs[:i], "/")
+		dir := i < len(segs) || isDir
+		if matchAny(m.exclude, p, dir) {
+			return true
+		}
+		if m.matches(m.full(p), dir) {
+			return true
+		}
+	}
+	return len(m.include) > 0 && !m.included(segs, isDir)
+}
+
+// ReIncludes reports whether a .repobookignore file re-includes paths with
+// "!pattern", which can bring back files git ignores. Tools that apply
+// git's rules themselves, like rg, would miss those.
+func (m *Matcher) ReIncludes() bool {
+	if m == nil {
+		return false
+	}
+	for _, ps := range m.book {
+		for _, p := range ps {
+			if p.negate {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches evaluates git and .repobookignore rules for one path (relative to
+// the worktree root) without considering its parents.
+func (m *Matcher) matches(full string, isDir bool) bool {
+	ignored := false
+	book, bookSet := false, false
+	dir := ""
+	rest := full
+	for {
+		sub := full
+		if dir != "" {
+			sub = strings.TrimPrefix(full, dir+"/")
+		}
+		for _, p := range m.git[dir] {
+			if p.match(sub, isDir) {
+				ignored = !p.negate
+			}
+		}
+		for _, p := range m.book[dir] {
+			if p.match(sub, isDir) {
+				book, bookSet = !p.negate, true
+			}
+		}
+
+		seg, tail, ok := strings.Cut(rest, "/")
+		if !ok {
+			// The remaining segment is the path itself, whose own ignore
+			// files (if a directory) don't apply to it.
+			if bookSet {
+				return book
+			}
+			return ignored
+		}
+		dir = path.Join(dir, seg)
+		rest = tail
+	}
+}
+
+// included reports whether a path passes the Include globs: it, or one of its
+// parents, matches an include. Directories are also kept when an include
+// could match something inside them.
+func (m *Matcher) included(segs []string, isDir bool) bool {
+	for i := 1; i <= len(segs); i++ {
+		if matchAny(m.include, strings.Join(segs[:i], "/"), i < len(segs) || isDir) {
+			return true
+		}
+	}
+	if !isDir {
 		return false
 	}
+	for _, p := range m.include {
+		if p.couldMatchInside(segs) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) full(rel string) string {
+	if m.prefix == "" {
+		return rel
+	}
+	if rel == "" {
+		return m.prefix
+	}
+	return m.prefix + "/" + rel
+}
 
-	p := relSlash
-	if isDir && !strings.HasSuffix(p, "/") {
-		p += "/"
+func compileGlobs(globs []string) []pattern {
+	out := make([]pattern, 0, len(globs))
+	for _, g := range globs {
+		if p, ok := compilePattern(strings.TrimSpace(g)); ok && !p.negate {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func matchAny(ps []pattern, rel string, isDir bool) bool {
+	for _, p := range ps {
+		if p.match(rel, isDir) {
+			return true
+		}
 	}
-	return m.gi.MatchesPath(p)
+	return false
 }
@@ -7,6 +7,7 @@ import (
 )
 
 func TestMatcher_IsIgnored(t *testing.T) {
+	isolateGitConfig(t)
 	root := t.TempDir()
 	gi := []byte("private/\n*.tmp\n")
 	if err := os.WriteFile(filepath.Join(root, ".gitignore"), gi, 0o644); err != nil {
@@ -31,3 +32,176 @@ func TestMatcher_IsIgnored(t *testing.T) {
 		t.Fatalf("did not expect docs/readme.md to be ignored")
 	}
 }
+
+func TestMatcher_NestedAndNegation(t *testing.T) {
+	isolateGitConfig(t)
+	root := t.TempDir()
+	writeFile(t, root, ".gitignore", "*.log\nbuild/\n/generated.md\ndocs/**/draft-*.md\n")
+	writeFile(t, root, "sub/.gitignore", "out/\n!keep.log\n*.md\n!README.md\n")
+	writeFile(t, root, "build/.gitignore", "!*\n")
+
+	m, err := Load(root)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	cases := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"app.log", false, true},
+		{"sub/keep.log", false, false},    // re-included by the nested file
+		{"sub/other.log", false, true},    // still ignored by the root file
+		{"sub/out/x.md", false, true},     // nested dir rule
+		{"out/x.md", false, false},        // nested rules don't apply outside their dir
+		{"sub/notes.md", false, true},     // nested *.md
+		{"sub/README.md", false, false},   // nested negation
+		{"build/a.md", false, true},       // can't re-include inside an excluded dir
+		{"generated.md", false, true},     // anchored
+		{"sub/generated.md", false, true}, // ignored by sub's *.md, not the anchored rule
+		{"x/generated.md", false, false},  // anchored rule only matches at root
+		{"docs/draft-a.md", false, true},  // "**" matches zero dirs
+		{"docs/a/b/draft-b.md", false, true},
+		{"docs/final.md", false, false},
+	}
+	for _, c := range cases {
+		if got := m.IsIgnored(c.rel, c.isDir); got != c.want {
+			t.Errorf("IsIgnored(%q) = %v, want %v", c.rel, got, c.want)
+		}
+	}
+}
+
+func TestMatcher_InfoExcludeAndGlobal(t *testing.T) {
+	home := isolateGitConfig(t)
+	root := t.TempDir()
+	writeFile(t, root, ".git/info/exclude", "local-only.md\n")
+	writeFile(t, home, "global-ignore", "*.bak\n")
+	writeFile(t, home, ".gitconfig", "[user]\n\tname = x\n[core]\n\texcludesFile = ~/global-ignore\n")
+	// The repo's .gitignore has higher precedence than the global file.
+	writeFile(t, root, ".gitignore", "!keep.bak\n")
+
+	m, err := Load(root)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !m.IsIgnored("local-only.md", false) {
+		t.Fatalf("expected .git/info/exclude to apply")
+	}
+	if !m.IsIgnored("docs/old.bak", false) {
+		t.Fatalf("expected core.excludesFile to apply")
+	}
+	if m.IsIgnored("keep.bak", false) {
+		t.Fatalf("expected .gitignore to override the global excludes file")
+	}
+}
+
+func TestMatcher_SubdirectoryOfRepo(t *testing.T) {
+	isolateGitConfig(t)
+	repo := t.TempDir()
+	writeFile(t, repo, ".git/HEAD", "ref: refs/heads/main\n")
+	writeFile(t, repo, ".gitignore", "/docs/private/\n*.tmp\n")
+
+	m, err := Load(filepath.Join(repo, "docs"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !m.IsIgnored("private/a.md", false) {
+		t.Fatalf("expected rules from the worktree root to apply to a served subdirectory")
+	}
+	if !m.IsIgnored("x.tmp", false) {
+		t.Fatalf("expected *.tmp from the worktree root")
+	}
+	if m.IsIgnored("guide.md", false) {
+		t.Fatalf("did not expect guide.md to be ignored")
+	}
+}
+
+// isolateGitConfig points HOME and XDG_CONFIG_HOME at an empty directory so
+// the developer's own git configuration can't affect the test.
+func isolateGitConfig(t *testing.T) string {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_GLOBAL", "")
+	return home
+}
+
+func writeFile(t *testing.T, root, rel, body string) {
+	t.Helper()
+	abs := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(abs, []byte(body), 0o644); err != nil {
+		t.Fatalf("write %s: %v", rel, err)
+	}
+}
+
+func TestMatcher_RepobookIgnoreAndDefaults(t *testing.T) {
+	isolateGitConfig(t)
+	root := t.TempDir()
+	writeFile(t, root, ".gitignore", "generated/\n")
+	writeFile(t, root, ".repobookignore", "runbooks/internal/\n!generated/\ngenerated/api/\n")
+	writeFile(t, root, "docs/.repobookignore", "draft.md\n")
+
+	m, err := Load(root)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	cases := []struct {
+		rel  string
+		want bool
+	}{
+		{"runbooks/internal/oncall.md", true},
+		{"runbooks/public.md", false},
+		{"generated/index.md", false}, // .repobookignore overrides .gitignore
+		{"generated/api/x.md", true},
+		{"docs/draft.md", true},
+		{"draft.md", false},
+		{"node_modules/pkg/README.md", true},
+		{".git/HEAD", true},
+	}
+	for _, c := range cases {
+		if got := m.IsIgnored(c.rel, false); got != c.want {
+			t.Errorf("IsIgnored(%q) = %v, want %v", c.rel, got, c.want)
+		}
+	}
+}
+
+func TestMatcher_IncludeExclude(t *testing.T) {
+	isolateGitConfig(t)
+	root := t.TempDir()
+
+	m, err := LoadWithOptions(root, Options{
+		Include: []string{"docs/**", "/README.md"},
+		Exclude: []string{"docs/internal/", "*.draft.md"},
+	})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	cases := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"README.md", false, false},
+		{"docs", true, false},
+		{"docs/guide.md", false, false},
+		{"docs/a/b.md", false, false},
+		{"src", true, true},
+		{"src/README.md", false, true},
+		{"notes.md", false, true},
+		{"docs/internal/x.md", false, true},
+		{"docs/plan.draft.md", false, true},
+	}
+	for _, c := range cases {
+		if got := m.IsIgnored(c.rel, c.isDir); got != c.want {
+			t.Errorf("IsIgnored(%q) = %v, want %v", c.rel, got, c.want)
+		}
+	}
+}
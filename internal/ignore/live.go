@@ -0,0 +1,72 @@
+package ignore
+
+import (
+	"path/filepath"
+	"sync/atomic"
+)
+
+// Live holds the current Matcher for a root and can rebuild it when ignore
+// files change. Readers always see a complete Matcher: reloads swap it
+// atomically.
+type Live struct {
+	rootAbs string
+	opts    Options
+	cur     atomic.Pointer[Matcher]
+}
+
+func NewLive(rootAbs string, opts Options) (*Live, error) {
+	m, err := LoadWithOptions(rootAbs, opts)
+	if err != nil {
+		return nil, err
+	}
+	l := &Live{rootAbs: rootAbs, opts: opts}
+	l.cur.Store(m)
+	return l, nil
+}
+
+// Matcher returns the current rules. It is nil-safe so callers can treat a
+// nil *Live as "ignore nothing".
+func (l *Live) Matcher() *Matcher {
+	if l == nil {
+		return nil
+	}
+	return l.cur.Load()
+}
+
+// Reload re-reads all ignore files and swaps in the new rules. On error the
+// previous rules stay in effect.
+func (l *Live) Reload() error {
+	m, err := LoadWithOptions(l.rootAbs, l.opts)
+	if err != nil {
+		return err
+	}
+	l.cur.Store(m)
+	return nil
+}
+
+// IsIgnoreFile reports whether the file at abs feeds the rules: a .gitignore
+// or .repobookignore inside the root, or one of the Matcher's Sources.
+func (l *Live) IsIgnoreFile(abs string) bool {
+	name := filepath.Base(abs)
+	if name == ".gitignore" || name == RepobookIgnoreFile {
+		return true
+	}
+	abs = filepath.Clean(abs)
+	for _, s := range l.Matcher().Sources() {
+		if filepath.Clean(s) == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// Sources returns the ignore files outside the served root that affect it:
+// the global excludes file, .git/info/exclude, and .gitignore/.repobookignore
+// files in directories above the root. Files are listed whether or not they
+// currently exist, so callers can watch for them being created.
+func (m *Matcher) Sources() []string {
+	if m == nil {
+		return nil
+	}
+	return m.sources
+}
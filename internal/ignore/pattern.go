@@ -0,0 +1,133 @@
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strings"
+)
+
+// pattern is one compiled line of a gitignore-style file.
+type pattern struct {
+	segs     []string // glob segments, split on "/"
+	negate   bool     // "!pattern" re-includes
+	dirOnly  bool     // "pattern/" only matches directories
+	anchored bool     // contains a non-trailing "/": relative to the file's dir
+}
+
+// parsePatterns compiles the lines of a gitignore-style file.
+func parsePatterns(data []byte) []pattern {
+	out := make([]pattern, 0, 16)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		if p, ok := compilePattern(s.Text()); ok {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+func compilePattern(line string) (pattern, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	line = strings.TrimPrefix(line, "\ufeff")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	// Trailing spaces are ignored unless escaped with a backslash.
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	var p pattern
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, "\\!"), strings.HasPrefix(line, "\\#"):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	// Git spells negated character classes "[!...]"; path.Match wants "[^...]".
+	line = strings.ReplaceAll(line, "[!", "[^")
+	p.segs = strings.Split(line, "/")
+	return p, true
+}
+
+// match reports whether rel (relative to the directory holding the pattern
+// file, forward slashes) matches.
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if !p.anchored {
+		return matchSeg(p.segs[0], path.Base(rel))
+	}
+	return matchSegs(p.segs, strings.Split(rel, "/"))
+}
+
+func matchSegs(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			rest := pat[1:]
+			if len(rest) == 0 {
+				// Trailing "/**" matches everything inside, but not the
+				// directory itself.
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegs(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 || !matchSeg(pat[0], name[0]) {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+func matchSeg(pat, name string) bool {
+	ok, err := path.Match(pat, name)
+	return err == nil && ok
+}
+
+// couldMatchInside reports whether the pattern might match a path below the
+// directory dirSegs.
+func (p pattern) couldMatchInside(dirSegs []string) bool {
+	if !p.anchored {
+		return true
+	}
+	pat := p.segs
+	for _, seg := range dirSegs {
+		if len(pat) == 0 {
+			return false
+		}
+		if pat[0] == "**" {
+			return true
+		}
+		if !matchSeg(pat[0], seg) {
+			return false
+		}
+		pat = pat[1:]
+	}
+	return len(pat) > 0
+}
@@ -1,6 +1,7 @@
 package render
 
 import (
+	"fmt"
 	stdhtml "html"
 	"strings"
 
@@ -55,7 +56,11 @@ func (t *diagramTransformer) Transform(doc *ast.Document, reader text.Reader, pc
 		switch lang {
 		case "mermaid":
 			diag := content
-			html := `<div class="mermaid">` + stdhtml.EscapeString(diag) + `</div>`
+			attrs := ""
+			if v, ok := f.AttributeString(sourceLineAttr); ok {
+				attrs = fmt.Sprintf(` %s="%s"`, sourceLineAttr, v)
+			}
+			html := `<div class="mermaid"` + attrs + `>` + stdhtml.EscapeString(diag) + `</div>`
 			parent.ReplaceChild(parent, f, &DiagramBlock{HTML: html})
 		}
 	}
@@ -0,0 +1,74 @@
+package render
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	ast "github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+
+	"repobook/internal/frontmatter"
+	"repobook/internal/util"
+)
+
+// Heading is a document heading with its position in the source file.
+type Heading struct {
+	Level int    `json:"level"`
+	ID    string `json:"id"`
+	Title string `json:"title"`
+	Line  int    `json:"line"` // 1-based, in the original file (front matter included)
+}
+
+// outlineParser parses with the same options that affect headings and their
+// auto-generated IDs as the renderer, so IDs match RenderResult.TOC.
+var outlineParser = goldmark.New(
+	goldmark.WithExtensions(extension.GFM),
+	goldmark.WithParserOptions(parser.WithAutoHeadingID()),
+).Parser()
+
+// Outline returns the headings of a markdown document without rendering it.
+// Front matter is skipped the same way RenderFile skips it.
+func Outline(src []byte) []Heading {
+	_, body := frontmatter.Split(src)
+	offset := lineOffset(src, body)
+
+	doc := outlineParser.Parse(text.NewReader(body))
+	out := make([]Heading, 0, 16)
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+		h, ok := n.(*ast.Heading)
+		if !ok {
+			return ast.WalkContinue, nil
+		}
+		title := util.ExtractNodeTextWithSource(h, body)
+		if strings.TrimSpace(title) == "" {
+			return ast.WalkSkipChildren, nil
+		}
+		line := 0
+		if lines := h.Lines(); lines.Len() > 0 {
+			line = bytes.Count(body[:lines.At(0).Start], []byte("\n")) + 1 + offset
+		}
+		out = append(out, Heading{Level: h.Level, ID: headingID(h), Title: title, Line: line})
+		return ast.WalkSkipChildren, nil
+	})
+	return out
+}
+
+func headingID(h *ast.Heading) string {
+	v, ok := h.AttributeString("id")
+	if !ok {
+		return ""
+	}
+	switch s := v.(type) {
+	case []byte:
+		return string(s)
+	case string:
+		return s
+	}
+	return ""
+}
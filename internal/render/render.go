@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 
@@ -21,6 +22,7 @@ import (
 	"github.com/yuin/goldmark/text"
 	gmutil "github.com/yuin/goldmark/util"
 
+	"repobook/internal/frontmatter"
 	"repobook/internal/util"
 )
 
@@ -40,6 +42,9 @@ type RenderResult struct {
 	HTML  string    `json:"html"`
 	TOC   []TOCItem `json:"toc"`
 	MTime int64     `json:"mtime"`
+	// Rev is set when the document was read from a git revision rather than
+	// the working tree.
+	Rev string `json:"rev,omitempty"`
 }
 
 type Renderer struct {
@@ -80,6 +85,7 @@ func New(opts Options) (*Renderer, error) {
 		goldmark.WithParserOptions(
 			parser.WithAutoHeadingID(),
 			parser.WithASTTransformers(
+				gmutil.Prioritized(&sourceLineTransformer{}, 80),
 				gmutil.Prioritized(&diagramTransformer{}, 90),
 				gmutil.Prioritized(&linkRewriter{repoRootAbs: r.rootAbs}, 100),
 			),
@@ -103,6 +109,8 @@ func New(opts Options) (*Renderer, error) {
 	p.RequireNoReferrerOnFullyQualifiedLinks(false)
 	p.AllowAttrs("id").OnElements("h1", "h2", "h3", "h4", "h5", "h6")
 	p.AllowAttrs("class").OnElements("div", "pre", "code", "span")
+	p.AllowAttrs(sourceLineAttr).Matching(regexp.MustCompile(`^[0-9]+$`)).OnElements(
+		"p", "h1", "h2", "h3", "h4", "h5", "h6", "ul", "ol", "li", "blockquote", "table", "div")
 	p.AllowAttrs("href").OnElements("a")
 	p.AllowAttrs("src", "alt", "title").OnElements("img")
 	p.AllowAttrs("rel", "target").OnElements("a")
@@ -138,10 +146,37 @@ func (r *Renderer) RenderFile(rel string) (RenderResult, error) {
 	if err != nil {
 		return RenderResult{}, err
 	}
+	res, err := r.render(rel, src)
+	if err != nil {
+		return RenderResult{}, err
+	}
+	res.MTime = mtime
 
-	// Set per-render context for link rewriting.
+	r.mu.Lock()
+	r.cache[rel] = cached{mtime: mtime, res: res}
+	r.mu.Unlock()
+
+	return res, nil
+}
+
+// RenderBytes renders src as the markdown document at rel, for content that
+// is not in the working tree, such as an older revision of the file. Links
+// resolve as they would from rel. The result is not cached and has no
+// MTime.
+func (r *Renderer) RenderBytes(rel string, src []byte) (RenderResult, error) {
+	return r.render(filepath.ToSlash(rel), src)
+}
+
+func (r *Renderer) render(rel string, src []byte) (RenderResult, error) {
+	// Front matter is metadata, not content.
+	_, body := frontmatter.Split(src)
+	offset := lineOffset(src, body)
+	src = body
+
+	// Set per-render context for link rewriting and source lines.
 	ctx := parser.NewContext()
 	ctx.Set(linkCtxKeyCurrentRel, rel)
+	ctx.Set(lineCtxKeyOffset, offset)
 
 	reader := text.NewReader(src)
 	doc := r.md.Parser().Parse(reader, parser.WithContext(ctx))
@@ -164,19 +199,12 @@ func (r *Renderer) RenderFile(rel string) (RenderResult, error) {
 		title = path.Base(rel)
 	}
 
-	res := RenderResult{
+	return RenderResult{
 		Path:  rel,
 		Title: title,
 		HTML:  string(htmlOut),
 		TOC:   toc,
-		MTime: mtime,
-	}
-
-	r.mu.Lock()
-	r.cache[rel] = cached{mtime: mtime, res: res}
-	r.mu.Unlock()
-
-	return res, nil
+	}, nil
 }
 
 func extractTOC(doc ast.Node, source []byte) []TOCItem {
@@ -190,14 +218,7 @@ func extractTOC(doc ast.Node, source []byte) []TOCItem {
 			return ast.WalkContinue, nil
 		}
 
-		id := ""
-		if v, ok := h.AttributeString("id"); ok {
-			if s, ok := v.([]byte); ok {
-				id = string(s)
-			} else if s, ok := v.(string); ok {
-				id = s
-			}
-		}
+		id := headingID(h)
 		title := util.ExtractNodeTextWithSource(h, source)
 		if strings.TrimSpace(title) == "" {
 			return ast.WalkContinue, nil
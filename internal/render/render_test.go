@@ -95,3 +95,141 @@ func TestRenderer_RenderFile_SyntaxHighlighting(t *testing.T) {
 		t.Fatalf("expected chroma classes in HTML")
 	}
 }
+
+func TestRenderer_RenderFile_SkipsFrontMatter(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "fm.md"), []byte("---\nweight: 2\n---\n# Real Title\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	r, err := New(Options{RepoRootAbs: root})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	res, err := r.RenderFile("fm.md")
+	if err != nil {
+		t.Fatalf("RenderFile: %v", err)
+	}
+	if res.Title != "Real Title" {
+		t.Fatalf("expected title 'Real Title', got %q", res.Title)
+	}
+	if strings.Contains(res.HTML, "weight") {
+		t.Fatalf("expected front matter to be omitted; html=%q", res.HTML)
+	}
+}
+
+func TestRenderer_RenderBytes(t *testing.T) {
+	root := t.TempDir()
+	r, err := New(Options{RepoRootAbs: root})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The file need not exist; links resolve relative to its path.
+	res, err := r.RenderBytes("docs/old.md", []byte("---\nweight: 2\n---\n# Old\n\nSee [guide](guide.md).\n"))
+	if err != nil {
+		t.Fatalf("RenderBytes: %v", err)
+	}
+	if res.Path != "docs/old.md" || res.Title != "Old" || res.MTime != 0 {
+		t.Fatalf("unexpected result %+v", res)
+	}
+	if !strings.Contains(res.HTML, `href="/file/docs/guide.md"`) || strings.Contains(res.HTML, "weight") {
+		t.Fatalf("unexpected html %q", res.HTML)
+	}
+}
+
+func TestRenderer_RenderSource(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "main.go"), []byte("package main\n\nfunc main() {}\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "blob.bin"), []byte{0x00, 0x01}, 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	r, err := New(Options{RepoRootAbs: root})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	res, err := r.RenderSource("main.go")
+	if err != nil {
+		t.Fatalf("RenderSource: %v", err)
+	}
+	if res.Title != "main.go" {
+		t.Fatalf("expected title main.go, got %q", res.Title)
+	}
+	if !strings.Contains(res.HTML, "chroma") || !strings.Contains(res.HTML, "package") {
+		t.Fatalf("expected highlighted source; html=%q", res.HTML)
+	}
+
+	if _, err := r.RenderSource("blob.bin"); err != ErrNotText {
+		t.Fatalf("expected ErrNotText, got %v", err)
+	}
+}
+
+func TestOutline_MatchesTOC(t *testing.T) {
+	src := "---\ntitle: x\n---\n# Intro\n\ntext\n\n## Setup\n\n```\n# not a heading\n```\n\n## Setup\n\nSub\n---\n"
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.md"), []byte(src), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r, err := New(Options{RepoRootAbs: root})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	res, err := r.RenderFile("a.md")
+	if err != nil {
+		t.Fatalf("RenderFile: %v", err)
+	}
+
+	hs := Outline([]byte(src))
+	if len(hs) != len(res.TOC) {
+		t.Fatalf("expected %d headings, got %d", len(res.TOC), len(hs))
+	}
+	for i, h := range hs {
+		if h.ID != res.TOC[i].ID || h.Title != res.TOC[i].Title {
+			t.Fatalf("heading %d: got %+v, TOC has %+v", i, h, res.TOC[i])
+		}
+	}
+	wantLines := []int{4, 8, 14, 16}
+	for i, h := range hs {
+		if h.Line != wantLines[i] {
+			t.Fatalf("heading %q: expected line %d, got %d", h.Title, wantLines[i], h.Line)
+		}
+	}
+}
+
+func TestRenderer_SourceLines(t *testing.T) {
+	src := "---\ntitle: x\n---\n# Intro\n\ntext\nmore\n\n- a\n- b\n\n> quote\n\n```mermaid\ngraph TD\n```\n\n| a | b |\n|---|---|\n| 1 | 2 |\n\n<p data-source-line=\"x1\">raw</p>\n"
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.md"), []byte(src), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	r, err := New(Options{RepoRootAbs: root})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	res, err := r.RenderFile("a.md")
+	if err != nil {
+		t.Fatalf("RenderFile: %v", err)
+	}
+
+	// Lines count from the start of the file, front matter included.
+	for _, want := range []string{
+		`<h1 id="intro" data-source-line="4">`,
+		`<p data-source-line="6">text`,
+		`<ul data-source-line="9">`,
+		`<li data-source-line="10">b`,
+		`<blockquote data-source-line="12">`,
+		`<div class="mermaid" data-source-line="14">`,
+		`<table data-source-line="18">`,
+		`<td>1</td>`,
+		`<p>raw</p>`,
+	} {
+		if !strings.Contains(res.HTML, want) {
+			t.Fatalf("expected %s in html=%q", want, res.HTML)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package render
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+
+	"repobook/internal/util"
+)
+
+// maxSourceBytes caps the size of files shown in the source view. Larger
+// files are still reachable via the repo asset server.
+const maxSourceBytes = 2 << 20
+
+var (
+	ErrNotText        = errors.New("not a text file")
+	ErrSourceTooLarge = errors.New("file too large to display")
+)
+
+// RenderSource renders a non-markdown text file as a syntax highlighted
+// listing. The result has no TOC.
+func (r *Renderer) RenderSource(rel string) (RenderResult, error) {
+	rel = filepath.ToSlash(rel)
+	abs, _, err := util.ResolveRepoPath(r.rootAbs, rel)
+	if err != nil {
+		return RenderResult{}, err
+	}
+
+	st, err := os.Stat(abs)
+	if err != nil {
+		return RenderResult{}, err
+	}
+	if st.IsDir() {
+		return RenderResult{}, ErrNotText
+	}
+	if st.Size() > maxSourceBytes {
+		return RenderResult{}, ErrSourceTooLarge
+	}
+	mtime := st.ModTime().UnixNano()
+
+	key := "source:" + rel
+	r.mu.Lock()
+	if c, ok := r.cache[key]; ok && c.mtime == mtime {
+		res := c.res
+		r.mu.Unlock()
+		return res, nil
+	}
+	r.mu.Unlock()
+
+	src, err := os.ReadFile(abs)
+	if err != nil {
+		return RenderResult{}, err
+	}
+	if bytes.IndexByte(src, 0) >= 0 {
+		return RenderResult{}, ErrNotText
+	}
+
+	lexer := lexers.Match(path.Base(rel))
+	if lexer == nil {
+		lexer = lexers.Analyse(string(src))
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	lexer = chroma.Coalesce(lexer)
+
+	it, err := lexer.Tokenise(nil, string(src))
+	if err != nil {
+		return RenderResult{}, err
+	}
+	var buf bytes.Buffer
+	f := chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true))
+	if err := f.Format(&buf, styles.Get("github"), it); err != nil {
+		return RenderResult{}, err
+	}
+
+	res := RenderResult{
+		Path:  rel,
+		Title: path.Base(rel),
+		HTML:  `<div class="source-view">` + string(r.policy.SanitizeBytes(buf.Bytes())) + `</div>`,
+		TOC:   []TOCItem{},
+		MTime: mtime,
+	}
+
+	r.mu.Lock()
+	r.cache[key] = cached{mtime: mtime, res: res}
+	r.mu.Unlock()
+
+	return res, nil
+}
@@ -0,0 +1,95 @@
+package render
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+)
+
+// sourceLineAttr holds the 1-based line of the original file a block starts
+// on, so the viewer can scroll to the block an editor's cursor is in.
+const sourceLineAttr = "data-source-line"
+
+// lineCtxKeyOffset is the number of lines stripped from the start of the
+// file (front matter) before parsing.
+var lineCtxKeyOffset = parser.NewContextKey()
+
+// sourceLineTransformer sets sourceLineAttr on the block nodes whose
+// renderers write attributes: paragraphs, headings, lists and their items,
+// block quotes and tables. It runs before diagramTransformer, which carries
+// the line over to diagram blocks. Highlighted code blocks and thematic
+// breaks are left without one.
+type sourceLineTransformer struct{}
+
+func (t *sourceLineTransformer) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	offset, _ := pc.Get(lineCtxKeyOffset).(int)
+	lines := newLineIndex(reader.Source())
+	_ = ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering || n.Type() != ast.TypeBlock || n.Kind() == ast.KindDocument {
+			return ast.WalkContinue, nil
+		}
+		if line := lines.blockLine(n); line > 0 {
+			n.SetAttributeString(sourceLineAttr, []byte(strconv.Itoa(line+offset)))
+		}
+		if n.Kind() == east.KindTable {
+			// Rows and cells stay unmarked; the table is one block.
+			return ast.WalkSkipChildren, nil
+		}
+		return ast.WalkContinue, nil
+	})
+}
+
+// lineIndex maps byte offsets in a source to line numbers.
+type lineIndex []int // the offset each line starts at
+
+func newLineIndex(src []byte) lineIndex {
+	idx := lineIndex{0}
+	for i, b := range src {
+		if b == '\n' {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+// line returns the 1-based line holding offset.
+func (idx lineIndex) line(offset int) int {
+	return sort.SearchInts(idx, offset+1)
+}
+
+// blockLine returns the line n starts on: that of its first line of text,
+// or of its first child's for containers such as lists. Fenced code blocks
+// start on the line of the opening fence, above their first line. It
+// returns 0 for blocks without text.
+func (idx lineIndex) blockLine(n ast.Node) int {
+	if n.Lines().Len() > 0 {
+		line := idx.line(n.Lines().At(0).Start)
+		if _, ok := n.(*ast.FencedCodeBlock); ok {
+			line--
+		}
+		return line
+	}
+	if f, ok := n.(*ast.FencedCodeBlock); ok && f.Info != nil {
+		return idx.line(f.Info.Segment.Start)
+	}
+	for c := n.FirstChild(); c != nil; c = c.NextSibling() {
+		if c.Type() != ast.TypeBlock {
+			continue
+		}
+		if line := idx.blockLine(c); line > 0 {
+			return line
+		}
+	}
+	return 0
+}
+
+// lineOffset returns the number of lines in the prefix of src that body
+// does not include.
+func lineOffset(src, body []byte) int {
+	return bytes.Count(src[:len(src)-len(body)], []byte("\n"))
+}
@@ -0,0 +1,185 @@
+package scan
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"repobook/internal/frontmatter"
+)
+
+// dirOrder is an explicit ordering for the entries of one directory, read
+// from a ".order" or ".pages" file.
+type dirOrder struct {
+	// Names lists entries in the desired order. Entries may omit the
+	// markdown extension.
+	Names []string
+	// Rest is the index in Names where unlisted entries are placed
+	// ("..." in .pages). -1 means after all listed entries.
+	Rest int
+	// Title optionally overrides the directory's display name (.pages only).
+	Title string
+}
+
+// readDirOrder looks for an ordering file in dirAbs. ".order" (one entry per
+// line, as used by Azure DevOps wikis) takes precedence over ".pages" (the
+// mkdocs awesome-pages format, subset: "title:" and a "nav:" list).
+func readDirOrder(dirAbs string) *dirOrder {
+	if o := readDotOrder(filepath.Join(dirAbs, ".order")); o != nil {
+		return o
+	}
+	return readDotPages(filepath.Join(dirAbs, ".pages"))
+}
+
+func readDotOrder(p string) *dirOrder {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	o := &dirOrder{Rest: -1}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if line == "..." {
+			o.Rest = len(o.Names)
+			continue
+		}
+		o.Names = append(o.Names, line)
+	}
+	return o
+}
+
+func readDotPages(p string) *dirOrder {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	o := &dirOrder{Rest: -1}
+	inNav := false
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		raw := s.Text()
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		indented := raw[0] == ' ' || raw[0] == '\t'
+		if !indented && !strings.HasPrefix(line, "-") {
+			inNav = false
+			key, val, _ := strings.Cut(line, ":")
+			switch strings.TrimSpace(key) {
+			case "nav":
+				inNav = true
+			case "title":
+				o.Title = frontmatter.Unquote(strings.TrimSpace(val))
+			}
+			continue
+		}
+		if !inNav || !strings.HasPrefix(line, "-") {
+			continue
+		}
+		item := strings.TrimSpace(strings.TrimPrefix(line, "-"))
+		if item == "..." {
+			o.Rest = len(o.Names)
+			continue
+		}
+		// "- Some Title: file.md" entries: we only care about the target.
+		if _, target, ok := strings.Cut(item, ":"); ok {
+			item = strings.TrimSpace(target)
+		}
+		if item = frontmatter.Unquote(item); item != "" {
+			o.Names = append(o.Names, item)
+		}
+	}
+	return o
+}
+
+// index returns the position of name in the explicit ordering, or -1.
+func (o *dirOrder) index(name string) int {
+	if o == nil {
+		return -1
+	}
+	for i, n := range o.Names {
+		n = strings.TrimSuffix(n, "/")
+		if strings.EqualFold(n, name) {
+			return i
+		}
+		lower := strings.ToLower(name)
+		for _, ext := range []string{".md", ".markdown"} {
+			if strings.HasSuffix(lower, ext) && strings.EqualFold(n, name[:len(name)-len(ext)]) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// naturalLess compares names case-insensitively, treating runs of digits as
+// numbers so "2-setup.md" sorts before "10-intro.md".
+func naturalLess(a, b string) bool {
+	a, b = strings.ToLower(a), strings.ToLower(b)
+	for a != "" && b != "" {
+		ar, br := rune(a[0]), rune(b[0])
+		if isDigit(ar) && isDigit(br) {
+			an, arest := splitDigits(a)
+			bn, brest := splitDigits(b)
+			// Compare numerically: strip leading zeros, then by length, then lexically.
+			at, bt := strings.TrimLeft(an, "0"), strings.TrimLeft(bn, "0")
+			if len(at) != len(bt) {
+				return len(at) < len(bt)
+			}
+			if at != bt {
+				return at < bt
+			}
+			if len(an) != len(bn) {
+				// Same value; fewer leading zeros first.
+				return len(an) < len(bn)
+			}
+			a, b = arest, brest
+			continue
+		}
+		if ar != br {
+			return ar < br
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func isDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+func splitDigits(s string) (string, string) {
+	i := 0
+	for i < len(s) && isDigit(rune(s[i])) {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// stripNumericPrefix removes ordering prefixes like "01-", "2_" or "10. "
+// from a display name. Names that are only a prefix are left unchanged.
+func stripNumericPrefix(name string) string {
+	digits, rest := splitDigits(name)
+	if digits == "" {
+		return name
+	}
+	trimmed := strings.TrimLeft(rest, "-_. ")
+	if trimmed == rest || trimmed == "" {
+		return name
+	}
+	// "10.md": the dot starts the extension, not a separator.
+	if rest[0] == '.' && !strings.Contains(trimmed, ".") {
+		return name
+	}
+	return trimmed
+}
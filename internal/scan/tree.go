@@ -7,6 +7,7 @@ import (
 	"sort"
 	"strings"
 
+	"repobook/internal/frontmatter"
 	"repobook/internal/ignore"
 	"repobook/internal/util"
 )
@@ -14,12 +15,22 @@ import (
 type Options struct {
 	RootAbs string
 	Ignore  *ignore.Matcher
+
+	// StripNumericPrefix removes ordering prefixes like "01-" from displayed
+	// names. Paths are unchanged.
+	StripNumericPrefix bool
+
+	// AllFiles includes every non-ignored file instead of only markdown.
+	// File nodes then carry Kind, going by the file name, and Size.
+	AllFiles bool
 }
 
 type Node struct {
 	Name     string `json:"name"`
-	Path     string `json:"path"` // repo-relative, forward slashes
-	Type     string `json:"type"` // "dir" or "file"
+	Path     string `json:"path"`           // repo-relative, forward slashes
+	Type     string `json:"type"`           // "dir" or "file"
+	Kind     string `json:"kind,omitempty"` // util.Kind* for files
+	Size     int64  `json:"size,omitempty"`
 	Children []Node `json:"children,omitempty"`
 }
 
@@ -29,18 +40,12 @@ func BuildTree(opts Options) (Node, error) {
 		return Node{}, err
 	}
 
-	// We build a directory tree containing only markdown files and directories
-	// that contain markdown (directly or indirectly).
+	// We build a directory tree containing only markdown files (or all files
+	// with AllFiles) and directories that contain them (directly or indirectly).
 	filesByDir := map[string][]string{} // dirRel -> []fileRel
 	dirSet := map[string]struct{}{}     // dirRel
-
-	ignoreDirs := map[string]struct{}{
-		".git":         {},
-		"node_modules": {},
-		"vendor":       {},
-		".idea":        {},
-		".vscode":      {},
-	}
+	weights := map[string]int{}         // fileRel -> weight
+	infos := map[string]fileInfo{}      // fileRel -> kind/size (AllFiles only)
 
 	err = filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
 		if walkErr != nil {
@@ -63,16 +68,20 @@ func BuildTree(opts Options) (Node, error) {
 		}
 
 		if d.IsDir() {
-			name := d.Name()
-			if _, ok := ignoreDirs[name]; ok {
-				return fs.SkipDir
-			}
 			return nil
 		}
 
-		if !util.IsMarkdownFileName(d.Name()) {
+		isMarkdown := util.IsMarkdownFileName(d.Name())
+		if !isMarkdown && !opts.AllFiles {
 			return nil
 		}
+		if opts.AllFiles {
+			fi := fileInfo{kind: util.FileKind(d.Name())}
+			if info, err := d.Info(); err == nil {
+				fi.size = info.Size()
+			}
+			infos[rel] = fi
+		}
 
 		dirRel := path.Dir(rel)
 		if dirRel == "." {
@@ -80,6 +89,13 @@ func BuildTree(opts Options) (Node, error) {
 		}
 
 		filesByDir[dirRel] = append(filesByDir[dirRel], rel)
+		if isMarkdown {
+			if meta, err := frontmatter.ReadFile(p); err == nil {
+				if w, ok := meta.Int("weight"); ok {
+					weights[rel] = w
+				}
+			}
+		}
 		// Mark this directory and all parents as present.
 		cur := dirRel
 		for {
@@ -99,18 +115,36 @@ func BuildTree(opts Options) (Node, error) {
 	}
 
 	root := Node{Name: path.Base(filepath.ToSlash(rootAbs)), Path: "", Type: "dir"}
-	root.Children = buildDir("", filesByDir, dirSet)
+	b := &treeBuilder{rootAbs: rootAbs, opts: opts, filesByDir: filesByDir, dirSet: dirSet, weights: weights, infos: infos}
+	root.Children = b.buildDir("", readDirOrder(rootAbs))
 	return root, nil
 }
 
-func buildDir(dirRel string, filesByDir map[string][]string, dirSet map[string]struct{}) []Node {
+type treeBuilder struct {
+	rootAbs    string
+	opts       Options
+	filesByDir map[string][]string
+	dirSet     map[string]struct{}
+	weights    map[string]int // fileRel -> front matter weight
+	infos      map[string]fileInfo
+}
+
+type fileInfo struct {
+	kind string
+	size int64
+}
+
+// buildDir returns the entries of one directory, sorted. order is the
+// directory's ordering file, if any, read once by the caller, which also
+// needs its title.
+func (b *treeBuilder) buildDir(dirRel string, order *dirOrder) []Node {
 	// Add subdirectories (only those in dirSet).
 	subdirs := make([]string, 0, 32)
 	prefix := dirRel
 	if prefix != "" {
 		prefix += "/"
 	}
-	for d := range dirSet {
+	for d := range b.dirSet {
 		if d == dirRel {
 			continue
 		}
@@ -123,36 +157,104 @@ func buildDir(dirRel string, filesByDir map[string][]string, dirSet map[string]s
 		}
 		subdirs = append(subdirs, d)
 	}
-	sort.Strings(subdirs)
 
 	nodes := make([]Node, 0, 64)
 	for _, sd := range subdirs {
-		name := path.Base(sd)
-		n := Node{Name: name, Path: sd, Type: "dir"}
-		n.Children = buildDir(sd, filesByDir, dirSet)
+		n := Node{Name: path.Base(sd), Path: sd, Type: "dir"}
+		o := readDirOrder(b.abs(sd))
+		if o != nil && o.Title != "" {
+			n.Name = o.Title
+		} else if b.opts.StripNumericPrefix {
+			n.Name = stripNumericPrefix(n.Name)
+		}
+		n.Children = b.buildDir(sd, o)
 		nodes = append(nodes, n)
 	}
 
-	files := append([]string(nil), filesByDir[dirRel]...)
-	sort.Strings(files)
-	for _, f := range files {
-		nodes = append(nodes, Node{Name: path.Base(f), Path: f, Type: "file"})
+	for _, f := range b.filesByDir[dirRel] {
+		n := Node{Name: path.Base(f), Path: f, Type: "file"}
+		if fi, ok := b.infos[f]; ok {
+			n.Kind, n.Size = fi.kind, fi.size
+		}
+		if b.opts.StripNumericPrefix {
+			n.Name = stripNumericPrefix(n.Name)
+		}
+		nodes = append(nodes, n)
+	}
+
+	b.sortNodes(nodes, order)
+	return nodes
+}
+
+// sortNodes orders the entries of one directory. An explicit ordering file
+// (order, if not nil) wins; everything else is sorted directories first,
+// README.md first among files, then by front matter weight, then by
+// natural name order.
+func (b *treeBuilder) sortNodes(nodes []Node, order *dirOrder) {
+	restSlot := -1
+	if order != nil {
+		restSlot = order.Rest
+		if restSlot < 0 {
+			restSlot = len(order.Names)
+		}
+	}
+	slot := func(n Node) int {
+		i := order.index(path.Base(n.Path))
+		if i < 0 {
+			return restSlot
+		}
+		if i >= restSlot {
+			return i + 1
+		}
+		return i
 	}
 
-	// Prefer README.md first inside a directory.
 	sort.SliceStable(nodes, func(i, j int) bool {
-		a, b := nodes[i], nodes[j]
-		if a.Type != b.Type {
+		a, c := nodes[i], nodes[j]
+		if order != nil {
+			if sa, sc := slot(a), slot(c); sa != sc {
+				return sa < sc
+			}
+		}
+		if a.Type != c.Type {
 			return a.Type == "dir"
 		}
+		an, cn := path.Base(a.Path), path.Base(c.Path)
 		if a.Type == "file" {
-			ar := strings.EqualFold(a.Name, "README.md")
-			br := strings.EqualFold(b.Name, "README.md")
-			if ar != br {
+			ar := strings.EqualFold(an, "README.md")
+			cr := strings.EqualFold(cn, "README.md")
+			if ar != cr {
 				return ar
 			}
 		}
-		return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		aw, aok := b.weight(a)
+		cw, cok := b.weight(c)
+		if aok != cok {
+			return aok
+		}
+		if aw != cw {
+			return aw < cw
+		}
+		return naturalLess(an, cn)
 	})
-	return nodes
+}
+
+// weight returns the front matter weight of a file, or of a directory's
+// README.md.
+func (b *treeBuilder) weight(n Node) (int, bool) {
+	if n.Type == "file" {
+		w, ok := b.weights[n.Path]
+		return w, ok
+	}
+	for _, f := range b.filesByDir[n.Path] {
+		if strings.EqualFold(path.Base(f), "README.md") {
+			w, ok := b.weights[f]
+			return w, ok
+		}
+	}
+	return 0, false
+}
+
+func (b *treeBuilder) abs(rel string) string {
+	return filepath.Join(b.rootAbs, filepath.FromSlash(rel))
 }
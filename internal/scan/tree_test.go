@@ -4,6 +4,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"repobook/internal/ignore"
@@ -97,3 +98,129 @@ func findNode(n *Node, name string) *Node {
 	}
 	return nil
 }
+
+func TestBuildTree_NaturalOrder(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"10-intro.md": "# x\n",
+		"2-setup.md":  "# x\n",
+		"1-start.md":  "# x\n",
+	})
+
+	tree, err := BuildTree(Options{RootAbs: root})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+	assertChildNames(t, tree.Children, "1-start.md", "2-setup.md", "10-intro.md")
+
+	tree, err = BuildTree(Options{RootAbs: root, StripNumericPrefix: true})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+	assertChildNames(t, tree.Children, "start.md", "setup.md", "intro.md")
+	if tree.Children[2].Path != "10-intro.md" {
+		t.Fatalf("expected path to keep its prefix, got %q", tree.Children[2].Path)
+	}
+}
+
+func TestBuildTree_OrderFileAndWeight(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"README.md":       "# x\n",
+		"a.md":            "# x\n",
+		"b.md":            "---\nweight: 1\n---\n# x\n",
+		"c.md":            "# x\n",
+		"docs/.order":     "zeta\n...\nalpha\n",
+		"docs/alpha.md":   "# x\n",
+		"docs/beta.md":    "# x\n",
+		"docs/zeta.md":    "# x\n",
+		"guide/.pages":    "title: The Guide\nnav:\n  - two.md\n  - one.md\n",
+		"guide/one.md":    "# x\n",
+		"guide/two.md":    "# x\n",
+		"guide/three.md":  "# x\n",
+		"guide/README.md": "# x\n",
+	})
+
+	tree, err := BuildTree(Options{RootAbs: root})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+
+	// Weighted files come before unweighted ones, README.md stays first.
+	assertChildNames(t, tree.Children, "docs", "The Guide", "README.md", "b.md", "a.md", "c.md")
+
+	docs := findNode(&tree, "docs")
+	assertChildNames(t, docs.Children, "zeta.md", "beta.md", "alpha.md")
+
+	guide := findNode(&tree, "guide")
+	assertChildNames(t, guide.Children, "two.md", "one.md", "README.md", "three.md")
+}
+
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for rel, body := range files {
+		abs := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(abs, []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+}
+
+func assertChildNames(t *testing.T, children []Node, want ...string) {
+	t.Helper()
+	got := make([]string, 0, len(children))
+	for _, c := range children {
+		got = append(got, c.Name)
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("expected children %v, got %v", want, got)
+	}
+}
+
+func TestBuildTree_AllFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFiles(t, root, map[string]string{
+		"README.md":     "# x\n",
+		"src/main.go":   "package main\n",
+		"img/logo.png":  "\x89PNG\x00",
+		"bin/tool":      "\x7fELF\x00\x00",
+		"bin/app.wasm":  "\x00asm",
+		"docs/spec.pdf": "%PDF-1.4\n",
+	})
+
+	tree, err := BuildTree(Options{RootAbs: root})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+	if findNode(&tree, "main.go") != nil {
+		t.Fatalf("expected non-markdown files to be omitted by default")
+	}
+
+	tree, err = BuildTree(Options{RootAbs: root, AllFiles: true})
+	if err != nil {
+		t.Fatalf("BuildTree: %v", err)
+	}
+	want := map[string]string{
+		"README.md": "markdown",
+		"main.go":   "text",
+		"logo.png":  "image",
+		"tool":      "text", // by name; the source view tells it is binary
+		"app.wasm":  "binary",
+		"spec.pdf":  "pdf",
+	}
+	for name, kind := range want {
+		n := findNode(&tree, name)
+		if n == nil {
+			t.Fatalf("expected %s in tree", name)
+		}
+		if n.Kind != kind {
+			t.Fatalf("expected %s to be %s, got %q", name, kind, n.Kind)
+		}
+	}
+	if n := findNode(&tree, "main.go"); n.Size != int64(len("package main\n")) {
+		t.Fatalf("expected size of main.go, got %d", n.Size)
+	}
+}
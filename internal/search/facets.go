@@ -0,0 +1,101 @@
+package search
+
+import (
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"repobook/internal/frontmatter"
+)
+
+// maxFacetValues bounds each facet list to its most frequent values.
+const maxFacetValues = 20
+
+// Facets count the matching files per tag, directory and author, so
+// clients can offer filters ("tag:", "path:" and "author:").
+type Facets struct {
+	Tags    []FacetCount `json:"tags,omitempty"`
+	Dirs    []FacetCount `json:"dirs,omitempty"`
+	Authors []FacetCount `json:"authors,omitempty"`
+}
+
+// FacetCount is the number of matching files with one facet value.
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// CountFacets reads the front matter of each file in files (repo-relative,
+// as in Response.Files) and counts the files per facet value, most frequent
+// first. Files at the root of the tree have no directory facet. It returns
+// nil if there is nothing to count.
+func CountFacets(rootAbs string, files []FileHits) *Facets {
+	return countFacets(rootAbs, files, nil)
+}
+
+// countFacets is CountFacets taking the front matter of files from cached,
+// if it has them, rather than reading it.
+func countFacets(rootAbs string, files []FileHits, cached func(rel string) (frontmatter.Meta, bool)) *Facets {
+	tags := make(map[string]int)
+	dirs := make(map[string]int)
+	authors := make(map[string]int)
+	for _, f := range files {
+		if dir := path.Dir(f.Path); dir != "." {
+			dirs[dir+"/"]++
+		}
+		var meta frontmatter.Meta
+		ok := false
+		if cached != nil {
+			meta, ok = cached(f.Path)
+		}
+		if !ok {
+			var err error
+			if meta, err = frontmatter.ReadFile(filepath.Join(rootAbs, filepath.FromSlash(f.Path))); err != nil {
+				continue
+			}
+		}
+		countValues(tags, meta, metaKeys[FieldTag])
+		countValues(authors, meta, metaKeys[FieldAuthor])
+	}
+	fs := &Facets{Tags: topFacets(tags), Dirs: topFacets(dirs), Authors: topFacets(authors)}
+	if fs.Tags == nil && fs.Dirs == nil && fs.Authors == nil {
+		return nil
+	}
+	return fs
+}
+
+// countValues counts each distinct value of keys in m once.
+func countValues(counts map[string]int, m frontmatter.Meta, keys []string) {
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		for _, v := range m.List(key) {
+			v = strings.TrimSpace(v)
+			if v == "" || seen[strings.ToLower(v)] {
+				continue
+			}
+			seen[strings.ToLower(v)] = true
+			counts[v]++
+		}
+	}
+}
+
+func topFacets(counts map[string]int) []FacetCount {
+	if len(counts) == 0 {
+		return nil
+	}
+	out := make([]FacetCount, 0, len(counts))
+	for v, n := range counts {
+		out = append(out, FacetCount{Value: v, Count: n})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Value < out[j].Value
+	})
+	if len(out) > maxFacetValues {
+		out = out[:maxFacetValues]
+	}
+	return out
+}
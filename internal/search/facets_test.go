@@ -0,0 +1,35 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+)
+
+func TestCountFacets(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "ops/db.md", "---\ntags: [runbook, database]\nauthors: [ana, bo]\n---\n# DB\n")
+	bgindextest.WriteDoc(t, root, "ops/cache.md", "---\ntags: runbook\nauthor: ana\n---\n# Cache\n")
+	bgindextest.WriteDoc(t, root, "README.md", "# Readme\n")
+
+	got := CountFacets(root, []FileHits{{"ops/db.md", 3}, {"ops/cache.md", 1}, {"README.md", 2}})
+	want := &Facets{
+		Tags:    []FacetCount{{"runbook", 2}, {"database", 1}},
+		Dirs:    []FacetCount{{"ops/", 2}},
+		Authors: []FacetCount{{"ana", 2}, {"bo", 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if got := CountFacets(root, []FileHits{{"README.md", 1}}); got != nil {
+		t.Fatalf("expected no facets for a root file without front matter, got %+v", got)
+	}
+
+	// The index answers from the front matter it keeps.
+	idx := newReadyIndex(t, root, nil)
+	if got := idx.CountFacets([]FileHits{{"ops/db.md", 3}, {"ops/cache.md", 1}, {"README.md", 2}}); !reflect.DeepEqual(got, want) {
+		t.Fatalf("index: got %+v, want %+v", got, want)
+	}
+}
@@ -1,135 +1,269 @@
 package search
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
 	"time"
 
+	"repobook/internal/frontmatter"
 	"repobook/internal/ignore"
+	"repobook/internal/render"
 	"repobook/internal/util"
 )
 
-// Fallback performs a best-effort fixed-string search without relying on ripgrep.
-// It scans markdown files under rootAbs, respecting .gitignore (best-effort) and
-// common heavyweight directories.
+// fallbackBudget bounds how long one Fallback search may run.
+const fallbackBudget = 3 * time.Second
+
+// Fallback performs a best-effort search without relying on ripgrep.
+// It scans markdown files under rootAbs that are not excluded by ig.
+//
+// Files are searched concurrently by a small worker pool, but results come
+// back in walk order (by path, then line), as a sequential scan would
+// return them. Lines are matched with q.MatchLine and front matter with
+// q.MatchMeta; it returns up to limit results.
 //
-// It is intentionally simple: fixed-string match with smart-case, returns up to
-// limit results, and stops after a small time budget.
-func Fallback(rootAbs string, ig *ignore.Matcher, query string, limit int) (Response, error) {
-	query = strings.TrimSpace(query)
-	if query == "" {
-		return Response{Query: query, Results: nil, Truncated: false}, nil
+// The scan runs for at most a few seconds; when that budget runs out, the
+// results found so far, in order, are returned as truncated. Cancelling ctx
+// stops the scan and returns ctx's error.
+func Fallback(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int) (Response, error) {
+	return FallbackStream(ctx, rootAbs, ig, q, limit, nil)
+}
+
+// FallbackStream is Fallback, additionally calling emit with each result, in
+// order, as soon as it is known.
+func FallbackStream(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int, emit func(Result)) (Response, error) {
+	return fallback(ctx, rootAbs, ig, q, limit, emit, fallbackWorkers())
+}
+
+func fallbackWorkers() int {
+	return max(2, runtime.GOMAXPROCS(0))
+}
+
+type fileJob struct {
+	seq int // walk order
+	rel string
+	abs string
+}
+
+type fileHits struct {
+	seq     int
+	results []Result
+	partial bool // stopped early by the time budget
+}
+
+func fallback(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int, emit func(Result), workers int) (Response, error) {
+	if q.Empty() {
+		return Response{Query: q.Raw, Results: nil, Truncated: false}, nil
 	}
 	if limit <= 0 {
 		limit = 200
 	}
 
-	deadline := time.Now().Add(3 * time.Second)
-	resp := Response{Query: query, Results: make([]Result, 0, 32)}
+	budget, cancel := context.WithTimeout(ctx, fallbackBudget)
+	defer cancel()
+
+	jobs := make(chan fileJob, workers)
+	go func() {
+		defer close(jobs)
+		seq := 0
+		_ = filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				// Best-effort; ignore unreadable entries.
+				return nil
+			}
+			relOS, err := filepath.Rel(rootAbs, p)
+			if err != nil {
+				return nil
+			}
+			rel := filepath.ToSlash(relOS)
+			if rel == "." {
+				return nil
+			}
+			if d.IsDir() {
+				if ig != nil && ig.IsIgnored(rel, true) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if ig != nil && ig.IsIgnored(rel, false) {
+				return nil
+			}
+			if !util.IsMarkdownFileName(d.Name()) || !q.MatchPath(rel) {
+				return nil
+			}
+			select {
+			case jobs <- fileJob{seq: seq, rel: path.Clean(rel), abs: p}:
+				seq++
+				return nil
+			case <-budget.Done():
+				return fs.SkipAll
+			}
+		})
+	}()
 
-	ignoreDirs := map[string]struct{}{
-		".git":         {},
-		"node_modules": {},
-		"vendor":       {},
-		".idea":        {},
-		".vscode":      {},
+	hits := make(chan fileHits, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				h := searchFile(budget, job, q, limit)
+				select {
+				case hits <- h:
+				case <-budget.Done():
+					return
+				}
+			}
+		}()
 	}
+	go func() {
+		wg.Wait()
+		close(hits)
+	}()
 
-	caseSensitive := false
-	for _, r := range query {
-		if 'A' <= r && r <= 'Z' {
-			caseSensitive = true
-			break
+	// Put files back in walk order before handing out results.
+	resp := Response{Query: q.Raw, Results: make([]Result, 0, 32), Engine: EngineFallback}
+	pending := make(map[int]fileHits)
+	next := 0
+collect:
+	for h := range hits {
+		pending[h.seq] = h
+		for {
+			h, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			for _, r := range h.results {
+				resp.Results = append(resp.Results, r)
+				if emit != nil {
+					emit(r)
+				}
+				if len(resp.Results) >= limit {
+					resp.Truncated = true
+					break collect
+				}
+			}
+			if h.partial {
+				resp.Truncated = true
+				break collect
+			}
 		}
 	}
+	budgetErr := budget.Err()
+	cancel()
 
-	qLower := ""
-	if !caseSensitive {
-		qLower = strings.ToLower(query)
+	// The time budget truncates; a cancelled request is an error.
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+	if errors.Is(budgetErr, context.DeadlineExceeded) {
+		resp.Truncated = true
 	}
+	return resp, nil
+}
 
-	err := filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			// Best-effort; ignore unreadable entries.
-			return nil
+// searchFile returns up to limit matching lines of one file, annotated with
+// their sections. For a Listing query it returns the file's listing instead.
+func searchFile(budget context.Context, job fileJob, q Query, limit int) fileHits {
+	h := fileHits{seq: job.seq}
+	src, err := os.ReadFile(job.abs)
+	if err != nil {
+		return h
+	}
+	if q.needsMeta() {
+		if meta, _ := frontmatter.Split(src); !q.MatchMeta(meta) {
+			return h
+		}
+	}
+	if q.Listing() {
+		if q.excludes(string(src)) {
+			return h
 		}
-		if time.Now().After(deadline) {
-			resp.Truncated = true
-			return fs.SkipAll
+		hs := render.Outline(src)
+		h.results = listDoc(q, job.rel, docTitle(job.rel, hs), hs)
+		if len(h.results) > limit {
+			h.results = h.results[:limit]
 		}
+		return h
+	}
 
-		relOS, err := filepath.Rel(rootAbs, p)
-		if err != nil {
-			return nil
-		}
-		rel := filepath.ToSlash(relOS)
-		if rel == "." {
-			rel = ""
+	// For fixed strings, only lines holding a hit of the first term can
+	// match; one pass over the file finds them. Regexes may match across
+	// lines, so there every line is checked once the file passes mayMatch.
+	var hits [][]int
+	if q.Regex {
+		if !q.mayMatch(src) {
+			return h
 		}
+	} else if hits = q.terms[0].FindAllIndex(src, -1); len(hits) == 0 {
+		return h
+	}
 
-		if d.IsDir() {
-			if _, ok := ignoreDirs[d.Name()]; ok {
-				return fs.SkipDir
+	var hs []render.Heading // outline, parsed at the first hit
+	var lines []string      // for context, split at the first hit
+	lineNo, off := 0, 0
+	for rest := src; len(rest) > 0 && len(h.results) < limit; {
+		lineNo++
+		if lineNo%256 == 0 && budget.Err() != nil {
+			h.partial = true
+			break
+		}
+		var line []byte
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			line, rest = rest[:i], rest[i+1:]
+		} else {
+			line, rest = rest, nil
+		}
+		start := off
+		off += len(line) + 1
+		if !q.Regex {
+			for len(hits) > 0 && hits[0][0] < start {
+				hits = hits[1:]
 			}
-			if ig != nil && rel != "" && ig.IsIgnored(rel, true) {
-				return fs.SkipDir
+			if len(hits) == 0 {
+				break
+			}
+			if hits[0][0] >= off {
+				continue
 			}
-			return nil
 		}
 
-		if rel != "" && ig != nil && ig.IsIgnored(rel, false) {
-			return nil
+		text := strings.TrimRight(string(line), "\r")
+		if text == "" {
+			continue
 		}
-
-		if !util.IsMarkdownFileName(d.Name()) {
-			return nil
+		matches, ok := q.MatchLine(text)
+		if !ok {
+			continue
 		}
-
-		f, err := os.Open(p)
-		if err != nil {
-			return nil
-		}
-		defer f.Close()
-
-		s := bufio.NewScanner(f)
-		// Allow larger lines than the default 64K.
-		s.Buffer(make([]byte, 0, 64*1024), 1024*1024)
-		lineNo := 0
-		for s.Scan() {
-			lineNo++
-			if time.Now().After(deadline) {
-				resp.Truncated = true
-				return fs.SkipAll
+		r := Result{Path: job.rel, Line: lineNo, Preview: text, Matches: matches}
+		if !q.lazySections || q.needsHeading() {
+			if hs == nil {
+				hs = render.Outline(src)
 			}
-			line := strings.TrimRight(s.Text(), "\r\n")
-			if line == "" {
-				continue
+			if hd, ok := enclosingHeading(hs, lineNo); ok {
+				r.Heading, r.Anchor = hd.Title, hd.ID
 			}
-			matched := false
-			if caseSensitive {
-				matched = strings.Contains(line, query)
-			} else {
-				matched = strings.Contains(strings.ToLower(line), qLower)
-			}
-			if !matched {
+			if !q.MatchHeading(r.Heading) {
 				continue
 			}
-
-			resp.Results = append(resp.Results, Result{Path: path.Clean(rel), Line: lineNo, Preview: line})
-			if len(resp.Results) >= limit {
-				resp.Truncated = true
-				return fs.SkipAll
-			}
 		}
-		return nil
-	})
-	if err != nil {
-		return Response{}, err
+		if lines == nil && (q.Before > 0 || q.After > 0) {
+			lines = splitLines(src)
+		}
+		q.withContext(&r, lines, 1)
+		h.results = append(h.results, r)
 	}
-
-	return resp, nil
+	return h
 }
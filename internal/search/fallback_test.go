@@ -1,8 +1,13 @@
 package search
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"repobook/internal/ignore"
@@ -39,7 +44,7 @@ func TestFallback_SearchesMarkdownOnly_RespectsIgnore(t *testing.T) {
 		t.Fatalf("ignore.Load: %v", err)
 	}
 
-	res, err := Fallback(root, ig, "Alpha", 200)
+	res, err := Fallback(context.Background(), root, ig, mustQuery(t, "Alpha"), 200)
 	if err != nil {
 		t.Fatalf("Fallback: %v", err)
 	}
@@ -61,7 +66,7 @@ func TestFallback_SmartCase(t *testing.T) {
 	}
 
 	// Lowercase query => case-insensitive => matches both lines.
-	res, err := Fallback(root, nil, "alpha", 200)
+	res, err := Fallback(context.Background(), root, nil, mustQuery(t, "alpha"), 200)
 	if err != nil {
 		t.Fatalf("Fallback: %v", err)
 	}
@@ -70,7 +75,7 @@ func TestFallback_SmartCase(t *testing.T) {
 	}
 
 	// Uppercase in query => case-sensitive => matches only the 'Alpha' line.
-	res2, err := Fallback(root, nil, "Alpha", 200)
+	res2, err := Fallback(context.Background(), root, nil, mustQuery(t, "Alpha"), 200)
 	if err != nil {
 		t.Fatalf("Fallback: %v", err)
 	}
@@ -88,7 +93,7 @@ func TestFallback_LimitTruncates(t *testing.T) {
 		t.Fatalf("write note.md: %v", err)
 	}
 
-	res, err := Fallback(root, nil, "Alpha", 2)
+	res, err := Fallback(context.Background(), root, nil, mustQuery(t, "Alpha"), 2)
 	if err != nil {
 		t.Fatalf("Fallback: %v", err)
 	}
@@ -99,3 +104,155 @@ func TestFallback_LimitTruncates(t *testing.T) {
 		t.Fatalf("expected truncated")
 	}
 }
+
+func TestFallback_SectionAndMatches(t *testing.T) {
+	root := t.TempDir()
+	body := "# Guide\n\nintro\n\n## Install Steps\n\nRun the alpha installer, then ALPHA again.\n"
+	if err := os.WriteFile(filepath.Join(root, "guide.md"), []byte(body), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	res, err := Fallback(context.Background(), root, nil, mustQuery(t, "alpha"), 200)
+	if err != nil {
+		t.Fatalf("Fallback: %v", err)
+	}
+	if len(res.Results) != 1 {
+		t.Fatalf("expected 1 result, got %d", len(res.Results))
+	}
+	r := res.Results[0]
+	if r.Heading != "Install Steps" || r.Anchor != "install-steps" {
+		t.Fatalf("expected enclosing heading Install Steps/install-steps, got %q/%q", r.Heading, r.Anchor)
+	}
+	if len(r.Matches) != 2 {
+		t.Fatalf("expected 2 matches, got %+v", r.Matches)
+	}
+	for _, m := range r.Matches {
+		if got := r.Preview[m.Start:m.End]; !strings.EqualFold(got, "alpha") {
+			t.Fatalf("match range %+v selects %q", m, got)
+		}
+	}
+}
+
+func TestFallback_CancelledContext(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "note.md"), []byte("Alpha\n"), 0o644); err != nil {
+		t.Fatalf("write note.md: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Fallback(ctx, root, nil, mustQuery(t, "Alpha"), 200); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestFallbackStream_EmitsEachResult(t *testing.T) {
+	root := t.TempDir()
+	body := "# Guide\n\nalpha one\n\n## More\n\nalpha two\n"
+	if err := os.WriteFile(filepath.Join(root, "guide.md"), []byte(body), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	var streamed []Result
+	res, err := FallbackStream(context.Background(), root, nil, mustQuery(t, "alpha"), 200, func(r Result) {
+		streamed = append(streamed, r)
+	})
+	if err != nil {
+		t.Fatalf("FallbackStream: %v", err)
+	}
+	if !reflect.DeepEqual(streamed, res.Results) {
+		t.Fatalf("streamed %+v, returned %+v", streamed, res.Results)
+	}
+	if len(streamed) != 2 || streamed[1].Anchor != "more" {
+		t.Fatalf("expected 2 annotated results, got %+v", streamed)
+	}
+}
+
+func TestFallback_ParallelOrderIsDeterministic(t *testing.T) {
+	root := t.TempDir()
+	writeBenchCorpus(t, root, 40, 30)
+
+	want, err := fallback(context.Background(), root, nil, mustQuery(t, "alpha"), 10000, nil, 1)
+	if err != nil {
+		t.Fatalf("sequential fallback: %v", err)
+	}
+	if len(want.Results) != 40*3 {
+		t.Fatalf("expected %d results, got %d", 40*3, len(want.Results))
+	}
+	for i := 0; i < 5; i++ {
+		var streamed []Result
+		got, err := fallback(context.Background(), root, nil, mustQuery(t, "alpha"), 10000, func(r Result) {
+			streamed = append(streamed, r)
+		}, 8)
+		if err != nil {
+			t.Fatalf("parallel fallback: %v", err)
+		}
+		if !reflect.DeepEqual(got.Results, want.Results) || !reflect.DeepEqual(streamed, want.Results) {
+			t.Fatalf("parallel results differ from sequential order")
+		}
+	}
+
+	// Stopping at the limit keeps the same prefix.
+	got, err := fallback(context.Background(), root, nil, mustQuery(t, "alpha"), 7, nil, 8)
+	if err != nil {
+		t.Fatalf("parallel fallback: %v", err)
+	}
+	if !got.Truncated || !reflect.DeepEqual(got.Results, want.Results[:7]) {
+		t.Fatalf("expected the first 7 results, truncated; got %d (truncated=%v)", len(got.Results), got.Truncated)
+	}
+}
+
+// BenchmarkFallback compares a single worker with the default pool on a
+// tree of many documents. Run with:
+//
+//	go test ./internal/search -run '^$' -bench Fallback
+func BenchmarkFallback(b *testing.B) {
+	root := b.TempDir()
+	writeBenchCorpus(b, root, 400, 400)
+	q, err := ParseQuery("alpha", QueryOptions{})
+	if err != nil {
+		b.Fatalf("ParseQuery: %v", err)
+	}
+
+	for _, bc := range []struct {
+		name    string
+		workers int
+	}{
+		{"sequential", 1},
+		{"parallel", fallbackWorkers()},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := fallback(context.Background(), root, nil, q, 100000, nil, bc.workers); err != nil {
+					b.Fatalf("fallback: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// writeBenchCorpus writes files markdown documents of lines lines each,
+// spread over a few directories, with three "alpha" hits per document.
+func writeBenchCorpus(tb testing.TB, root string, files, lines int) {
+	tb.Helper()
+	var sb strings.Builder
+	sb.WriteString("# Doc\n\n")
+	for i := 0; i < lines; i++ {
+		switch i {
+		case lines / 4, lines / 2, lines - 1:
+			sb.WriteString("a line that mentions alpha somewhere\n")
+		default:
+			sb.WriteString("some ordinary prose about deployments, builds and releases\n")
+		}
+	}
+	body := []byte(sb.String())
+	for i := 0; i < files; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%02d", i%8))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			tb.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("doc%03d.md", i)), body, 0o644); err != nil {
+			tb.Fatalf("write: %v", err)
+		}
+	}
+}
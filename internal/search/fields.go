@@ -0,0 +1,178 @@
+package search
+
+import (
+	"strings"
+
+	"repobook/internal/frontmatter"
+	"repobook/internal/render"
+)
+
+// Field filter names.
+const (
+	FieldTag     = "tag"
+	FieldOwner   = "owner"
+	FieldStatus  = "status"
+	FieldAuthor  = "author"
+	FieldHeading = "heading"
+)
+
+// fieldNames maps the prefixes accepted in query text to field names.
+var fieldNames = map[string]string{
+	"tag":     FieldTag,
+	"tags":    FieldTag,
+	"owner":   FieldOwner,
+	"owners":  FieldOwner,
+	"status":  FieldStatus,
+	"author":  FieldAuthor,
+	"authors": FieldAuthor,
+	"heading": FieldHeading,
+}
+
+// metaKeys are the front matter keys read for each field, singular and
+// plural spellings alike.
+var metaKeys = map[string][]string{
+	FieldTag:    {"tags", "tag"},
+	FieldOwner:  {"owner", "owners"},
+	FieldStatus: {"status"},
+	FieldAuthor: {"authors", "author"},
+}
+
+// FieldFilter restricts results by document metadata. Front matter fields
+// match when the field, or any element of a list, equals Value ignoring
+// case. The heading field matches results whose enclosing heading contains
+// Value, ignoring case.
+type FieldFilter struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func (f FieldFilter) matchMeta(m frontmatter.Meta) bool {
+	for _, key := range metaKeys[f.Field] {
+		for _, v := range m.List(key) {
+			if strings.EqualFold(strings.TrimSpace(v), f.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f FieldFilter) matchHeading(h string) bool {
+	return strings.Contains(strings.ToLower(h), strings.ToLower(f.Value))
+}
+
+// needsMeta reports whether the query filters on front matter.
+func (q Query) needsMeta() bool {
+	for _, fs := range [][]FieldFilter{q.Fields, q.NotFields} {
+		for _, f := range fs {
+			if f.Field != FieldHeading {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchMeta reports whether a document's front matter passes the field
+// filters. Heading filters are ignored here; see MatchHeading.
+func (q Query) MatchMeta(m frontmatter.Meta) bool {
+	for _, f := range q.Fields {
+		if f.Field != FieldHeading && !f.matchMeta(m) {
+			return false
+		}
+	}
+	for _, f := range q.NotFields {
+		if f.Field != FieldHeading && f.matchMeta(m) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchHeading reports whether a result under heading h passes the heading
+// filters.
+func (q Query) MatchHeading(h string) bool {
+	for _, f := range q.Fields {
+		if f.Field == FieldHeading && !f.matchHeading(h) {
+			return false
+		}
+	}
+	for _, f := range q.NotFields {
+		if f.Field == FieldHeading && f.matchHeading(h) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q Query) hasHeadingFilter() bool {
+	for _, f := range q.Fields {
+		if f.Field == FieldHeading {
+			return true
+		}
+	}
+	return false
+}
+
+// needsHeading reports whether the query filters on the enclosing heading,
+// so line hits must be annotated with their sections before matching.
+func (q Query) needsHeading() bool {
+	for _, fs := range [][]FieldFilter{q.Fields, q.NotFields} {
+		for _, f := range fs {
+			if f.Field == FieldHeading {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// excludes reports whether any excluded term occurs in text.
+func (q Query) excludes(text string) bool {
+	for _, re := range q.exclude {
+		if len(q.find(re, text)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// listDoc returns the results of a Listing query for a document that passed
+// its path and front matter filters: one result per matching heading if the
+// query has heading filters, otherwise a single result for the document.
+// title is the document title and hs its outline.
+func listDoc(q Query, rel, title string, hs []render.Heading) []Result {
+	if !q.hasHeadingFilter() {
+		return []Result{{Path: rel, Line: 1, Preview: title, Title: title}}
+	}
+	var out []Result
+	for _, h := range hs {
+		if !q.MatchHeading(h.Title) {
+			continue
+		}
+		var ms []Match
+		for _, re := range q.headings {
+			ms = append(ms, q.find(re, h.Title)...)
+		}
+		out = append(out, Result{
+			Path:    rel,
+			Line:    h.Line,
+			Preview: h.Title,
+			Heading: h.Title,
+			Anchor:  h.ID,
+			Matches: mergeMatches(ms),
+			Title:   title,
+		})
+	}
+	return out
+}
+
+// docTitle is the first level-one heading of a document, or its file name.
+func docTitle(rel string, hs []render.Heading) string {
+	for _, h := range hs {
+		if h.Level == 1 {
+			return h.Title
+		}
+	}
+	return rel[strings.LastIndexByte(rel, '/')+1:]
+}
@@ -0,0 +1,257 @@
+package search
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"repobook/internal/git"
+	"repobook/internal/ignore"
+)
+
+// historyBudget bounds how long one History search may run; walking the
+// diffs of a long history is slower than searching the working tree.
+const historyBudget = 5 * time.Second
+
+// Commit identifies where in git history a History result was found.
+type Commit struct {
+	Hash    string    `json:"hash"`
+	Date    time.Time `json:"date"`
+	Author  string    `json:"author"`
+	Subject string    `json:"subject"`
+	// Change is "added" or "removed": what the commit did to the line.
+	Change string `json:"change"`
+	// Rev is the revision in which Result.Path has the line at Result.Line:
+	// the commit itself for added lines, its parent for removed ones.
+	Rev string `json:"rev"`
+}
+
+// Changes reported in Commit.Change.
+const (
+	ChangeAdded   = "added"
+	ChangeRemoved = "removed"
+)
+
+// History searches the lines that past commits added to or removed from
+// markdown files under rootAbs, newest commit first. It is a pickaxe search
+// (git log -G) for the first term of q; every changed line is then checked
+// with q.MatchLine, so a line deleted long ago is found in the commit that
+// deleted it. Paths are filtered through ig and q's path filters; field
+// filters need the documents' state at each commit and are rejected with
+// ErrInvalidQuery. Results carry no context lines.
+//
+// Like Ripgrep, History stops after a time budget and returns the results
+// found so far as truncated, and cancelling ctx stops git and returns ctx's
+// error. It fails with git.ErrNotRepo outside a git work tree and
+// git.ErrNotFound if git is not installed.
+func History(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int) (Response, error) {
+	return HistoryStream(ctx, rootAbs, ig, q, limit, nil)
+}
+
+// HistoryStream is History, additionally calling emit with each result as
+// soon as it is found.
+func HistoryStream(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int, emit func(Result)) (Response, error) {
+	if len(q.Fields) > 0 || len(q.NotFields) > 0 {
+		return Response{}, fmt.Errorf("%w: field filters are not supported in history search", ErrInvalidQuery)
+	}
+	if q.Empty() {
+		return Response{Query: q.Raw, Results: nil, Truncated: false}, nil
+	}
+	if limit <= 0 {
+		limit = 200
+	}
+
+	budget, cancel := context.WithTimeout(ctx, historyBudget)
+	defer cancel()
+
+	args := []string{
+		"log",
+		"--relative",
+		"--patch",
+		"--unified=0",
+		"--no-color",
+		"--no-ext-diff",
+		"--src-prefix=a/",
+		"--dst-prefix=b/",
+		"--format=%x00%H%x09%P%x09%ct%x09%an%x09%s",
+	}
+	// Regexes are RE2 and git's are POSIX, so regex queries walk every
+	// diff and rely on MatchLine alone.
+	if !q.Regex {
+		args = append(args, "--extended-regexp", "-G"+quoteERE(q.Terms[0]))
+		if !q.caseSensitive() {
+			args = append(args, "--regexp-ignore-case")
+		}
+	}
+	args = append(args, "--", "*.md", "*.markdown")
+	cmd, err := git.Command(budget, rootAbs, args...)
+	if err != nil {
+		return Response{}, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return Response{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return Response{}, err
+	}
+
+	resp := Response{Query: q.Raw, Results: make([]Result, 0, 32), Engine: EngineHistory}
+	var (
+		commit           Commit
+		parent           string
+		oldPath, newPath string
+		oldLine, newLine int
+		oldLeft, newLeft int // lines left in the current hunk
+	)
+	// add records a changed line if it matches and reports whether the
+	// limit is reached.
+	add := func(p string, line int, text, change, rev string) bool {
+		if p == "" || (ig != nil && ig.IsIgnored(p, false)) || !q.MatchPath(p) {
+			return false
+		}
+		matches, ok := q.MatchLine(text)
+		if !ok {
+			return false
+		}
+		c := commit
+		c.Change, c.Rev = change, rev
+		res := Result{Path: p, Line: line, Commit: &c}
+		res.Preview, res.Matches = window(text, matches)
+		resp.Results = append(resp.Results, res)
+		if emit != nil {
+			emit(res)
+		}
+		if len(resp.Results) >= limit {
+			resp.Truncated = true
+			return true
+		}
+		return false
+	}
+
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64*1024), 4<<20)
+scan:
+	for s.Scan() {
+		line := s.Text()
+		if oldLeft > 0 || newLeft > 0 {
+			text := strings.TrimRight(line[min(1, len(line)):], "\r")
+			switch {
+			case strings.HasPrefix(line, "-") && oldLeft > 0:
+				oldLeft--
+				if add(oldPath, oldLine, text, ChangeRemoved, parent) {
+					break scan
+				}
+				oldLine++
+				continue
+			case strings.HasPrefix(line, "+") && newLeft > 0:
+				newLeft--
+				if add(newPath, newLine, text, ChangeAdded, commit.Hash) {
+					break scan
+				}
+				newLine++
+				continue
+			case strings.HasPrefix(line, `\`):
+				// "\ No newline at end of file"
+				continue
+			}
+			oldLeft, newLeft = 0, 0
+		}
+		switch {
+		case strings.HasPrefix(line, "\x00"):
+			commit, parent = parseCommitLine(line[1:])
+			oldPath, newPath = "", ""
+		case strings.HasPrefix(line, "diff --git "):
+			oldPath, newPath = "", ""
+		case strings.HasPrefix(line, "--- "):
+			oldPath = diffPath(line[4:], "a/")
+		case strings.HasPrefix(line, "+++ "):
+			newPath = diffPath(line[4:], "b/")
+		case strings.HasPrefix(line, "@@ "):
+			oldLine, oldLeft, newLine, newLeft = parseHunkHeader(line)
+		}
+	}
+
+	_ = stdout.Close()
+	if resp.Truncated {
+		// Stop git rather than let it fail writing to the closed pipe.
+		cancel()
+	}
+	waitErr := cmd.Wait()
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+	if resp.Truncated {
+		return resp, nil
+	}
+	if budget.Err() != nil {
+		// Out of time: keep what was found so far.
+		resp.Truncated = true
+		return resp, nil
+	}
+	if waitErr != nil {
+		return Response{}, git.Error(waitErr, stderr.String())
+	}
+	return resp, nil
+}
+
+// parseCommitLine reads the header line written by History's --format:
+// hash, parents, commit time, author and subject, separated by tabs.
+func parseCommitLine(line string) (Commit, string) {
+	f := strings.SplitN(line, "\t", 5)
+	for len(f) < 5 {
+		f = append(f, "")
+	}
+	c := Commit{Hash: f[0], Author: f[3], Subject: f[4]}
+	if ts, err := strconv.ParseInt(f[2], 10, 64); err == nil {
+		c.Date = time.Unix(ts, 0).UTC()
+	}
+	parent, _, _ := strings.Cut(f[1], " ")
+	return c, parent
+}
+
+// diffPath strips the prefix from a "---" or "+++" file name; /dev/null
+// becomes "".
+func diffPath(name, prefix string) string {
+	name = strings.TrimRight(name, "\t")
+	if name == "/dev/null" {
+		return ""
+	}
+	return strings.TrimPrefix(name, prefix)
+}
+
+// parseHunkHeader reads "@@ -start[,count] +start[,count] @@".
+func parseHunkHeader(line string) (oldStart, oldCount, newStart, newCount int) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 {
+		return 0, 0, 0, 0
+	}
+	oldStart, oldCount = parseRange(strings.TrimPrefix(fields[1], "-"))
+	newStart, newCount = parseRange(strings.TrimPrefix(fields[2], "+"))
+	return oldStart, oldCount, newStart, newCount
+}
+
+func parseRange(s string) (start, count int) {
+	a, b, ok := strings.Cut(s, ",")
+	start, _ = strconv.Atoi(a)
+	count = 1
+	if ok {
+		count, _ = strconv.Atoi(b)
+	}
+	return start, count
+}
+
+// quoteERE escapes s for use as a literal in a POSIX extended regular
+// expression.
+func quoteERE(s string) string {
+	return ereSpecial.ReplaceAllString(s, `\$0`)
+}
+
+var ereSpecial = regexp.MustCompile(`[\\.^$|?*+()\[\]{}]`)
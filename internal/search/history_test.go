@@ -0,0 +1,102 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+	"repobook/internal/git"
+)
+
+// gitRepo creates a repository in a temp dir and returns it with a helper
+// that runs git there.
+func gitRepo(t *testing.T) (string, func(args ...string) string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(t.TempDir(), "gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	root := t.TempDir()
+	run := func(args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=Ana", "-c", "user.email=ana@example.com"}, args...)...)
+		cmd.Dir = root
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	run("init", "-q")
+	return root, run
+}
+
+func TestHistory_FindsRemovedLines(t *testing.T) {
+	root, run := gitRepo(t)
+	bgindextest.WriteDoc(t, root, "docs/guide.md", "# Guide\nUse the legacy installer.\nKeep this.\n")
+	bgindextest.WriteDoc(t, root, "notes.txt", "legacy\n")
+	run("add", ".")
+	run("commit", "-q", "-m", "Add guide")
+	first := run("rev-parse", "HEAD")
+	bgindextest.WriteDoc(t, root, "docs/guide.md", "# Guide\nKeep this.\n")
+	run("commit", "-q", "-am", "Drop the legacy installer")
+	second := run("rev-parse", "HEAD")
+
+	res, err := History(context.Background(), root, nil, mustQuery(t, "legacy"), 10)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	var got []string
+	for _, r := range res.Results {
+		got = append(got, fmt.Sprintf("%s:%d %s %s@%s", r.Path, r.Line, r.Commit.Change, r.Commit.Subject, r.Commit.Rev))
+	}
+	want := []string{
+		"docs/guide.md:2 removed Drop the legacy installer@" + first,
+		"docs/guide.md:2 added Add guide@" + first,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if r := res.Results[0]; r.Commit.Hash != second || r.Commit.Author != "Ana" || r.Commit.Date.IsZero() || len(r.Matches) != 1 {
+		t.Fatalf("unexpected commit details %+v", r.Commit)
+	}
+
+	// Serving a subdirectory reports paths relative to it.
+	res, err = History(context.Background(), filepath.Join(root, "docs"), nil, mustQuery(t, "Legacy"), 10)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(res.Results) != 0 {
+		t.Fatalf("expected smart case to reject lower-case hits, got %+v", res.Results)
+	}
+	res, err = History(context.Background(), filepath.Join(root, "docs"), nil, mustQuery(t, "legacy -path:docs"), 1)
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(res.Results) != 1 || res.Results[0].Path != "guide.md" || !res.Truncated {
+		t.Fatalf("expected one truncated result for guide.md, got %+v", res)
+	}
+}
+
+func TestHistory_Errors(t *testing.T) {
+	root, _ := gitRepo(t)
+	if _, err := History(context.Background(), root, nil, mustQuery(t, "x tag:runbook"), 10); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for field filters, got %v", err)
+	}
+	if _, err := History(context.Background(), t.TempDir(), nil, mustQuery(t, "x"), 10); !errors.Is(err, git.ErrNotRepo) {
+		t.Fatalf("expected git.ErrNotRepo outside a repository, got %v", err)
+	}
+}
+
+func TestQuoteERE(t *testing.T) {
+	if got := quoteERE(`a.b(c)*[d]`); got != `a\.b\(c\)\*\[d\]` {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,519 @@
+package search
+
+import (
+	"bytes"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"repobook/internal/bgindex"
+	"repobook/internal/frontmatter"
+	"repobook/internal/ignore"
+	"repobook/internal/render"
+	"repobook/internal/util"
+)
+
+// Field weights and BM25 parameters. A query term in a document title counts
+// like several body occurrences; headings sit in between.
+const (
+	weightTitle   = 3.0
+	weightHeading = 2.0
+	weightBody    = 1.0
+
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+const (
+	fieldTitle = iota
+	fieldHeading
+	fieldBody
+	numFields
+)
+
+var fieldWeights = [numFields]float64{weightTitle, weightHeading, weightBody}
+
+// Index is an in-memory inverted index over the sections of all markdown
+// documents in a tree, ranked with BM25F. A section is the text between two
+// headings; each section is scored on its document title, its heading and
+// its body.
+//
+// The index is built in the background and kept current with Update and
+// Refresh, which are cheap to call from the watcher: work is queued and
+// coalesced on a single worker goroutine (see bgindex).
+type Index struct {
+	rootAbs string
+	ignore  func() *ignore.Matcher
+	queue   *bgindex.Queue
+
+	mu       sync.RWMutex
+	sections map[int]*section
+	byPath   map[string]*indexedDoc
+	postings map[string]map[int]*posting
+	fieldLen [numFields]int // total tokens per field, for average lengths
+	nextID   int
+}
+
+type indexedDoc struct {
+	mtime    int64
+	title    string
+	meta     frontmatter.Meta
+	sections []int
+}
+
+type section struct {
+	path     string
+	title    string   // document title
+	heading  string   // "" for text before the first heading
+	anchor   string   // heading ID, as in the rendered TOC
+	line     int      // first line of the section (1-based)
+	lines    []string // raw source lines of the section
+	fieldLen [numFields]int
+}
+
+type posting struct {
+	tf [numFields]int
+}
+
+// NewIndex creates an empty index for rootAbs and starts its worker. ig is
+// consulted on every scan so live ignore rule changes are respected. Call
+// Refresh to build it.
+func NewIndex(rootAbs string, ig func() *ignore.Matcher) *Index {
+	idx := &Index{
+		rootAbs:  rootAbs,
+		ignore:   ig,
+		sections: make(map[int]*section),
+		byPath:   make(map[string]*indexedDoc),
+		postings: make(map[string]map[int]*posting),
+	}
+	idx.queue = bgindex.New(idx.scan, idx.indexFile)
+	return idx
+}
+
+func (idx *Index) Close() {
+	idx.queue.Close()
+}
+
+// Ready reports whether the initial build has finished.
+func (idx *Index) Ready() bool {
+	return idx.queue.Ready()
+}
+
+// Update queues a re-index of one document (repo-relative path). Deleted or
+// ignored documents are dropped from the index.
+func (idx *Index) Update(rel string) {
+	idx.queue.Update(rel)
+}
+
+// Refresh queues a rescan of the whole tree. Unchanged documents (same
+// mtime) are not re-read.
+func (idx *Index) Refresh() {
+	idx.queue.Refresh()
+}
+
+// scan walks the tree, (re)indexing new and modified documents and dropping
+// ones that disappeared or became ignored.
+func (idx *Index) scan() {
+	ig := idx.ignore()
+	seen := make(map[string]struct{})
+	_ = filepath.WalkDir(idx.rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return nil
+		}
+		relOS, err := filepath.Rel(idx.rootAbs, p)
+		if err != nil {
+			return nil
+		}
+		rel := filepath.ToSlash(relOS)
+		if rel == "." {
+			return nil
+		}
+		if ig.IsIgnored(rel, d.IsDir()) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !util.IsMarkdownFileName(d.Name()) {
+			return nil
+		}
+		seen[rel] = struct{}{}
+		idx.indexFile(rel)
+		return nil
+	})
+
+	idx.mu.Lock()
+	for rel := range idx.byPath {
+		if _, ok := seen[rel]; !ok {
+			idx.removeLocked(rel)
+		}
+	}
+	idx.mu.Unlock()
+}
+
+// indexFile (re)indexes one document if it changed since it was last seen.
+func (idx *Index) indexFile(rel string) {
+	abs, _, err := util.ResolveRepoPath(idx.rootAbs, rel)
+	st, statErr := os.Stat(abs)
+	if err != nil || statErr != nil || st.IsDir() || !util.IsMarkdownFileName(path.Base(rel)) || idx.ignore().IsIgnored(rel, false) {
+		idx.mu.Lock()
+		idx.removeLocked(rel)
+		idx.mu.Unlock()
+		return
+	}
+
+	mtime := st.ModTime().UnixNano()
+	idx.mu.RLock()
+	d, ok := idx.byPath[rel]
+	unchanged := ok && d.mtime == mtime
+	idx.mu.RUnlock()
+	if unchanged {
+		return
+	}
+
+	src, err := os.ReadFile(abs)
+	if err != nil {
+		return
+	}
+	secs, title := splitSections(rel, src)
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(rel)
+	meta, _ := frontmatter.Split(src)
+	doc := &indexedDoc{mtime: mtime, title: title, meta: meta}
+	for _, s := range secs {
+		id := idx.nextID
+		idx.nextID++
+		idx.sections[id] = s
+		doc.sections = append(doc.sections, id)
+
+		fields := [numFields]string{s.title, s.heading, strings.Join(s.lines, "\n")}
+		for f, text := range fields {
+			toks := tokenize(text)
+			s.fieldLen[f] = len(toks)
+			idx.fieldLen[f] += len(toks)
+			for _, tok := range toks {
+				ps := idx.postings[tok]
+				if ps == nil {
+					ps = make(map[int]*posting)
+					idx.postings[tok] = ps
+				}
+				p := ps[id]
+				if p == nil {
+					p = &posting{}
+					ps[id] = p
+				}
+				p.tf[f]++
+			}
+		}
+	}
+	idx.byPath[rel] = doc
+}
+
+func (idx *Index) removeLocked(rel string) {
+	doc, ok := idx.byPath[rel]
+	if !ok {
+		return
+	}
+	for _, id := range doc.sections {
+		s := idx.sections[id]
+		fields := [numFields]string{s.title, s.heading, strings.Join(s.lines, "\n")}
+		for f, text := range fields {
+			idx.fieldLen[f] -= s.fieldLen[f]
+			for _, tok := range tokenize(text) {
+				if ps := idx.postings[tok]; ps != nil {
+					delete(ps, id)
+					if len(ps) == 0 {
+						delete(idx.postings, tok)
+					}
+				}
+			}
+		}
+		delete(idx.sections, id)
+	}
+	delete(idx.byPath, rel)
+}
+
+// splitSections cuts a document into heading-delimited sections.
+func splitSections(rel string, src []byte) ([]*section, string) {
+	headings := render.Outline(src)
+	title := docTitle(rel, headings)
+
+	lines := strings.Split(string(bytes.ReplaceAll(src, []byte("\r\n"), []byte("\n"))), "\n")
+	secs := make([]*section, 0, len(headings)+1)
+	start := 1
+	heading, anchor := "", ""
+	emit := func(end int) {
+		// Lines start..end-1 (1-based).
+		if end <= start && heading == "" {
+			return
+		}
+		s := &section{path: rel, title: title, heading: heading, anchor: anchor, line: start}
+		if end > start {
+			s.lines = lines[start-1 : end-1]
+		}
+		secs = append(secs, s)
+	}
+	for _, h := range headings {
+		if h.Line <= 0 || h.Line > len(lines) {
+			continue
+		}
+		emit(h.Line)
+		start, heading, anchor = h.Line, h.Title, h.ID
+	}
+	emit(len(lines) + 1)
+	return secs, title
+}
+
+// Search returns the best matching sections, highest score first. All query
+// terms are optional (OR semantics); the last term also matches as a prefix
+// so results update while typing. Quoted phrases must occur in a section,
+// excluded terms must not, and path, ext and field filters apply per
+// document. The modes reported by Query.LinesOnly are not honored.
+func (idx *Index) Search(q Query, limit int) Response {
+	resp := Response{Query: q.Raw, Results: nil, Engine: EngineIndex}
+	if q.Empty() {
+		return resp
+	}
+	if limit <= 0 {
+		limit = 200
+	}
+	if q.Listing() {
+		return idx.list(q, limit)
+	}
+	terms := tokenize(strings.Join(q.Terms, " "))
+	if len(terms) == 0 {
+		return resp
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	n := float64(len(idx.sections))
+	if n == 0 {
+		return resp
+	}
+	var avgLen [numFields]float64
+	for f := range avgLen {
+		avgLen[f] = math.Max(1, float64(idx.fieldLen[f])/n)
+	}
+
+	// Expand the last term to all indexed terms it prefixes.
+	expanded := make([][]string, len(terms))
+	for i, t := range terms {
+		expanded[i] = []string{t}
+	}
+	last := terms[len(terms)-1]
+	for tok := range idx.postings {
+		if tok != last && strings.HasPrefix(tok, last) {
+			expanded[len(terms)-1] = append(expanded[len(terms)-1], tok)
+		}
+	}
+
+	scores := make(map[int]float64)
+	accepted := make(map[int]bool)
+	for _, alts := range expanded {
+		for _, tok := range alts {
+			ps := idx.postings[tok]
+			if len(ps) == 0 {
+				continue
+			}
+			df := float64(len(ps))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			for id, p := range ps {
+				s := idx.sections[id]
+				ok, seen := accepted[id]
+				if !seen {
+					ok = s.accepts(q, idx.byPath[s.path].meta)
+					accepted[id] = ok
+				}
+				if !ok {
+					continue
+				}
+				tf := 0.0
+				for f := 0; f < numFields; f++ {
+					if p.tf[f] == 0 {
+						continue
+					}
+					norm := 1 - bm25B + bm25B*float64(s.fieldLen[f])/avgLen[f]
+					tf += fieldWeights[f] * float64(p.tf[f]) / norm
+				}
+				scores[id] += idf * tf / (bm25K1 + tf)
+			}
+		}
+	}
+
+	ids := make([]int, 0, len(scores))
+	for id := range scores {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		sa, sb := idx.sections[a], idx.sections[b]
+		if sa.path != sb.path {
+			return sa.path < sb.path
+		}
+		return sa.line < sb.line
+	})
+	if len(ids) > limit {
+		ids = ids[:limit]
+		resp.Truncated = true
+	}
+
+	resp.Results = make([]Result, 0, len(ids))
+	for _, id := range ids {
+		s := idx.sections[id]
+		line, preview, matches := s.bestLine(expanded)
+		r := Result{
+			Path:    s.path,
+			Line:    line,
+			Preview: preview,
+			Heading: s.heading,
+			Anchor:  s.anchor,
+			Matches: matches,
+			Title:   s.title,
+			Score:   math.Round(scores[id]*1000) / 1000,
+		}
+		q.withContext(&r, s.lines, s.line)
+		resp.Results = append(resp.Results, r)
+	}
+	return resp
+}
+
+// CountFacets is the package's CountFacets, taking the front matter of
+// indexed documents from the index instead of reading every file again.
+func (idx *Index) CountFacets(files []FileHits) *Facets {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return countFacets(idx.rootAbs, files, func(rel string) (frontmatter.Meta, bool) {
+		d, ok := idx.byPath[rel]
+		if !ok {
+			return nil, false
+		}
+		return d.meta, true
+	})
+}
+
+// list answers a Listing query from the indexed documents, in path order.
+func (idx *Index) list(q Query, limit int) Response {
+	resp := Response{Query: q.Raw, Results: []Result{}, Engine: EngineIndex}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	paths := make([]string, 0, len(idx.byPath))
+	for rel, d := range idx.byPath {
+		if q.MatchPath(rel) && q.MatchMeta(d.meta) {
+			paths = append(paths, rel)
+		}
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		d := idx.byPath[rel]
+		hs := make([]render.Heading, 0, len(d.sections))
+		excluded := false
+		for _, id := range d.sections {
+			s := idx.sections[id]
+			for _, re := range q.exclude {
+				excluded = excluded || s.contains(q, re)
+			}
+			if s.heading != "" {
+				hs = append(hs, render.Heading{ID: s.anchor, Title: s.heading, Line: s.line})
+			}
+		}
+		if excluded {
+			continue
+		}
+		for _, r := range listDoc(q, rel, d.title, hs) {
+			if len(resp.Results) >= limit {
+				resp.Truncated = true
+				return resp
+			}
+			resp.Results = append(resp.Results, r)
+		}
+	}
+	return resp
+}
+
+// accepts applies the parts of q that the token index cannot express: file
+// and field filters, phrases and exclusions. meta is the front matter of
+// the section's document.
+func (s *section) accepts(q Query, meta frontmatter.Meta) bool {
+	if !q.MatchPath(s.path) || !q.MatchMeta(meta) || !q.MatchHeading(s.heading) {
+		return false
+	}
+	for i, t := range q.Terms {
+		if strings.IndexFunc(t, unicode.IsSpace) < 0 {
+			continue
+		}
+		if !s.contains(q, q.terms[i]) {
+			return false
+		}
+	}
+	for _, re := range q.exclude {
+		if s.contains(q, re) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *section) contains(q Query, re *regexp.Regexp) bool {
+	if len(q.find(re, s.heading)) > 0 {
+		return true
+	}
+	for _, l := range s.lines {
+		if len(q.find(re, l)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// bestLine picks the section line with the most query term hits for the
+// preview, falling back to the heading line. It also returns the hit ranges
+// within the preview.
+func (s *section) bestLine(terms [][]string) (int, string, []Match) {
+	want := make(map[string]int) // term -> query position
+	for i, alts := range terms {
+		for _, t := range alts {
+			want[t] = i
+		}
+	}
+
+	bestLine, bestHits := s.line, 0
+	preview := s.heading
+	var bestMatches []Match
+	for i, l := range s.lines {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		seen := make(map[int]struct{})
+		var matches []Match
+		for _, sp := range tokenSpans(l) {
+			if q, ok := want[sp.term]; ok {
+				seen[q] = struct{}{}
+				matches = append(matches, Match{Start: sp.start, End: sp.end})
+			}
+		}
+		if len(seen) > bestHits {
+			bestLine, bestHits, preview, bestMatches = s.line+i, len(seen), l, matches
+		}
+	}
+	if preview == "" && len(s.lines) > 0 {
+		preview = strings.TrimSpace(s.lines[0])
+	}
+	return bestLine, preview, bestMatches
+}
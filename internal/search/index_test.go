@@ -0,0 +1,92 @@
+package search
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+	"repobook/internal/ignore"
+)
+
+func TestIndex_RanksTitlesAndHeadingsFirst(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "docs/deploy.md", "# Deployment\n\nHow we ship.\n\n## Rollback\n\nUndo a release.\n")
+	bgindextest.WriteDoc(t, root, "docs/notes.md", "# Notes\n\nWe talked about deployment once.\n\nAnd lunch.\n")
+	bgindextest.WriteDoc(t, root, "docs/other.md", "# Other\n\nNothing relevant.\n")
+
+	idx := newReadyIndex(t, root, nil)
+
+	res := idx.Search(mustQuery(t, "deployment"), 10)
+	if res.Engine != EngineIndex {
+		t.Fatalf("expected engine %q, got %q", EngineIndex, res.Engine)
+	}
+	if len(res.Results) < 2 {
+		t.Fatalf("expected at least 2 results, got %+v", res.Results)
+	}
+	if res.Results[0].Path != "docs/deploy.md" {
+		t.Fatalf("expected the titled document first, got %+v", res.Results)
+	}
+	if res.Results[0].Title != "Deployment" {
+		t.Fatalf("expected document title, got %q", res.Results[0].Title)
+	}
+
+	// Hits point at the matching section, not the top of the document.
+	res = idx.Search(mustQuery(t, "rollback"), 10)
+	if len(res.Results) != 1 || res.Results[0].Line != 5 {
+		t.Fatalf("expected a hit on the Rollback heading (line 5), got %+v", res.Results)
+	}
+	if r := res.Results[0]; r.Heading != "Rollback" || r.Anchor != "rollback" {
+		t.Fatalf("expected section Rollback/rollback, got %q/%q", r.Heading, r.Anchor)
+	}
+	if r := res.Results[0]; len(r.Matches) != 1 || r.Preview[r.Matches[0].Start:r.Matches[0].End] != "Rollback" {
+		t.Fatalf("expected match range on the heading text, got %+v in %q", r.Matches, r.Preview)
+	}
+
+	// The last term matches as a prefix while typing.
+	res = idx.Search(mustQuery(t, "deplo"), 10)
+	if len(res.Results) == 0 || res.Results[0].Path != "docs/deploy.md" {
+		t.Fatalf("expected prefix match, got %+v", res.Results)
+	}
+}
+
+func TestIndex_UpdateAndRemove(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "# A\n\nalpha\n")
+	idx := newReadyIndex(t, root, nil)
+
+	bgindextest.WriteDoc(t, root, "b.md", "# B\n\nbravo\n")
+	idx.Update("b.md")
+	bgindextest.WaitFor(t, func() bool { return len(idx.Search(mustQuery(t, "bravo"), 10).Results) == 1 })
+
+	if err := os.Remove(filepath.Join(root, "a.md")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	idx.Update("a.md")
+	bgindextest.WaitFor(t, func() bool { return len(idx.Search(mustQuery(t, "alpha"), 10).Results) == 0 })
+}
+
+func TestIndex_RespectsIgnore(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, ".gitignore", "private/\n")
+	bgindextest.WriteDoc(t, root, "private/secret.md", "# Secret\n\nalpha\n")
+	bgindextest.WriteDoc(t, root, "public.md", "# Public\n\nalpha\n")
+
+	ig, err := ignore.Load(root)
+	if err != nil {
+		t.Fatalf("ignore.Load: %v", err)
+	}
+	idx := newReadyIndex(t, root, ig)
+
+	res := idx.Search(mustQuery(t, "alpha"), 10)
+	if len(res.Results) != 1 || res.Results[0].Path != "public.md" {
+		t.Fatalf("expected only public.md, got %+v", res.Results)
+	}
+}
+
+func newReadyIndex(t *testing.T, root string, ig *ignore.Matcher) *Index {
+	t.Helper()
+	idx := NewIndex(root, func() *ignore.Matcher { return ig })
+	bgindextest.Ready(t, idx)
+	return idx
+}
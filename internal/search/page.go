@@ -0,0 +1,172 @@
+package search
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Result limits for one page.
+const (
+	DefaultLimit = 200
+	MaxLimit     = 1000
+
+	// countAhead is how many matches past the end of a page are counted
+	// toward Response.Total before the count becomes an estimate.
+	countAhead = 2000
+)
+
+// Page selects a window of results: Limit results after skipping Offset.
+type Page struct {
+	Offset int
+	Limit  int
+}
+
+// FileHits is the number of matches counted in one file.
+type FileHits struct {
+	Path  string `json:"path"`
+	Count int    `json:"count"`
+}
+
+// ParsePage reads the cursor and limit request parameters. An empty cursor
+// starts at the first result; an empty or zero limit means DefaultLimit.
+// Cursors come from Response.Next and are opaque to clients.
+func ParsePage(cursor, limit string) (Page, error) {
+	p := Page{Limit: DefaultLimit}
+	if cursor != "" {
+		n, err := strconv.Atoi(cursor)
+		if err != nil || n < 0 {
+			return Page{}, fmt.Errorf("%w: bad cursor %q", ErrInvalidQuery, cursor)
+		}
+		p.Offset = n
+	}
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 0 {
+			return Page{}, fmt.Errorf("%w: bad limit %q", ErrInvalidQuery, limit)
+		}
+		if n > 0 {
+			p.Limit = min(n, MaxLimit)
+		}
+	}
+	return p, nil
+}
+
+// Pager cuts a page out of the results a backend produces, in order, and
+// counts all of them per file. Pass ScanLimit to the backend as its limit
+// and Add as its emit callback.
+type Pager struct {
+	page     Page
+	emit     func(Result)
+	sections *sectionAnnotator // set by Lazy
+	sorted   bool              // set by Lazy: pages are cut from hits, sorted
+	seen     int
+	hits     []Result // every result, when sorted
+	results  []Result
+	files    []FileHits
+	fileIdx  map[string]int
+}
+
+// NewPager returns a Pager for page. emit, if non-nil, receives the results
+// that fall on the page as they arrive.
+func NewPager(page Page, emit func(Result)) *Pager {
+	if page.Limit <= 0 {
+		page.Limit = DefaultLimit
+	}
+	return &Pager{page: page, emit: emit, fileIdx: make(map[string]int)}
+}
+
+// ScanLimit is how many results the backend should produce: the page plus
+// enough beyond it for a useful total.
+func (p *Pager) ScanLimit() int {
+	return p.page.Offset + p.page.Limit + countAhead
+}
+
+// Lazy returns q set up for a line search backend (RipgrepStream,
+// FallbackStream) to skip locating the section of each hit, which means
+// parsing the outline of every file with hits. The Pager then annotates
+// only the results on the page, reading files under rootAbs; the hits
+// beyond it are merely counted.
+//
+// rg reports files in whatever order its threads finish them, so the Pager
+// also keeps every hit and cuts the page in Response, after sorting them by
+// path and line. Results are then emitted only once the backend is done.
+func (p *Pager) Lazy(q Query, rootAbs string) Query {
+	q.lazySections = true
+	p.sections = newSectionAnnotator(rootAbs)
+	p.sorted = true
+	return q
+}
+
+// Add records the next result from the backend.
+func (p *Pager) Add(r Result) {
+	p.seen++
+	if i, ok := p.fileIdx[r.Path]; ok {
+		p.files[i].Count++
+	} else {
+		p.fileIdx[r.Path] = len(p.files)
+		p.files = append(p.files, FileHits{Path: r.Path, Count: 1})
+	}
+	if p.sorted {
+		p.hits = append(p.hits, r)
+		return
+	}
+	if p.seen <= p.page.Offset || p.seen > p.page.Offset+p.page.Limit {
+		return
+	}
+	p.take(r)
+}
+
+// take adds a result on the page.
+func (p *Pager) take(r Result) {
+	if p.sections != nil && r.Heading == "" {
+		p.sections.annotate(&r)
+	}
+	p.results = append(p.results, r)
+	if p.emit != nil {
+		p.emit(r)
+	}
+}
+
+// cut sorts the hits kept for Lazy and takes the page out of them.
+func (p *Pager) cut() {
+	slices.SortStableFunc(p.hits, func(a, b Result) int {
+		return cmp.Or(strings.Compare(a.Path, b.Path), cmp.Compare(a.Line, b.Line))
+	})
+	slices.SortStableFunc(p.files, func(a, b FileHits) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+	start := min(p.page.Offset, len(p.hits))
+	end := min(p.page.Offset+p.page.Limit, len(p.hits))
+	for _, r := range p.hits[start:end] {
+		p.take(r)
+	}
+	p.hits, p.sorted = nil, false
+}
+
+// Response returns the page. backend is the backend's own response; it
+// supplies the query, engine and whether the backend stopped early, which
+// makes Total a lower bound.
+func (p *Pager) Response(backend Response) Response {
+	if p.sorted {
+		p.cut()
+	}
+	resp := Response{
+		Query:     backend.Query,
+		Results:   p.results,
+		Engine:    backend.Engine,
+		Total:     p.seen,
+		Estimated: backend.Truncated,
+		Files:     p.files,
+	}
+	if resp.Results == nil {
+		resp.Results = []Result{}
+	}
+	if end := p.page.Offset + p.page.Limit; p.seen > end {
+		resp.Next = strconv.Itoa(end)
+	}
+	resp.Truncated = resp.Next != "" || resp.Estimated
+	return resp
+}
@@ -0,0 +1,160 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+)
+
+func TestParsePage(t *testing.T) {
+	p, err := ParsePage("", "")
+	if err != nil || p != (Page{Offset: 0, Limit: DefaultLimit}) {
+		t.Fatalf("expected the default page, got %+v, %v", p, err)
+	}
+	p, err = ParsePage("40", "20")
+	if err != nil || p != (Page{Offset: 40, Limit: 20}) {
+		t.Fatalf("expected offset 40 limit 20, got %+v, %v", p, err)
+	}
+	if p, _ := ParsePage("", "100000"); p.Limit != MaxLimit {
+		t.Fatalf("expected the limit to be capped at %d, got %d", MaxLimit, p.Limit)
+	}
+	for _, c := range [][2]string{{"x", ""}, {"-1", ""}, {"", "many"}} {
+		if _, err := ParsePage(c[0], c[1]); !errors.Is(err, ErrInvalidQuery) {
+			t.Fatalf("ParsePage(%q, %q): expected ErrInvalidQuery, got %v", c[0], c[1], err)
+		}
+	}
+}
+
+func TestPager_PagesThroughFallback(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "alpha 1\nalpha 2\nalpha 3\n")
+	bgindextest.WriteDoc(t, root, "b.md", "alpha 4\nalpha 5\n")
+
+	search := func(page Page) Response {
+		t.Helper()
+		p := NewPager(page, nil)
+		res, err := FallbackStream(context.Background(), root, nil, mustQuery(t, "alpha"), p.ScanLimit(), p.Add)
+		if err != nil {
+			t.Fatalf("FallbackStream: %v", err)
+		}
+		return p.Response(res)
+	}
+	lines := func(res Response) []string {
+		var out []string
+		for _, r := range res.Results {
+			out = append(out, r.Preview)
+		}
+		return out
+	}
+
+	first := search(Page{Limit: 2})
+	if got := lines(first); !reflect.DeepEqual(got, []string{"alpha 1", "alpha 2"}) {
+		t.Fatalf("first page: got %q", got)
+	}
+	if first.Total != 5 || first.Estimated || first.Next != "2" || !first.Truncated {
+		t.Fatalf("first page: unexpected paging fields %+v", first)
+	}
+	if want := []FileHits{{"a.md", 3}, {"b.md", 2}}; !reflect.DeepEqual(first.Files, want) {
+		t.Fatalf("expected per-file counts %+v, got %+v", want, first.Files)
+	}
+
+	page, err := ParsePage(first.Next, "2")
+	if err != nil {
+		t.Fatalf("ParsePage: %v", err)
+	}
+	second := search(page)
+	if got := lines(second); !reflect.DeepEqual(got, []string{"alpha 3", "alpha 4"}) {
+		t.Fatalf("second page: got %q", got)
+	}
+
+	last := search(Page{Offset: 4, Limit: 2})
+	if got := lines(last); !reflect.DeepEqual(got, []string{"alpha 5"}) {
+		t.Fatalf("last page: got %q", got)
+	}
+	if last.Next != "" || last.Truncated {
+		t.Fatalf("last page: expected no next cursor, got %+v", last)
+	}
+}
+
+func TestPager_LazySections(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "# Intro\n\nalpha 1\n\n## Setup\n\nalpha 2\nalpha 3\n")
+
+	for _, tc := range []struct {
+		query    string
+		backend  bool // whether the backend must annotate to filter
+		previews []string
+	}{
+		{"alpha", false, []string{"alpha 2"}},
+		{"alpha -heading:intro", true, []string{"alpha 3"}},
+		{"alpha heading:setup", true, []string{"alpha 3"}},
+	} {
+		p := NewPager(Page{Offset: 1, Limit: 1}, nil)
+		q := p.Lazy(mustQuery(t, tc.query), root)
+		if _, err := FallbackStream(context.Background(), root, nil, q, p.ScanLimit(), func(r Result) {
+			if annotated := r.Heading != ""; annotated != tc.backend {
+				t.Errorf("%q: backend annotated %q: %v", tc.query, r.Preview, annotated)
+			}
+			p.Add(r)
+		}); err != nil {
+			t.Fatalf("FallbackStream: %v", err)
+		}
+		res := p.Response(Response{})
+		if len(res.Results) != 1 || res.Results[0].Preview != tc.previews[0] || res.Results[0].Heading != "Setup" || res.Results[0].Anchor != "setup" {
+			t.Fatalf("%q: got %+v", tc.query, res.Results)
+		}
+	}
+}
+
+func TestPager_EstimatesWhenBackendStopsEarly(t *testing.T) {
+	p := NewPager(Page{Limit: 1}, nil)
+	var emitted []Result
+	p.emit = func(r Result) { emitted = append(emitted, r) }
+	p.Add(Result{Path: "a.md", Line: 1})
+	p.Add(Result{Path: "a.md", Line: 2})
+
+	res := p.Response(Response{Query: "x", Truncated: true, Engine: EngineRipgrep})
+	if res.Total != 2 || !res.Estimated || res.Next != "1" || res.Engine != EngineRipgrep {
+		t.Fatalf("unexpected response %+v", res)
+	}
+	if len(emitted) != 1 || emitted[0].Line != 1 {
+		t.Fatalf("expected only the page to be emitted, got %+v", emitted)
+	}
+}
+
+func TestPager_SortsLineHits(t *testing.T) {
+	// rg reports files in any order; pages come out the same every time.
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "alpha\n")
+	bgindextest.WriteDoc(t, root, "b.md", "alpha\n\nalpha\n")
+	bgindextest.WriteDoc(t, root, "c.md", "alpha\n")
+	hits := []Result{{Path: "c.md", Line: 1}, {Path: "b.md", Line: 1}, {Path: "b.md", Line: 3}, {Path: "a.md", Line: 1}}
+
+	var emitted []Result
+	p := NewPager(Page{Offset: 1, Limit: 2}, func(r Result) { emitted = append(emitted, r) })
+	p.Lazy(mustQuery(t, "alpha"), root)
+	for _, r := range hits {
+		p.Add(r)
+	}
+	if len(emitted) != 0 {
+		t.Fatalf("expected nothing emitted before the backend is done, got %+v", emitted)
+	}
+	res := p.Response(Response{Engine: EngineRipgrep})
+	var got []string
+	for _, r := range res.Results {
+		got = append(got, fmt.Sprintf("%s:%d", r.Path, r.Line))
+	}
+	if want := []string{"b.md:1", "b.md:3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if len(emitted) != 2 || res.Total != 4 || res.Next != "3" {
+		t.Fatalf("unexpected response %+v (emitted %d)", res, len(emitted))
+	}
+	if want := []FileHits{{"a.md", 1}, {"b.md", 2}, {"c.md", 1}}; !reflect.DeepEqual(res.Files, want) {
+		t.Fatalf("expected per-file counts in path order, got %+v", res.Files)
+	}
+}
@@ -0,0 +1,417 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// CaseMode controls how query terms treat letter case.
+type CaseMode string
+
+const (
+	// CaseSmart matches case-sensitively only when a term contains an
+	// upper-case letter, like ripgrep's --smart-case.
+	CaseSmart       CaseMode = "smart"
+	CaseSensitive   CaseMode = "sensitive"
+	CaseInsensitive CaseMode = "insensitive"
+)
+
+// QueryOptions are the matching modes that are not part of the query text,
+// and how much of the surrounding text results carry.
+type QueryOptions struct {
+	// Regex treats terms as regular expressions (RE2 syntax) instead of
+	// fixed strings.
+	Regex bool
+	// WholeWord only matches terms that are not surrounded by letters,
+	// digits or underscores.
+	WholeWord bool
+	// Case defaults to CaseSmart.
+	Case CaseMode
+	// Before and After are the numbers of context lines returned before
+	// and after each matching line, up to MaxContext.
+	Before, After int
+}
+
+// Query is a parsed search query, shared by all search backends.
+//
+// The query text is split on whitespace into terms, all of which must occur
+// on a matching line. Double quotes group a phrase into a single term. A
+// leading "-" negates a term: lines containing it are dropped. The filters
+// "path:" and "ext:" restrict which files are searched and can be negated
+// the same way:
+//
+//	install "rolling update" -draft path:docs/ ext:md -path:docs/archive
+//
+// A path filter is a prefix of the repo-relative path ("docs/"), or a glob
+// ("docs/*/setup.md") matched against the path and each of its parent
+// directories.
+//
+// Field filters match document front matter ("tag:", "owner:", "status:",
+// "author:") and the enclosing heading ("heading:"); see FieldFilter. A
+// query made only of field filters lists the matching documents, or the
+// matching headings if it has a heading filter:
+//
+//	tag:runbook owner:payments -status:deprecated
+type Query struct {
+	Raw string
+	QueryOptions
+
+	Terms     []string
+	Exclude   []string
+	Paths     []string
+	NotPaths  []string
+	Exts      []string
+	NotExts   []string
+	Fields    []FieldFilter
+	NotFields []FieldFilter
+
+	terms   []*regexp.Regexp
+	exclude []*regexp.Regexp
+	// headings highlights the heading filters in Fields when listing.
+	headings []*regexp.Regexp
+
+	// lazySections leaves Heading and Anchor of line hits to the Pager,
+	// unless the query filters on them; see Pager.Lazy.
+	lazySections bool
+}
+
+// ErrInvalidQuery wraps query parse errors, such as a bad regular expression.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// ParseQuery parses raw with the given options.
+func ParseQuery(raw string, opts QueryOptions) (Query, error) {
+	switch opts.Case {
+	case "":
+		opts.Case = CaseSmart
+	case CaseSmart, CaseSensitive, CaseInsensitive:
+	default:
+		return Query{}, fmt.Errorf("%w: unknown case mode %q", ErrInvalidQuery, opts.Case)
+	}
+	if opts.Before < 0 || opts.After < 0 {
+		return Query{}, fmt.Errorf("%w: negative context", ErrInvalidQuery)
+	}
+	opts.Before, opts.After = min(opts.Before, MaxContext), min(opts.After, MaxContext)
+
+	q := Query{Raw: strings.TrimSpace(raw), QueryOptions: opts}
+	for _, tok := range splitQuery(q.Raw) {
+		v := tok.text
+		if !tok.quoted {
+			if field, val, ok := strings.Cut(v, ":"); ok && val != "" {
+				switch strings.ToLower(field) {
+				case "path":
+					val = strings.TrimPrefix(val, "/")
+					if tok.negate {
+						q.NotPaths = append(q.NotPaths, val)
+					} else {
+						q.Paths = append(q.Paths, val)
+					}
+					continue
+				case "ext":
+					val = strings.ToLower(strings.TrimPrefix(val, "."))
+					if tok.negate {
+						q.NotExts = append(q.NotExts, val)
+					} else {
+						q.Exts = append(q.Exts, val)
+					}
+					continue
+				}
+				if name, ok := fieldNames[strings.ToLower(field)]; ok {
+					f := FieldFilter{Field: name, Value: val}
+					if tok.negate {
+						q.NotFields = append(q.NotFields, f)
+					} else {
+						q.Fields = append(q.Fields, f)
+						if name == FieldHeading {
+							q.headings = append(q.headings, regexp.MustCompile("(?i)"+regexp.QuoteMeta(val)))
+						}
+					}
+					continue
+				}
+			}
+		}
+		if tok.negate {
+			q.Exclude = append(q.Exclude, v)
+		} else {
+			q.Terms = append(q.Terms, v)
+		}
+	}
+
+	sensitive := q.caseSensitive()
+	for _, t := range q.Terms {
+		re, err := q.compile(t, sensitive)
+		if err != nil {
+			return Query{}, err
+		}
+		q.terms = append(q.terms, re)
+	}
+	for _, t := range q.Exclude {
+		re, err := q.compile(t, sensitive)
+		if err != nil {
+			return Query{}, err
+		}
+		q.exclude = append(q.exclude, re)
+	}
+	return q, nil
+}
+
+func (q Query) compile(term string, sensitive bool) (*regexp.Regexp, error) {
+	expr := term
+	if q.Regex {
+		// Validate the term alone so errors quote what the user typed.
+		if _, err := regexp.Compile(term); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+		}
+	} else {
+		expr = regexp.QuoteMeta(term)
+	}
+	if !sensitive {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// Empty reports whether the query has nothing to search for: no positive
+// terms and no field filters.
+func (q Query) Empty() bool {
+	return len(q.Terms) == 0 && len(q.Fields) == 0 && len(q.NotFields) == 0
+}
+
+// Listing reports whether the query has field filters but no terms, so it
+// lists documents or headings instead of matching lines.
+func (q Query) Listing() bool {
+	return len(q.Terms) == 0 && !q.Empty()
+}
+
+// LinesOnly reports whether the query uses modes that only the line-based
+// backends implement; the ranked index works on tokens and cannot honor
+// them.
+func (q Query) LinesOnly() bool {
+	return q.Regex || q.WholeWord || q.Case == CaseSensitive
+}
+
+// caseSensitive resolves the case mode. Under CaseSmart, an upper-case
+// letter in any term makes the whole query case-sensitive; in regex mode,
+// escaped characters such as \W or \S do not count.
+func (q Query) caseSensitive() bool {
+	switch q.Case {
+	case CaseSensitive:
+		return true
+	case CaseInsensitive:
+		return false
+	}
+	for _, t := range append(append([]string(nil), q.Terms...), q.Exclude...) {
+		escaped := false
+		for _, r := range t {
+			if q.Regex && !escaped && r == '\\' {
+				escaped = true
+				continue
+			}
+			if !escaped && unicode.IsUpper(r) {
+				return true
+			}
+			escaped = false
+		}
+	}
+	return false
+}
+
+// MatchPath reports whether a repo-relative file path passes the path and
+// ext filters.
+func (q Query) MatchPath(rel string) bool {
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(rel), "."))
+	if len(q.Exts) > 0 && !containsString(q.Exts, ext) {
+		return false
+	}
+	if containsString(q.NotExts, ext) {
+		return false
+	}
+	if len(q.Paths) > 0 {
+		ok := false
+		for _, p := range q.Paths {
+			if matchPathFilter(p, rel) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	for _, p := range q.NotPaths {
+		if matchPathFilter(p, rel) {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchLine reports whether line contains every term and no excluded term,
+// returning the sorted, non-overlapping byte ranges of the term hits.
+func (q Query) MatchLine(line string) ([]Match, bool) {
+	if len(q.terms) == 0 {
+		return nil, false
+	}
+	for _, re := range q.exclude {
+		if len(q.find(re, line)) > 0 {
+			return nil, false
+		}
+	}
+	var all []Match
+	for _, re := range q.terms {
+		ms := q.find(re, line)
+		if len(ms) == 0 {
+			return nil, false
+		}
+		all = append(all, ms...)
+	}
+	return mergeMatches(all), true
+}
+
+// mayMatch is a cheap prefilter for a whole file: every term occurs
+// somewhere in src. Files that fail it cannot have a matching line.
+func (q Query) mayMatch(src []byte) bool {
+	for _, re := range q.terms {
+		if !re.Match(src) {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the non-empty hits of re in line, honoring WholeWord.
+func (q Query) find(re *regexp.Regexp, line string) []Match {
+	var out []Match
+	for _, loc := range re.FindAllStringIndex(line, -1) {
+		if loc[0] == loc[1] {
+			continue
+		}
+		if q.WholeWord && !atWordBoundary(line, loc[0], loc[1]) {
+			continue
+		}
+		out = append(out, Match{Start: loc[0], End: loc[1]})
+	}
+	return out
+}
+
+func atWordBoundary(s string, start, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(s[:start])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	if end < len(s) {
+		r, _ := utf8.DecodeRuneInString(s[end:])
+		if isWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// mergeMatches sorts ranges and joins overlapping ones so they can be
+// highlighted in a single pass.
+func mergeMatches(ms []Match) []Match {
+	sort.Slice(ms, func(i, j int) bool {
+		if ms[i].Start != ms[j].Start {
+			return ms[i].Start < ms[j].Start
+		}
+		return ms[i].End > ms[j].End
+	})
+	out := ms[:0]
+	for _, m := range ms {
+		if n := len(out); n > 0 && m.Start <= out[n-1].End {
+			if m.End > out[n-1].End {
+				out[n-1].End = m.End
+			}
+			continue
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func matchPathFilter(filter, rel string) bool {
+	if !strings.ContainsAny(filter, "*?[") {
+		return strings.HasPrefix(rel, filter)
+	}
+	filter = strings.TrimSuffix(filter, "/")
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if ok, _ := path.Match(filter, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+type queryToken struct {
+	text   string
+	quoted bool
+	negate bool
+}
+
+// splitQuery splits the query text on whitespace, keeping double-quoted
+// phrases together. An unterminated quote runs to the end of the input.
+func splitQuery(s string) []queryToken {
+	var out []queryToken
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+		tok := queryToken{}
+		if s[i] == '-' && i+1 < len(s) && !isSpaceByte(s[i+1]) {
+			tok.negate = true
+			i++
+		}
+		if s[i] == '"' {
+			end := strings.IndexByte(s[i+1:], '"')
+			if end < 0 {
+				tok.text = s[i+1:]
+				i = len(s)
+			} else {
+				tok.text = s[i+1 : i+1+end]
+				i += end + 2
+			}
+			tok.quoted = true
+		} else {
+			start := i
+			for i < len(s) {
+				r, size := utf8.DecodeRuneInString(s[i:])
+				if unicode.IsSpace(r) {
+					break
+				}
+				i += size
+			}
+			tok.text = s[start:i]
+		}
+		if tok.text != "" {
+			out = append(out, tok)
+		}
+	}
+	return out
+}
+
+func isSpaceByte(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r'
+}
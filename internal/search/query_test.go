@@ -0,0 +1,236 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"sort"
+	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+)
+
+func mustQuery(t *testing.T, raw string) Query {
+	t.Helper()
+	q, err := ParseQuery(raw, QueryOptions{})
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", raw, err)
+	}
+	return q
+}
+
+func TestParseQuery(t *testing.T) {
+	q := mustQuery(t, `install "rolling update" -draft path:/docs/ ext:.MD -path:docs/archive -"make install" -ext:txt http://x -`)
+
+	check := func(name string, got, want []string) {
+		t.Helper()
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %q, want %q", name, got, want)
+		}
+	}
+	check("Terms", q.Terms, []string{"install", "rolling update", "http://x", "-"})
+	check("Exclude", q.Exclude, []string{"draft", "make install"})
+	check("Paths", q.Paths, []string{"docs/"})
+	check("NotPaths", q.NotPaths, []string{"docs/archive"})
+	check("Exts", q.Exts, []string{"md"})
+	check("NotExts", q.NotExts, []string{"txt"})
+	if q.Case != CaseSmart {
+		t.Fatalf("expected smart case by default, got %q", q.Case)
+	}
+
+	if _, err := ParseQuery("(", QueryOptions{Regex: true}); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for a bad regex, got %v", err)
+	}
+	if _, err := ParseQuery("x", QueryOptions{Case: "loud"}); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("expected ErrInvalidQuery for an unknown case mode, got %v", err)
+	}
+	if q := mustQuery(t, "path:docs/ -draft"); !q.Empty() {
+		t.Fatalf("expected a query with only filters and exclusions to be empty")
+	}
+
+	q = mustQuery(t, "Tags:runbook -owner:payments heading:Setup localhost:8080")
+	if want := []FieldFilter{{FieldTag, "runbook"}, {FieldHeading, "Setup"}}; !reflect.DeepEqual(q.Fields, want) {
+		t.Fatalf("Fields: got %+v, want %+v", q.Fields, want)
+	}
+	if want := []FieldFilter{{FieldOwner, "payments"}}; !reflect.DeepEqual(q.NotFields, want) {
+		t.Fatalf("NotFields: got %+v, want %+v", q.NotFields, want)
+	}
+	check("Terms", q.Terms, []string{"localhost:8080"})
+	if q := mustQuery(t, "tag:runbook"); q.Empty() || !q.Listing() {
+		t.Fatalf("expected a query with only field filters to be a listing")
+	}
+}
+
+func TestQuery_MatchLine(t *testing.T) {
+	line := "Straße and STRASSE and straße"
+	ms, ok := mustQuery(t, "straße").MatchLine(line)
+	if !ok || len(ms) != 2 {
+		t.Fatalf("expected 2 matches, got %+v", ms)
+	}
+	if line[ms[0].Start:ms[0].End] != "Straße" || line[ms[1].Start:ms[1].End] != "straße" {
+		t.Fatalf("unexpected ranges %+v", ms)
+	}
+
+	// Hits of all terms come back sorted, with overlaps merged.
+	line = "make install and make installer"
+	ms, ok = mustQuery(t, "install make stall").MatchLine(line)
+	want := []Match{{0, 4}, {5, 12}, {17, 21}, {22, 29}}
+	if !ok || !reflect.DeepEqual(ms, want) {
+		t.Fatalf("expected %+v, got %+v", want, ms)
+	}
+
+	if _, ok := mustQuery(t, "install -installer").MatchLine(line); ok {
+		t.Fatalf("expected an excluded term to reject the line")
+	}
+}
+
+// searchCorpus is shared by the backend tests below so ripgrep and the
+// fallback are held to the same expectations.
+var searchCorpus = map[string]string{
+	"docs/guide.md": "# Guide\n" +
+		"Install the server with make install.\n" +
+		"Reinstall if needed.\n" +
+		"The rolling update is safe.\n" +
+		"rolling back an update is manual.\n" +
+		"Draft: install notes\n",
+	"docs/archive/old.md": "install legacy\n",
+	"notes/plan.markdown": "Install plan\n",
+	"notes/skip.txt":      "install is not markdown\n",
+	"README.md": "Error E42\n" +
+		"error e42\n" +
+		"foo.bar\n" +
+		"fooXbar\n",
+	"runbooks/db.md": "---\n" +
+		"tags: [runbook, database]\n" +
+		"owner: payments\n" +
+		"status: deprecated\n" +
+		"---\n" +
+		"# Database failover\n" +
+		"## Promote replica\n" +
+		"Promote the replica when the primary fails.\n",
+	"runbooks/cache.md": "---\n" +
+		"tags:\n" +
+		"  - runbook\n" +
+		"owner: Platform\n" +
+		"---\n" +
+		"# Cache\n" +
+		"## Flush\n" +
+		"Flush the cache when the primary fails.\n",
+}
+
+var queryCases = []struct {
+	query string
+	opts  QueryOptions
+	want  []string
+}{
+	{"install", QueryOptions{}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:3", "docs/guide.md:6", "notes/plan.markdown:1"}},
+	{"Install", QueryOptions{}, []string{"docs/guide.md:2", "notes/plan.markdown:1"}},
+	{"install", QueryOptions{Case: CaseSensitive}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:3", "docs/guide.md:6"}},
+	{"Install", QueryOptions{Case: CaseInsensitive}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:3", "docs/guide.md:6", "notes/plan.markdown:1"}},
+	{"install", QueryOptions{WholeWord: true}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:6", "notes/plan.markdown:1"}},
+	{`"rolling update"`, QueryOptions{}, []string{"docs/guide.md:4"}},
+	{"rolling update", QueryOptions{}, []string{"docs/guide.md:4", "docs/guide.md:5"}},
+	{"install -draft", QueryOptions{}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:3", "notes/plan.markdown:1"}},
+	{`install -"make install"`, QueryOptions{}, []string{"docs/archive/old.md:1", "docs/guide.md:3", "docs/guide.md:6", "notes/plan.markdown:1"}},
+	{"install path:docs/", QueryOptions{}, []string{"docs/archive/old.md:1", "docs/guide.md:2", "docs/guide.md:3", "docs/guide.md:6"}},
+	{"install path:docs/ -path:docs/archive", QueryOptions{}, []string{"docs/guide.md:2", "docs/guide.md:3", "docs/guide.md:6"}},
+	{"install path:*/archive", QueryOptions{}, []string{"docs/archive/old.md:1"}},
+	{"install ext:markdown", QueryOptions{}, []string{"notes/plan.markdown:1"}},
+	{"install -ext:md", QueryOptions{}, []string{"notes/plan.markdown:1"}},
+	{"foo.bar", QueryOptions{}, []string{"README.md:3"}},
+	{"foo.bar", QueryOptions{Regex: true}, []string{"README.md:3", "README.md:4"}},
+	{`E\d+`, QueryOptions{Regex: true}, []string{"README.md:1"}},
+	{`e\d+`, QueryOptions{Regex: true}, []string{"README.md:1", "README.md:2"}},
+	{"-install", QueryOptions{}, nil},
+	{"primary tag:runbook", QueryOptions{}, []string{"runbooks/cache.md:8", "runbooks/db.md:8"}},
+	{"primary owner:platform", QueryOptions{}, []string{"runbooks/cache.md:8"}},
+	{"primary -status:deprecated", QueryOptions{}, []string{"runbooks/cache.md:8"}},
+	{"primary heading:promote", QueryOptions{}, []string{"runbooks/db.md:8"}},
+	{"tag:runbook", QueryOptions{}, []string{"runbooks/cache.md:1", "runbooks/db.md:1"}},
+	{"tag:runbook -status:deprecated", QueryOptions{}, []string{"runbooks/cache.md:1"}},
+	{"tag:runbook -replica", QueryOptions{}, []string{"runbooks/cache.md:1"}},
+	{"tag:runbook heading:flush", QueryOptions{}, []string{"runbooks/cache.md:7"}},
+}
+
+func TestQuery_Backends(t *testing.T) {
+	root := t.TempDir()
+	for rel, body := range searchCorpus {
+		bgindextest.WriteDoc(t, root, rel, body)
+	}
+
+	backends := map[string]func(Query) (Response, error){
+		EngineFallback: func(q Query) (Response, error) { return Fallback(context.Background(), root, nil, q, 200) },
+	}
+	if _, err := exec.LookPath("rg"); err == nil {
+		backends[EngineRipgrep] = func(q Query) (Response, error) { return Ripgrep(context.Background(), root, nil, q, 200) }
+	}
+
+	for name, search := range backends {
+		for _, c := range queryCases {
+			q, err := ParseQuery(c.query, c.opts)
+			if err != nil {
+				t.Fatalf("ParseQuery(%q): %v", c.query, err)
+			}
+			res, err := search(q)
+			if err != nil {
+				t.Fatalf("%s %q: %v", name, c.query, err)
+			}
+			var got []string
+			for _, r := range res.Results {
+				got = append(got, fmt.Sprintf("%s:%d", r.Path, r.Line))
+				if len(r.Matches) == 0 && (!q.Listing() || q.hasHeadingFilter()) {
+					t.Fatalf("%s %q: result %s:%d has no match ranges", name, c.query, r.Path, r.Line)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, c.want) {
+				t.Fatalf("%s %q %+v: got %q, want %q", name, c.query, c.opts, got, c.want)
+			}
+		}
+	}
+}
+
+func TestIndex_QueryFilters(t *testing.T) {
+	root := t.TempDir()
+	for rel, body := range searchCorpus {
+		bgindextest.WriteDoc(t, root, rel, body)
+	}
+	idx := newReadyIndex(t, root, nil)
+
+	paths := func(raw string) []string {
+		var out []string
+		for _, r := range idx.Search(mustQuery(t, raw), 10).Results {
+			out = append(out, r.Path)
+		}
+		sort.Strings(out)
+		return out
+	}
+
+	// The guide is a single section that mentions "Draft".
+	if got := paths("install path:docs/ -draft"); !reflect.DeepEqual(got, []string{"docs/archive/old.md"}) {
+		t.Fatalf("expected path filter and exclusion to leave the archive, got %q", got)
+	}
+	if got := paths("install ext:markdown"); !reflect.DeepEqual(got, []string{"notes/plan.markdown"}) {
+		t.Fatalf("expected ext filter to leave the plan, got %q", got)
+	}
+	if got := paths(`"rolling update"`); !reflect.DeepEqual(got, []string{"docs/guide.md"}) {
+		t.Fatalf("expected the phrase to match the guide, got %q", got)
+	}
+	if got := paths(`"update rolling"`); got != nil {
+		t.Fatalf("expected a reversed phrase to match nothing, got %q", got)
+	}
+	if got := paths("primary tag:runbook -status:deprecated"); !reflect.DeepEqual(got, []string{"runbooks/cache.md"}) {
+		t.Fatalf("expected field filters to leave the cache runbook, got %q", got)
+	}
+	if got := paths("primary heading:promote"); !reflect.DeepEqual(got, []string{"runbooks/db.md"}) {
+		t.Fatalf("expected the heading filter to leave the database runbook, got %q", got)
+	}
+	if got := paths("tag:runbook"); !reflect.DeepEqual(got, []string{"runbooks/cache.md", "runbooks/db.md"}) {
+		t.Fatalf("expected a field-only query to list both runbooks, got %q", got)
+	}
+	if got := paths("owner:payments heading:promote"); !reflect.DeepEqual(got, []string{"runbooks/db.md"}) {
+		t.Fatalf("expected a heading listing for the database runbook, got %q", got)
+	}
+}
@@ -6,29 +6,136 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
+
+	"repobook/internal/frontmatter"
+	"repobook/internal/ignore"
 )
 
 type Result struct {
 	Path    string `json:"path"`
 	Line    int    `json:"line"`
 	Preview string `json:"preview"`
+
+	// Heading and Anchor identify the section containing the hit. Anchor
+	// matches the heading IDs in render.RenderResult.TOC, so clients can
+	// link to "/file/<path>#<anchor>".
+	Heading string `json:"heading,omitempty"`
+	Anchor  string `json:"anchor,omitempty"`
+	// Matches are the byte ranges of the hits within Preview. Long lines
+	// are cut down to a window around the first hit, with "…" marking the
+	// cut ends.
+	Matches []Match `json:"matches,omitempty"`
+	// Before and After are the context lines around the hit, in file order,
+	// when the query asks for them.
+	Before []ContextLine `json:"before,omitempty"`
+	After  []ContextLine `json:"after,omitempty"`
+
+	// Commit is set by History: the commit that added or removed the line.
+	Commit *Commit `json:"commit,omitempty"`
+
+	// Title is set by the ranked index and by listings; Score only by the
+	// ranked index.
+	Title string  `json:"title,omitempty"`
+	Score float64 `json:"score,omitempty"`
 }
 
 type Response struct {
 	Query     string   `json:"query"`
 	Results   []Result `json:"results"`
 	Truncated bool     `json:"truncated"`
+	// Engine names the backend that produced the results.
+	Engine string `json:"engine,omitempty"`
+
+	// Paging, filled in by Pager. Total counts all matches; it is a lower
+	// bound when Estimated is set. Next is the cursor of the following page.
+	// Files has the number of matches per file, in result order.
+	Total     int        `json:"total"`
+	Estimated bool       `json:"estimated,omitempty"`
+	Next      string     `json:"next,omitempty"`
+	Files     []FileHits `json:"files,omitempty"`
+
+	// Facets summarize the matching files for filtering; see CountFacets.
+	Facets *Facets `json:"facets,omitempty"`
 }
 
+// Search engines reported in Response.Engine.
+const (
+	EngineIndex    = "index"
+	EngineRipgrep  = "ripgrep"
+	EngineFallback = "fallback"
+	EngineHistory  = "history"
+)
+
 var ErrRipgrepNotFound = errors.New("ripgrep (rg) not found")
 
-func Ripgrep(rootAbs, query string, limit int) (Response, error) {
-	query = strings.TrimSpace(query)
-	if query == "" {
-		return Response{Query: query, Results: nil, Truncated: false}, nil
+// Ripgrep searches markdown files under rootAbs with rg. ig decides which
+// files count, as it does for the tree and FallbackStream; rg's own ignore
+// handling and the directories ig excludes keep it from crawling what ig
+// would drop anyway. See rgIgnoreArgs.
+//
+// rg searches for the first term of q only; every candidate line is then
+// checked with q.MatchLine, so both backends agree on what matches. Field
+// filters are applied per file. Listing queries have no term for rg to
+// search for and are answered by FallbackStream.
+//
+// rg runs for at most a few seconds; when that budget runs out, the results
+// found so far are returned as truncated. Cancelling ctx kills rg and returns
+// ctx's error.
+func Ripgrep(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int) (Response, error) {
+	return RipgrepStream(ctx, rootAbs, ig, q, limit, nil)
+}
+
+// rgIgnoreArgs returns the rg arguments that skip what ig ignores, so rg
+// does not crawl it: the default excludes and the ignored directories at
+// the top of rootAbs are left out, and rg applies git's rules itself unless
+// .repobookignore re-includes files they exclude. ig still checks every
+// result. Hidden files are searched, as the tree shows them, but rg's
+// .ignore and .rgignore files are not read, since ig doesn't either.
+func rgIgnoreArgs(rootAbs string, ig *ignore.Matcher) []string {
+	args := []string{"--hidden", "--no-ignore-dot", "--glob=!.git"}
+	if ig.ReIncludes() {
+		args = append(args, "--no-ignore")
+	}
+	for _, d := range ignore.DefaultExcludes() {
+		if ig.IsIgnored(strings.TrimSuffix(d, "/"), true) {
+			args = append(args, "--glob=!"+d)
+		}
+	}
+	entries, _ := os.ReadDir(rootAbs)
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != ".git" && ig.IsIgnored(e.Name(), true) {
+			args = append(args, "--glob=!/"+escapeGlob(e.Name())+"/")
+		}
+	}
+	return args
+}
+
+// escapeGlob makes name match itself in an rg glob.
+func escapeGlob(name string) string {
+	var b strings.Builder
+	for _, r := range name {
+		if strings.ContainsRune(`\*?[]{}`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// RipgrepStream is Ripgrep, additionally calling emit with each result as
+// soon as rg reports it.
+func RipgrepStream(ctx context.Context, rootAbs string, ig *ignore.Matcher, q Query, limit int, emit func(Result)) (Response, error) {
+	if q.Empty() {
+		return Response{Query: q.Raw, Results: nil, Truncated: false}, nil
+	}
+	if q.Listing() {
+		return FallbackStream(ctx, rootAbs, ig, q, limit, emit)
 	}
 	if limit <= 0 {
 		limit = 200
@@ -38,7 +145,7 @@ func Ripgrep(rootAbs, query string, limit int) (Response, error) {
 		return Response{}, ErrRipgrepNotFound
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	budget, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	args := []string{
@@ -46,13 +153,29 @@ func Ripgrep(rootAbs, query string, limit int) (Response, error) {
 		"--no-heading",
 		"--line-number",
 		"--color=never",
-		"--smart-case",
 		"--glob=*.md",
 		"--glob=*.markdown",
-		"--fixed-strings",
-		query,
 	}
-	cmd := exec.CommandContext(ctx, "rg", args...)
+	args = append(args, rgIgnoreArgs(rootAbs, ig)...)
+	if q.caseSensitive() {
+		args = append(args, "--case-sensitive")
+	} else {
+		args = append(args, "--ignore-case")
+	}
+	if !q.Regex {
+		args = append(args, "--fixed-strings")
+	}
+	if q.WholeWord {
+		args = append(args, "--word-regexp")
+	}
+	if q.Before > 0 {
+		args = append(args, "--before-context="+strconv.Itoa(q.Before))
+	}
+	if q.After > 0 {
+		args = append(args, "--after-context="+strconv.Itoa(q.After))
+	}
+	args = append(args, "--regexp="+q.Terms[0])
+	cmd := exec.CommandContext(budget, "rg", args...)
 	cmd.Dir = rootAbs
 
 	stdout, err := cmd.StdoutPipe()
@@ -80,7 +203,16 @@ func Ripgrep(rootAbs, query string, limit int) (Response, error) {
 		}
 	}()
 
-	resp := Response{Query: query, Results: make([]Result, 0, 32)}
+	resp := Response{Query: q.Raw, Results: make([]Result, 0, 32), Engine: EngineRipgrep}
+	out := &rgContext{q: q, emit: func(r Result) {
+		resp.Results = append(resp.Results, r)
+		if emit != nil {
+			emit(r)
+		}
+	}}
+	found := 0
+	sections := newSectionAnnotator(rootAbs)
+	metaOK := make(map[string]bool) // per file, when q.needsMeta
 	s := bufio.NewScanner(stdout)
 	for s.Scan() {
 		line := s.Bytes()
@@ -99,25 +231,52 @@ func Ripgrep(rootAbs, query string, limit int) (Response, error) {
 		if err := json.Unmarshal(line, &ev); err != nil {
 			continue
 		}
-		if ev.Type != "match" {
+		if ev.Type == "end" {
+			out.flush()
+		}
+		if ev.Type != "match" && ev.Type != "context" {
 			continue
 		}
 		preview := strings.TrimRight(ev.Data.Lines.Text, "\r\n")
 		p := strings.ReplaceAll(ev.Data.Path.Text, "\\", "/")
-		resp.Results = append(resp.Results, Result{Path: p, Line: ev.Data.LineNumber, Preview: preview})
-		if len(resp.Results) >= limit {
-			resp.Truncated = true
+		if ev.Type == "context" || resp.Truncated {
+			out.line(p, ev.Data.LineNumber, preview, nil)
+		} else if res, ok := q.rgResult(p, ev.Data.LineNumber, preview, ig, sections, metaOK, rootAbs); ok {
+			out.line(p, ev.Data.LineNumber, preview, &res)
+			if found++; found >= limit {
+				resp.Truncated = true
+			}
+		} else {
+			out.line(p, ev.Data.LineNumber, preview, nil)
+		}
+		if resp.Truncated && len(out.pending) == 0 {
 			break
 		}
 	}
+	out.flush()
 
 	_ = stdout.Close()
-	// Wait for rg.
-	if err := cmd.Wait(); err != nil {
+	if resp.Truncated {
+		// Stop rg rather than let it fail writing to the closed pipe.
+		cancel()
+	}
+	waitErr := cmd.Wait()
+	if err := ctx.Err(); err != nil {
+		return Response{}, err
+	}
+	if resp.Truncated {
+		return resp, nil
+	}
+	if budget.Err() != nil {
+		// Out of time: keep what rg found so far.
+		resp.Truncated = true
+		return resp, nil
+	}
+	if err := waitErr; err != nil {
 		// rg exits with code 1 if no matches.
 		if ee, ok := err.(*exec.ExitError); ok {
 			if ee.ExitCode() == 1 {
-				return Response{Query: query, Results: nil, Truncated: false}, nil
+				return Response{Query: q.Raw, Results: nil, Truncated: false, Engine: EngineRipgrep}, nil
 			}
 		}
 		sErr := strings.TrimSpace(stderrBuf.String())
@@ -126,6 +285,102 @@ func Ripgrep(rootAbs, query string, limit int) (Response, error) {
 		}
 		return Response{}, err
 	}
-
 	return resp, nil
 }
+
+// rgResult turns a line rg reported as a match into a result, if it passes
+// the checks rg cannot do itself.
+func (q Query) rgResult(p string, n int, preview string, ig *ignore.Matcher, sections *sectionAnnotator, metaOK map[string]bool, rootAbs string) (Result, bool) {
+	if ig != nil && ig.IsIgnored(p, false) {
+		return Result{}, false
+	}
+	if !q.MatchPath(p) {
+		return Result{}, false
+	}
+	matches, ok := q.MatchLine(preview)
+	if !ok {
+		return Result{}, false
+	}
+	if q.needsMeta() {
+		ok, seen := metaOK[p]
+		if !seen {
+			meta, err := frontmatter.ReadFile(filepath.Join(rootAbs, filepath.FromSlash(p)))
+			ok = err == nil && q.MatchMeta(meta)
+			metaOK[p] = ok
+		}
+		if !ok {
+			return Result{}, false
+		}
+	}
+	res := Result{Path: p, Line: n, Preview: preview, Matches: matches}
+	if q.lazySections && !q.needsHeading() {
+		return res, true
+	}
+	sections.annotate(&res)
+	if !q.MatchHeading(res.Heading) {
+		return Result{}, false
+	}
+	return res, true
+}
+
+// rgContext attaches context lines to results from rg's "match" and
+// "context" events, which cover every line near a hit in file order. With
+// after-context, a result is held back until its following lines are seen.
+type rgContext struct {
+	q       Query
+	emit    func(Result)
+	path    string
+	recent  []ContextLine // the last q.Before lines of the current file
+	pending []Result      // waiting for after-context, in order
+}
+
+// line records line n of file p; r is the result for that line, if any.
+func (c *rgContext) line(p string, n int, text string, r *Result) {
+	if p != c.path {
+		c.flush()
+		c.path = p
+	}
+	// Extend the pending results; a gap in line numbers completes them.
+	for i := range c.pending {
+		pr := &c.pending[i]
+		if len(pr.After) < c.q.After && n == pr.Line+len(pr.After)+1 {
+			pr.After = append(pr.After, c.q.contextLine(n, text))
+		}
+	}
+	for len(c.pending) > 0 {
+		pr := c.pending[0]
+		if len(pr.After) < c.q.After && pr.Line+len(pr.After)+1 > n {
+			break
+		}
+		c.emit(pr)
+		c.pending = c.pending[1:]
+	}
+
+	if r != nil {
+		r.Preview, r.Matches = window(r.Preview, r.Matches)
+		for _, cl := range c.recent {
+			if cl.Line >= n-c.q.Before && cl.Line < n {
+				r.Before = append(r.Before, cl)
+			}
+		}
+		if c.q.After > 0 {
+			c.pending = append(c.pending, *r)
+		} else {
+			c.emit(*r)
+		}
+	}
+	if c.q.Before > 0 {
+		c.recent = append(c.recent, c.q.contextLine(n, text))
+		if len(c.recent) > c.q.Before {
+			c.recent = c.recent[1:]
+		}
+	}
+}
+
+// flush emits the pending results of the current file.
+func (c *rgContext) flush() {
+	for _, pr := range c.pending {
+		c.emit(pr)
+	}
+	c.pending, c.recent, c.path = nil, nil, ""
+}
@@ -1,16 +1,23 @@
 package search
 
 import (
+	"context"
+	"errors"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"testing"
+
+	"repobook/internal/bgindex/bgindextest"
+	"repobook/internal/ignore"
 )
 
 func TestRipgrep_NotFound(t *testing.T) {
 	root := t.TempDir()
 	t.Setenv("PATH", "")
-	_, err := Ripgrep(root, "x", 10)
+	_, err := Ripgrep(context.Background(), root, nil, mustQuery(t, "x"), 10)
 	if err != ErrRipgrepNotFound {
 		t.Fatalf("expected ErrRipgrepNotFound, got %v", err)
 	}
@@ -26,7 +33,7 @@ func TestRipgrep_FindsMatches_WhenAvailable(t *testing.T) {
 		t.Fatalf("write: %v", err)
 	}
 
-	res, err := Ripgrep(root, "Alpha", 50)
+	res, err := Ripgrep(context.Background(), root, nil, mustQuery(t, "Alpha"), 50)
 	if err != nil {
 		t.Fatalf("Ripgrep: %v", err)
 	}
@@ -40,3 +47,83 @@ func TestRipgrep_FindsMatches_WhenAvailable(t *testing.T) {
 		t.Fatalf("expected line 1, got %d", res.Results[0].Line)
 	}
 }
+
+func TestRipgrep_CancelledContext_WhenAvailable(t *testing.T) {
+	if _, err := exec.LookPath("rg"); err != nil {
+		t.Skip("rg not installed")
+	}
+
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.md"), []byte("Hello Alpha\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Ripgrep(ctx, root, nil, mustQuery(t, "Alpha"), 50); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+// Both backends leave ignore rules to the matcher, so a file .gitignore
+// excludes and .repobookignore re-includes is found, as in the tree.
+func TestBackends_IgnoreRulesComeFromMatcher(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, ".gitignore", "notes.md\nbuild/\n")
+	bgindextest.WriteDoc(t, root, ".repobookignore", "!notes.md\n")
+	bgindextest.WriteDoc(t, root, "notes.md", "alpha\n")
+	bgindextest.WriteDoc(t, root, "build/out.md", "alpha\n")
+	bgindextest.WriteDoc(t, root, ".github/guide.md", "alpha\n")
+	ig, err := ignore.Load(root)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	backends := map[string]func(context.Context, string, *ignore.Matcher, Query, int) (Response, error){
+		"fallback": Fallback,
+	}
+	if _, err := exec.LookPath("rg"); err == nil {
+		backends["ripgrep"] = Ripgrep
+	}
+	for name, search := range backends {
+		res, err := search(context.Background(), root, ig, mustQuery(t, "alpha"), 50)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var got []string
+		for _, r := range res.Results {
+			got = append(got, r.Path)
+		}
+		slices.Sort(got)
+		if want := []string{".github/guide.md", "notes.md"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestRgIgnoreArgs(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, ".gitignore", "build/\n!vendor/\n")
+	for _, rel := range []string{"build/a.md", "node_modules/pkg/a.md", "vendor/a.md", "docs/a.md", ".github/a.md"} {
+		bgindextest.WriteDoc(t, root, rel, "x\n")
+	}
+	args := func() []string {
+		t.Helper()
+		ig, err := ignore.Load(root)
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		return rgIgnoreArgs(root, ig)
+	}
+
+	want := []string{"--hidden", "--no-ignore-dot", "--glob=!.git", "--glob=!node_modules/", "--glob=!.idea/", "--glob=!.vscode/", "--glob=!/build/", "--glob=!/node_modules/"}
+	if got := args(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Re-including what git ignores needs rg's own ignore handling off.
+	bgindextest.WriteDoc(t, root, ".repobookignore", "!build/keep.md\n")
+	if got := args(); !slices.Contains(got, "--no-ignore") {
+		t.Fatalf("expected --no-ignore with a re-include, got %q", got)
+	}
+}
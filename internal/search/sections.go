@@ -0,0 +1,49 @@
+package search
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"repobook/internal/render"
+)
+
+// Match is a byte range [Start, End) of a hit within Result.Preview.
+type Match struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// sectionAnnotator fills Heading and Anchor for line-based results by
+// locating the heading that encloses each hit. Each file is parsed once.
+type sectionAnnotator struct {
+	rootAbs  string
+	outlines map[string][]render.Heading
+}
+
+func newSectionAnnotator(rootAbs string) *sectionAnnotator {
+	return &sectionAnnotator{rootAbs: rootAbs, outlines: make(map[string][]render.Heading)}
+}
+
+func (a *sectionAnnotator) annotate(r *Result) {
+	hs, ok := a.outlines[r.Path]
+	if !ok {
+		src, err := os.ReadFile(filepath.Join(a.rootAbs, filepath.FromSlash(r.Path)))
+		if err == nil {
+			hs = render.Outline(src)
+		}
+		a.outlines[r.Path] = hs
+	}
+	if h, ok := enclosingHeading(hs, r.Line); ok {
+		r.Heading, r.Anchor = h.Title, h.ID
+	}
+}
+
+// enclosingHeading returns the last heading at or before line.
+func enclosingHeading(hs []render.Heading, line int) (render.Heading, bool) {
+	i := sort.Search(len(hs), func(i int) bool { return hs[i].Line > line })
+	if i == 0 {
+		return render.Heading{}, false
+	}
+	return hs[i-1], true
+}
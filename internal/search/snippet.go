@@ -0,0 +1,124 @@
+package search
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxContext caps the context lines returned on each side of a hit.
+const MaxContext = 10
+
+// previewWidth is the length, in bytes, beyond which previews and context
+// lines are cut down to a window around their first hit.
+const previewWidth = 240
+
+// ellipsis marks the ends of a windowed line.
+const ellipsis = "…"
+
+// ContextLine is a line near a hit, as requested with QueryOptions.Before
+// and QueryOptions.After. Matches are the hits of any query term in Text.
+type ContextLine struct {
+	Line    int     `json:"line"`
+	Text    string  `json:"text"`
+	Matches []Match `json:"matches,omitempty"`
+}
+
+// contextLine windows text and marks the term hits in it.
+func (q Query) contextLine(n int, text string) ContextLine {
+	text, ms := window(text, q.termHits(text))
+	return ContextLine{Line: n, Text: text, Matches: ms}
+}
+
+// termHits returns the sorted, non-overlapping hits of any term in line;
+// unlike MatchLine it does not require all of them.
+func (q Query) termHits(line string) []Match {
+	var all []Match
+	for _, re := range q.terms {
+		all = append(all, q.find(re, line)...)
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	return mergeMatches(all)
+}
+
+// withContext windows r.Preview and fills in r.Before and r.After from
+// lines, where lines[i] is line first+i of r's file. Context does not reach
+// past the given lines.
+func (q Query) withContext(r *Result, lines []string, first int) {
+	r.Preview, r.Matches = window(r.Preview, r.Matches)
+	last := first + len(lines) - 1
+	for n := max(first, r.Line-q.Before); n < r.Line && n <= last; n++ {
+		r.Before = append(r.Before, q.contextLine(n, lines[n-first]))
+	}
+	for n := max(first, r.Line+1); n <= r.Line+q.After && n <= last; n++ {
+		r.After = append(r.After, q.contextLine(n, lines[n-first]))
+	}
+}
+
+// splitLines splits src into lines without their line endings.
+func splitLines(src []byte) []string {
+	lines := strings.Split(string(src), "\n")
+	if n := len(lines); n > 0 && lines[n-1] == "" {
+		lines = lines[:n-1]
+	}
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, "\r")
+	}
+	return lines
+}
+
+// window cuts a line longer than previewWidth down to about that many bytes
+// around its first hit, preferring to cut at spaces, and marks the cut ends
+// with an ellipsis. The hits are shifted to match; hits outside the window
+// are dropped and hits crossing its edges are clipped.
+func window(text string, ms []Match) (string, []Match) {
+	if len(text) <= previewWidth {
+		return text, ms
+	}
+	start := 0
+	if len(ms) > 0 {
+		// Show some lead-in before the first hit.
+		start = max(0, ms[0].Start-previewWidth/4)
+	}
+	end := min(len(text), start+previewWidth)
+	start = max(0, end-previewWidth)
+
+	// Move inward to a space close to each cut, then to a rune boundary.
+	const slack = 24
+	if start > 0 {
+		if i := strings.IndexByte(text[start:min(start+slack, end)], ' '); i >= 0 {
+			start += i + 1
+		}
+		for start < end && !utf8.RuneStart(text[start]) {
+			start++
+		}
+	}
+	if end < len(text) {
+		if i := strings.LastIndexByte(text[max(start, end-slack):end], ' '); i >= 0 {
+			end = max(start, end-slack) + i
+		}
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+	}
+
+	prefix, suffix := "", ""
+	if start > 0 {
+		prefix = ellipsis
+	}
+	if end < len(text) {
+		suffix = ellipsis
+	}
+	out := prefix + text[start:end] + suffix
+	shift := len(prefix) - start
+	var kept []Match
+	for _, m := range ms {
+		s, e := max(m.Start, start), min(m.End, end)
+		if s >= e {
+			continue
+		}
+		kept = append(kept, Match{Start: s + shift, End: e + shift})
+	}
+	return out, kept
+}
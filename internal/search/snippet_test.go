@@ -0,0 +1,135 @@
+package search
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"repobook/internal/bgindex/bgindextest"
+)
+
+func TestWindow(t *testing.T) {
+	short := "a short line"
+	if got, ms := window(short, []Match{{2, 7}}); got != short || !reflect.DeepEqual(ms, []Match{{2, 7}}) {
+		t.Fatalf("expected a short line to be left alone, got %q %+v", got, ms)
+	}
+
+	long := strings.Repeat("lorem ipsum ", 40) + "needle " + strings.Repeat("dolor sit ", 40)
+	at := strings.Index(long, "needle")
+	got, ms := window(long, []Match{{at, at + 6}, {0, 5}})
+	if len(got) > previewWidth+2*len(ellipsis) || !strings.HasPrefix(got, ellipsis) || !strings.HasSuffix(got, ellipsis) {
+		t.Fatalf("expected a window with both ends cut, got %q", got)
+	}
+	if len(ms) != 1 || got[ms[0].Start:ms[0].End] != "needle" {
+		t.Fatalf("expected the hit to move with the window and the one before it to be dropped, got %+v in %q", ms, got)
+	}
+	if after := strings.TrimPrefix(got, ellipsis); !strings.HasPrefix(after, "lorem ") && !strings.HasPrefix(after, "ipsum ") {
+		t.Fatalf("expected the cut to fall on a word boundary, got %q", got)
+	}
+
+	// Without hits the window starts at the beginning; cuts keep runes whole.
+	got, _ = window(strings.Repeat("é", 200), nil)
+	if strings.HasPrefix(got, ellipsis) || !utf8.ValidString(got) {
+		t.Fatalf("expected a valid window from the start, got %q", got)
+	}
+}
+
+func TestContextLines_FallbackAndIndex(t *testing.T) {
+	root := t.TempDir()
+	bgindextest.WriteDoc(t, root, "a.md", "# A\none\ntwo\nneedle here\nthree\n\nneedle again\n")
+
+	q, err := ParseQuery("needle", QueryOptions{Before: 2, After: 1})
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+	res, err := Fallback(context.Background(), root, nil, q, 10)
+	if err != nil {
+		t.Fatalf("Fallback: %v", err)
+	}
+	if len(res.Results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", res.Results)
+	}
+	r := res.Results[0]
+	if want := []ContextLine{{Line: 2, Text: "one"}, {Line: 3, Text: "two"}}; !reflect.DeepEqual(r.Before, want) {
+		t.Fatalf("Before: got %+v, want %+v", r.Before, want)
+	}
+	if want := []ContextLine{{Line: 5, Text: "three"}}; !reflect.DeepEqual(r.After, want) {
+		t.Fatalf("After: got %+v, want %+v", r.After, want)
+	}
+	// Context lines carry their own hits; the last line has no after-context.
+	r = res.Results[1]
+	if len(r.Before) != 2 || r.Before[0].Line != 5 || r.After != nil {
+		t.Fatalf("unexpected context for the second hit %+v", r)
+	}
+
+	idx := newReadyIndex(t, root, nil)
+	res = idx.Search(q, 10)
+	if len(res.Results) != 1 || len(res.Results[0].Before) != 2 || len(res.Results[0].After) != 1 {
+		t.Fatalf("expected the index to return context too, got %+v", res.Results)
+	}
+
+	if _, err := ParseQuery("x", QueryOptions{Before: -1}); err == nil {
+		t.Fatalf("expected an error for negative context")
+	}
+	if q := mustQueryOpts(t, "x", QueryOptions{After: 1000}); q.After != MaxContext {
+		t.Fatalf("expected context to be capped at %d, got %d", MaxContext, q.After)
+	}
+}
+
+func TestRgContext(t *testing.T) {
+	q := mustQueryOpts(t, "needle", QueryOptions{Before: 1, After: 2})
+	var got []Result
+	c := &rgContext{q: q, emit: func(r Result) { got = append(got, r) }}
+	hit := func(n int) *Result { return &Result{Path: "a.md", Line: n, Preview: "needle"} }
+
+	// rg's view of a.md with -B1 -A2: hits at 2 and 3 share context, the
+	// hit at 9 starts after a gap.
+	c.line("a.md", 1, "one", nil)
+	c.line("a.md", 2, "needle", hit(2))
+	c.line("a.md", 3, "needle", hit(3))
+	if len(got) != 0 {
+		t.Fatalf("expected results to wait for their after-context, got %+v", got)
+	}
+	c.line("a.md", 4, "four", nil)
+	if len(got) != 1 {
+		t.Fatalf("expected the first result once its after-context is complete, got %+v", got)
+	}
+	c.line("a.md", 5, "five", nil)
+	c.line("a.md", 8, "eight", nil)
+	c.line("a.md", 9, "needle", hit(9))
+	c.line("b.md", 1, "other", nil)
+
+	lines := func(cls []ContextLine) []int {
+		var out []int
+		for _, cl := range cls {
+			out = append(out, cl.Line)
+		}
+		return out
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected 3 results, got %+v", got)
+	}
+	for i, want := range []struct{ before, after []int }{
+		{[]int{1}, []int{3, 4}},
+		{[]int{2}, []int{4, 5}},
+		{[]int{8}, nil},
+	} {
+		if b, a := lines(got[i].Before), lines(got[i].After); !reflect.DeepEqual(b, want.before) || !reflect.DeepEqual(a, want.after) {
+			t.Fatalf("result %d: got before %v after %v, want %v %v", i, b, a, want.before, want.after)
+		}
+	}
+	if m := got[0].After[0].Matches; !reflect.DeepEqual(m, []Match{{0, 6}}) {
+		t.Fatalf("expected term hits in context lines, got %+v", m)
+	}
+}
+
+func mustQueryOpts(t *testing.T, raw string, opts QueryOptions) Query {
+	t.Helper()
+	q, err := ParseQuery(raw, opts)
+	if err != nil {
+		t.Fatalf("ParseQuery(%q): %v", raw, err)
+	}
+	return q
+}
@@ -0,0 +1,51 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// tokenize splits text into lower-cased index terms: runs of letters and
+// digits. Single letters are dropped as noise; single digits are kept.
+func tokenize(s string) []string {
+	spans := tokenSpans(s)
+	out := make([]string, len(spans))
+	for i, sp := range spans {
+		out[i] = sp.term
+	}
+	return out
+}
+
+// span is a token with its byte range in the source text.
+type span struct {
+	term       string
+	start, end int
+}
+
+func tokenSpans(s string) []span {
+	out := make([]span, 0, len(s)/6)
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		tok := s[start:end]
+		st := start
+		start = -1
+		if len(tok) == 1 && !unicode.IsDigit(rune(tok[0])) {
+			return
+		}
+		out = append(out, span{term: strings.ToLower(tok), start: st, end: end})
+	}
+	for i, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		flush(i)
+	}
+	flush(len(s))
+	return out
+}
@@ -3,15 +3,20 @@ package server
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
+	"repobook/internal/find"
+	"repobook/internal/git"
 	"repobook/internal/ignore"
 	"repobook/internal/render"
 	"repobook/internal/scan"
@@ -31,14 +36,39 @@ type Options struct {
 	// If RepoAssetPort is 0, an available port is chosen.
 	RepoAssetHost string
 	RepoAssetPort int
+
+	// StripNumericPrefix hides ordering prefixes like "01-" in the tree.
+	StripNumericPrefix bool
+
+	// Include and Exclude are gitignore-style globs (relative to Root) that
+	// scope the book on top of .gitignore and .repobookignore rules.
+	Include []string
+	Exclude []string
+
+	// TreeAllFiles lists all non-ignored files in the tree, not only
+	// markdown. Clients can also request this per call with /api/tree?all=1,
+	// after which the watcher reports changes to all files too.
+	TreeAllFiles bool
+
+	// WatchMode and PollInterval select how file changes are noticed; see
+	// watch.WatcherOptions.
+	WatchMode    string
+	PollInterval time.Duration
+	// Warn is called when file watching falls back to a less precise mode,
+	// for example when the system runs out of file watches. /api/status
+	// reports the same.
+	Warn func(msg string)
 }
 
 type Server struct {
 	rootAbs  string
-	ignore   *ignore.Matcher
+	opts     Options
+	ignore   *ignore.Live
 	renderer *render.Renderer
 	hub      *watch.Hub
 	watcher  *watch.Watcher
+	index    *search.Index
+	finder   *find.Index
 
 	repoAssetBaseURL string
 	repoAssetSrv     *http.Server
@@ -55,13 +85,24 @@ func New(opts Options) (*Server, error) {
 		opts.RepoAssetHost = "127.0.0.1"
 	}
 
-	ig, err := ignore.Load(rootAbs)
+	ig, err := ignore.NewLive(rootAbs, ignore.Options{
+		Include: opts.Include,
+		Exclude: opts.Exclude,
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	hub := watch.NewHub()
-	w, err := watch.NewWatcher(rootAbs, hub, ig)
+	hub := watch.NewHubWithOptions(watch.HubOptions{RevealPath: revealPath(rootAbs, ig)})
+	w, err := watch.NewWatcher(watch.WatcherOptions{
+		RootAbs:      rootAbs,
+		Hub:          hub,
+		Ignore:       ig,
+		AllFiles:     opts.TreeAllFiles,
+		Mode:         opts.WatchMode,
+		PollInterval: opts.PollInterval,
+		Warn:         opts.Warn,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -72,29 +113,71 @@ func New(opts Options) (*Server, error) {
 		return nil, err
 	}
 
+	// The ranked search index builds in the background; until it is ready,
+	// searches use line search.
+	idx := search.NewIndex(rootAbs, ig.Matcher)
+	idx.Refresh()
+	// Quick open keeps its own cache of paths, titles and headings.
+	finder := find.NewIndex(rootAbs, ig.Matcher)
+	finder.Refresh()
+	hub.Listen(func(ev watch.Event) {
+		switch ev.Type {
+		case "file-changed":
+			for _, p := range []string{ev.From, ev.Path} {
+				if p != "" {
+					idx.Update(p)
+					finder.Update(p)
+				}
+			}
+		case "tree-updated":
+			idx.Refresh()
+			finder.Refresh()
+		}
+	})
+
 	s := &Server{
 		rootAbs:  rootAbs,
+		opts:     opts,
 		ignore:   ig,
 		renderer: r,
 		hub:      hub,
 		watcher:  w,
+		index:    idx,
+		finder:   finder,
 	}
 
+	hub.Listen(s.pushRender)
+
 	// Serve repo assets from a different origin than the app UI.
 	// This prevents raw HTML/JS inside the repo from becoming same-origin with
 	// the repobook UI + API.
 	if err := s.startRepoAssetServer(opts.RepoAssetHost, opts.RepoAssetPort); err != nil {
 		_ = w.Close()
+		idx.Close()
+		finder.Close()
 		return nil, err
 	}
 
 	return s, nil
 }
 
+// CloseLive ends the live-update connections, which would otherwise keep
+// http.Server.Shutdown waiting. Register it with RegisterOnShutdown.
+func (s *Server) CloseLive() {
+	s.hub.Close()
+}
+
 func (s *Server) Close() error {
+	s.hub.Close()
 	if s.watcher != nil {
 		_ = s.watcher.Close()
 	}
+	if s.index != nil {
+		s.index.Close()
+	}
+	if s.finder != nil {
+		s.finder.Close()
+	}
 	if s.repoAssetSrv != nil {
 		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 		defer cancel()
@@ -125,10 +208,15 @@ func (s *Server) Handler() http.Handler {
 	mux.HandleFunc("/api/tree", s.handleTree)
 	mux.HandleFunc("/api/home", s.handleHome)
 	mux.HandleFunc("/api/render", s.handleRender)
+	mux.HandleFunc("/api/source", s.handleSource)
 	mux.HandleFunc("/api/search", s.handleSearch)
+	mux.HandleFunc("/api/find", s.handleFind)
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/reveal", s.handleReveal)
 
-	// WebSocket
+	// Live updates: WebSocket, or Server-Sent Events where proxies block it
 	mux.HandleFunc("/ws", s.hub.ServeWS)
+	mux.HandleFunc("/events", s.hub.ServeSSE)
 
 	// Client routes
 	mux.HandleFunc("/file/", s.handleIndex)
@@ -180,7 +268,23 @@ func (s *Server) handleTree(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tree, err := scan.BuildTree(scan.Options{RootAbs: s.rootAbs, Ignore: s.ignore})
+	all := s.opts.TreeAllFiles
+	switch r.URL.Query().Get("all") {
+	case "1", "true":
+		all = true
+	case "0", "false":
+		all = false
+	}
+	if all && s.watcher != nil {
+		s.watcher.ReportAllFiles()
+	}
+
+	tree, err := scan.BuildTree(scan.Options{
+		RootAbs:            s.rootAbs,
+		Ignore:             s.ignore.Matcher(),
+		StripNumericPrefix: s.opts.StripNumericPrefix,
+		AllFiles:           all,
+	})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -204,6 +308,106 @@ func (s *Server) handleHome(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, map[string]string{"path": rel})
 }
 
+// pushRender renders a changed document once and pushes the result to the
+// clients viewing it as a "rendered" event, so they need not refetch it.
+// Rendering happens off the watcher's goroutine; clients compare MTime to
+// drop a render overtaken by a newer one.
+func (s *Server) pushRender(ev watch.Event) {
+	if ev.Type != "file-changed" || (ev.Change != watch.ChangeModified && ev.Change != watch.ChangeCreated) {
+		return
+	}
+	if !util.IsMarkdownFileName(path.Base(ev.Path)) || !s.hub.Subscribed(watch.FileTopic(ev.Path)) {
+		return
+	}
+	go func() {
+		res, err := s.renderer.RenderFile(ev.Path)
+		if err != nil {
+			// Gone again, or unreadable; clients fall back to refetching.
+			return
+		}
+		data, err := json.Marshal(res)
+		if err != nil {
+			return
+		}
+		s.hub.Push(watch.FileTopic(ev.Path), watch.Event{Type: "rendered", Path: ev.Path, Render: data})
+	}()
+}
+
+// statusResponse is the body of /api/status.
+type statusResponse struct {
+	Watch watch.Status   `json:"watch"`
+	Hub   watch.HubStats `json:"hub"`
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, statusResponse{Watch: s.watcher.Status(), Hub: s.hub.Stats()})
+}
+
+// revealResponse is the body of /api/reveal.
+type revealResponse struct {
+	Path    string `json:"path"`
+	Line    int    `json:"line"`
+	Clients int    `json:"clients"` // how many viewers were told
+}
+
+// handleReveal lets an editor plugin scroll the viewers to the block at a
+// source line: POST /api/reveal with path and line as query or form values,
+// or path alone as "path:line". Requests from pages on other sites are
+// refused, so they cannot steer the viewers.
+func (s *Server) handleReveal(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !util.SameOrigin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	q, lineStr := r.FormValue("path"), r.FormValue("line")
+	if lineStr == "" {
+		if i := strings.LastIndexByte(q, ':'); i >= 0 {
+			q, lineStr = q[:i], q[i+1:]
+		}
+	}
+	line, err := strconv.Atoi(lineStr)
+	if err != nil || line < 1 {
+		http.Error(w, "bad line", http.StatusBadRequest)
+		return
+	}
+	rel, n, ok := s.hub.Reveal(q, line)
+	if !ok {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(w, revealResponse{Path: rel, Line: line, Clients: n})
+}
+
+// revealPath checks the path of a reveal request for the hub: a file in the
+// root that is not ignored. The path may be absolute, as editors know it,
+// if it is inside the root.
+func revealPath(rootAbs string, ig *ignore.Live) func(string) (string, bool) {
+	return func(p string) (string, bool) {
+		if filepath.IsAbs(p) {
+			rel, err := filepath.Rel(rootAbs, p)
+			if err != nil {
+				return "", false
+			}
+			p = filepath.ToSlash(rel)
+		}
+		_, rel, err := util.ResolveRepoPath(rootAbs, p)
+		if err != nil || rel == "" || rel == "." || ig.Matcher().IsIgnored(rel, false) {
+			return "", false
+		}
+		return rel, true
+	}
+}
+
 func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -211,6 +415,10 @@ func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
 	}
 
 	q := r.URL.Query().Get("path")
+	if rev := r.URL.Query().Get("rev"); rev != "" {
+		s.renderRevision(w, r, q, rev)
+		return
+	}
 	if q == "" {
 		// Default is README.md at repo root.
 		rel, err := util.ResolveDefaultReadmeRel(s.rootAbs)
@@ -231,7 +439,7 @@ func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
-	if s.ignore != nil && resolved.Rel != "" && s.ignore.IsIgnored(resolved.Rel, false) {
+	if resolved.Rel != "" && s.ignore.Matcher().IsIgnored(resolved.Rel, false) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
@@ -245,6 +453,87 @@ func (s *Server) handleRender(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, res)
 }
 
+// renderRevision renders the markdown file at q as of git revision rev, for
+// history search results. The file may no longer exist in the working tree.
+func (s *Server) renderRevision(w http.ResponseWriter, r *http.Request, q, rev string) {
+	if !git.ValidRevision(rev) {
+		http.Error(w, "bad revision", http.StatusBadRequest)
+		return
+	}
+	if unesc, err := url.PathUnescape(q); err == nil {
+		q = unesc
+	}
+	_, rel, err := util.ResolveRepoPath(s.rootAbs, q)
+	if err != nil || rel == "" || rel == "." || !util.IsMarkdownFileName(path.Base(rel)) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if s.ignore.Matcher().IsIgnored(rel, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	src, err := git.Show(r.Context(), s.rootAbs, rev, rel)
+	if err != nil {
+		switch {
+		case errors.Is(err, os.ErrNotExist), errors.Is(err, git.ErrNotRepo), errors.Is(err, git.ErrNotFound):
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	res, err := s.renderer.RenderBytes(rel, src)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res.Rev = rev
+
+	writeJSON(w, res)
+}
+
+// handleSource renders a non-markdown text file as a highlighted listing for
+// the all-files tree mode.
+func (s *Server) handleSource(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query().Get("path")
+	if unesc, err := url.PathUnescape(q); err == nil {
+		q = unesc
+	}
+
+	_, rel, err := util.ResolveRepoPath(s.rootAbs, q)
+	if err != nil || rel == "" || rel == "." {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if s.ignore.Matcher().IsIgnored(rel, false) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	res, err := s.renderer.RenderSource(rel)
+	if err != nil {
+		switch {
+		case errors.Is(err, render.ErrNotText):
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, render.ErrSourceTooLarge):
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, "not found", http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeJSON(w, res)
+}
+
 func (s *Server) handleRepoAssetRedirect(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -293,7 +582,7 @@ func (s *Server) handleRepoAssetDirect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
-	if s.ignore != nil && relURL != "" && s.ignore.IsIgnored(relURL, false) {
+	if relURL != "" && s.ignore.Matcher().IsIgnored(relURL, false) {
 		http.Error(w, "not found", http.StatusNotFound)
 		return
 	}
@@ -317,21 +606,179 @@ func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	q := r.URL.Query().Get("q")
-	res, err := search.Ripgrep(s.rootAbs, q, 200)
+	params := r.URL.Query()
+	before, after, err := contextParams(params)
 	if err != nil {
-		if err == search.ErrRipgrepNotFound {
-			// Fall back to a built-in search for environments where rg isn't
-			// available (common on Windows).
-			res, err = search.Fallback(s.rootAbs, s.ignore, q, 200)
-		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	q, err := search.ParseQuery(params.Get("q"), search.QueryOptions{
+		Regex:     boolParam(params.Get("regex")),
+		WholeWord: boolParam(params.Get("word")),
+		Case:      search.CaseMode(params.Get("case")),
+		Before:    before,
+		After:     after,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := search.ParsePage(params.Get("cursor"), params.Get("limit"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// With stream=1, results are written as NDJSON as soon as they are found,
+	// followed by a summary line.
+	var stream *searchStream
+	var emit func(search.Result)
+	if boolParam(params.Get("stream")) {
+		stream = newSearchStream(w)
+		emit = stream.result
+	}
+
+	// The request context cancels the search when the client goes away, e.g.
+	// when a newer keystroke supersedes this query.
+	res, err := s.runSearch(r.Context(), q, params.Get("mode"), page, emit)
+	if r.Context().Err() != nil {
+		return
+	}
+	if stream != nil {
+		stream.summary(q.Raw, res, err)
+		return
+	}
+	switch {
+	case errors.Is(err, search.ErrInvalidQuery), errors.Is(err, git.ErrNotRepo), errors.Is(err, git.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, res)
+}
+
+// runSearch picks a backend for q and returns the requested page. Ranked
+// search over the index is the default; "mode=lines" asks for raw line
+// matches in file order, as do regex, whole-word and case-sensitive queries.
+// "mode=history" searches lines added or removed in git history instead.
+// The first page of a working tree search also carries facet counts over all
+// matching files.
+func (s *Server) runSearch(ctx context.Context, q search.Query, mode string, page search.Page, emit func(search.Result)) (search.Response, error) {
+	if mode == "history" {
+		p := search.NewPager(page, emit)
+		res, err := search.HistoryStream(ctx, s.rootAbs, s.ignore.Matcher(), q, p.ScanLimit(), p.Add)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return search.Response{}, err
 		}
+		return p.Response(res), nil
 	}
+	res, err := s.searchPage(ctx, q, mode, page, emit)
+	if err == nil && page.Offset == 0 {
+		res.Facets = s.index.CountFacets(res.Files)
+	}
+	return res, err
+}
 
-	writeJSON(w, res)
+func (s *Server) searchPage(ctx context.Context, q search.Query, mode string, page search.Page, emit func(search.Result)) (search.Response, error) {
+	p := search.NewPager(page, emit)
+	if mode != "lines" && !q.LinesOnly() && s.index.Ready() {
+		res := s.index.Search(q, p.ScanLimit())
+		for _, r := range res.Results {
+			p.Add(r)
+		}
+		return p.Response(res), nil
+	}
+
+	// Only the hits on the page need their sections; the rest are counted.
+	q = p.Lazy(q, s.rootAbs)
+	res, err := search.RipgrepStream(ctx, s.rootAbs, s.ignore.Matcher(), q, p.ScanLimit(), p.Add)
+	if err == search.ErrRipgrepNotFound {
+		// Fall back to a built-in search for environments where rg isn't
+		// available (common on Windows).
+		res, err = search.FallbackStream(ctx, s.rootAbs, s.ignore.Matcher(), q, p.ScanLimit(), p.Add)
+	}
+	if err != nil {
+		return search.Response{}, err
+	}
+	return p.Response(res), nil
+}
+
+// searchStream writes streamed search output: one JSON object per line,
+// "result" events followed by a single "summary".
+type searchStream struct {
+	w     http.ResponseWriter
+	enc   *json.Encoder
+	count int
+}
+
+type searchEvent struct {
+	Type   string         `json:"type"`
+	Result *search.Result `json:"result,omitempty"`
+
+	// Summary fields.
+	Query     string            `json:"query,omitempty"`
+	Count     int               `json:"count,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+	Engine    string            `json:"engine,omitempty"`
+	Total     int               `json:"total,omitempty"`
+	Estimated bool              `json:"estimated,omitempty"`
+	Next      string            `json:"next,omitempty"`
+	Files     []search.FileHits `json:"files,omitempty"`
+	Facets    *search.Facets    `json:"facets,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+func newSearchStream(w http.ResponseWriter) *searchStream {
+	w.Header().Set("Content-Type", "application/x-ndjson; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &searchStream{w: w, enc: enc}
+}
+
+func (st *searchStream) result(r search.Result) {
+	st.count++
+	st.write(searchEvent{Type: "result", Result: &r})
+}
+
+func (st *searchStream) summary(query string, res search.Response, err error) {
+	ev := searchEvent{
+		Type:      "summary",
+		Query:     query,
+		Count:     st.count,
+		Truncated: res.Truncated,
+		Engine:    res.Engine,
+		Total:     res.Total,
+		Estimated: res.Estimated,
+		Next:      res.Next,
+		Files:     res.Files,
+		Facets:    res.Facets,
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	st.write(ev)
+}
+
+func (st *searchStream) write(ev searchEvent) {
+	_ = st.enc.Encode(ev)
+	if f, ok := st.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// handleFind serves quick open: fuzzy matches over document paths, titles
+// and headings.
+func (s *Server) handleFind(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, s.finder.Find(r.URL.Query().Get("q"), 50))
 }
 
 func writeJSON(w http.ResponseWriter, v any) {
@@ -341,3 +788,35 @@ func writeJSON(w http.ResponseWriter, v any) {
 	enc.SetEscapeHTML(false)
 	_ = enc.Encode(v)
 }
+
+// boolParam reads a flag-style query parameter ("1" or "true").
+func boolParam(v string) bool {
+	return v == "1" || v == "true"
+}
+
+// contextParams reads the number of context lines around search hits:
+// "context" sets both sides, "before" and "after" override it.
+func contextParams(params url.Values) (before, after int, err error) {
+	read := func(name string, def int) (int, error) {
+		v := params.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return 0, fmt.Errorf("bad %s %q", name, v)
+		}
+		return n, nil
+	}
+	both, err := read("context", 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	if before, err = read("before", both); err != nil {
+		return 0, 0, err
+	}
+	if after, err = read("after", both); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+// File kinds reported in the tree and used to pick a viewer.
+const (
+	KindMarkdown = "markdown"
+	KindText     = "text"
+	KindImage    = "image"
+	KindPDF      = "pdf"
+	KindBinary   = "binary"
+)
+
+var imageExts = map[string]struct{}{
+	".png": {}, ".jpg": {}, ".jpeg": {}, ".gif": {}, ".svg": {}, ".webp": {}, ".bmp": {}, ".ico": {}, ".avif": {},
+}
+
+var binaryExts = map[string]struct{}{
+	".zip": {}, ".gz": {}, ".tgz": {}, ".bz2": {}, ".xz": {}, ".7z": {}, ".rar": {}, ".tar": {},
+	".exe": {}, ".dll": {}, ".so": {}, ".dylib": {}, ".a": {}, ".o": {}, ".class": {}, ".jar": {}, ".wasm": {},
+	".woff": {}, ".woff2": {}, ".ttf": {}, ".otf": {}, ".eot": {},
+	".mp3": {}, ".mp4": {}, ".mov": {}, ".avi": {}, ".wav": {}, ".ogg": {}, ".webm": {},
+	".doc": {}, ".docx": {}, ".xls": {}, ".xlsx": {}, ".ppt": {}, ".pptx": {}, ".db": {}, ".sqlite": {},
+}
+
+// FileKind classifies a file by its name alone, without reading it.
+// Names it doesn't know are taken for text; the source view finds out when
+// such a file is binary.
+func FileKind(name string) string {
+	if IsMarkdownFileName(name) {
+		return KindMarkdown
+	}
+	ext := strings.ToLower(path.Ext(name))
+	if ext == ".pdf" {
+		return KindPDF
+	}
+	if _, ok := imageExts[ext]; ok {
+		return KindImage
+	}
+	if _, ok := binaryExts[ext]; ok {
+		return KindBinary
+	}
+	return KindText
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// SameOrigin reports whether r comes from a page served by this server: its
+// Origin header, if any, names the host r was sent to. Browsers send Origin
+// with WebSocket upgrades and cross-site POSTs, so this keeps other web
+// pages from using the local server to read documents or drive the viewer.
+// Requests without an Origin (curl, editor plugins) are allowed.
+func SameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
@@ -0,0 +1,29 @@
+package util
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSameOrigin(t *testing.T) {
+	cases := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://127.0.0.1:3000", true},
+		{"http://127.0.0.1:3001", false},
+		{"https://evil.example", false},
+		{"null", false},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:3000/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if got := SameOrigin(r); got != tc.want {
+			t.Fatalf("origin %q: got %v, want %v", tc.origin, got, tc.want)
+		}
+	}
+}
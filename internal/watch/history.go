@@ -0,0 +1,46 @@
+package watch
+
+// record is an event kept for resuming clients.
+type record struct {
+	msg    message
+	topics []string
+}
+
+// history is a ring buffer of the most recent events. Events are numbered
+// consecutively, so the buffer covers the numbers seq-n+1 through seq.
+type history struct {
+	buf  []record
+	head int // index of the oldest record
+	n    int
+}
+
+func (h *history) add(r record) {
+	if len(h.buf) == 0 {
+		return
+	}
+	if h.n < len(h.buf) {
+		h.buf[(h.head+h.n)%len(h.buf)] = r
+		h.n++
+		return
+	}
+	h.buf[h.head] = r
+	h.head = (h.head + 1) % len(h.buf)
+}
+
+// since returns the events after number id, given that seq is the number
+// of the last event. It reports false if some of them are no longer kept,
+// or if id is from the future.
+func (h *history) since(id, seq uint64) ([]record, bool) {
+	if id > seq {
+		return nil, false
+	}
+	missed := seq - id
+	if missed > uint64(h.n) {
+		return nil, false
+	}
+	out := make([]record, 0, missed)
+	for i := h.n - int(missed); i < h.n; i++ {
+		out = append(out, h.buf[(h.head+i)%len(h.buf)])
+	}
+	return out, true
+}
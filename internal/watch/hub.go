@@ -2,66 +2,609 @@ package watch
 
 import (
 	"encoding/json"
+	"errors"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+
+	"repobook/internal/util"
 )
 
 type Event struct {
+	// ID numbers the events of a hub in broadcast order, as
+	// "<epoch>-<seq>": seq counts from 1, and epoch changes whenever the
+	// server starts, so a client resuming from an ID of an earlier run is
+	// told to resync. It is set by Broadcast.
+	ID   string `json:"id,omitempty"`
 	Type string `json:"type"`
 	Path string `json:"path,omitempty"`
+
+	// Session, Anchor and Scroll describe a presenter's position in a
+	// "position" event: Path is the document, Anchor the heading in focus
+	// and Scroll how far down the document is scrolled, from 0 to 1. See
+	// SessionTopic.
+	Session string  `json:"session,omitempty"`
+	Anchor  string  `json:"anchor,omitempty"`
+	Scroll  float64 `json:"scroll,omitempty"`
+
+	// Line is the 1-based source line of Path to show in a "reveal" event.
+	// See Hub.Reveal.
+	Line int `json:"line,omitempty"`
+
+	// Change says what happened to Path in a "file-changed" event: one of
+	// ChangeCreated, ChangeModified, ChangeDeleted or ChangeRenamed. A
+	// renamed file was at From before.
+	Change string `json:"change,omitempty"`
+	From   string `json:"from,omitempty"`
+
+	// Render is the re-rendered document in a "rendered" event, which
+	// follows a "file-changed" event for clients viewing Path. It is encoded
+	// once and sent to every such client as is, by Push.
+	Render json.RawMessage `json:"render,omitempty"`
+}
+
+// Topics a client can subscribe to. Until a client subscribes to anything
+// it receives every event; afterwards only those of its topics.
+const (
+	// TopicTree has the "tree-updated" events.
+	TopicTree = "tree"
+	// TopicFiles has the "file-changed" events of every file; FileTopic
+	// names the topic of a single file.
+	TopicFiles = "files"
+	// TopicAll has every event.
+	TopicAll = "*"
+)
+
+// FileTopic returns the topic of the "file-changed" events of the file at
+// rel, including its renames.
+func FileTopic(rel string) string {
+	return "file:" + rel
+}
+
+// maxTopics caps the subscriptions of one client.
+const maxTopics = 64
+
+// topics returns the topics ev is published on.
+func (ev Event) topics() []string {
+	switch ev.Type {
+	case "tree-updated":
+		return []string{TopicTree}
+	case "file-changed":
+		ts := []string{TopicFiles, FileTopic(ev.Path)}
+		if ev.From != "" {
+			ts = append(ts, FileTopic(ev.From))
+		}
+		return ts
+	}
+	return nil
+}
+
+// clientMessage is what clients send over the WebSocket:
+//
+//	{"type": "subscribe", "topics": ["tree", "file:docs/a.md"]}
+//	{"type": "unsubscribe", "topics": ["file:docs/a.md"]}
+type clientMessage struct {
+	Type   string   `json:"type"`
+	Topics []string `json:"topics"`
+
+	// Presenter messages; see SessionTopic.
+	Path   string  `json:"path"`
+	Anchor string  `json:"anchor"`
+	Scroll float64 `json:"scroll"`
+
+	// A reveal message; see Hub.Reveal.
+	Line int `json:"line"`
+}
+
+type HubOptions struct {
+	// QueueSize is how many events may wait to be written to one client;
+	// 0 means DefaultQueueSize. A client whose queue is full is too slow to
+	// keep up and is disconnected, so it cannot hold up the others.
+	QueueSize int
+	// WriteTimeout bounds each write to a client; 0 means
+	// DefaultWriteTimeout.
+	WriteTimeout time.Duration
+	// PingInterval is how often clients are pinged; 0 means
+	// DefaultPingInterval. A client that sends nothing, not even a pong, for
+	// two intervals is disconnected.
+	PingInterval time.Duration
+	// History is how many recent events are kept for clients resuming
+	// after a disconnect; 0 means DefaultHistory.
+	History int
+	// RevealPath checks the path of a reveal request, from Hub.Reveal or a
+	// client, and returns it relative to the root; ok false rejects the
+	// request. If nil, paths are passed on as given.
+	RevealPath func(path string) (rel string, ok bool)
+}
+
+// Hub defaults. Events are small and rare, so a short queue only overflows
+// for a client that stopped reading.
+const (
+	DefaultQueueSize    = 64
+	DefaultWriteTimeout = 10 * time.Second
+	DefaultPingInterval = 30 * time.Second
+	DefaultHistory      = 256
+)
+
+// HubStats are counters for monitoring the hub's connections.
+type HubStats struct {
+	Clients   int    `json:"clients"`   // currently connected
+	Connected uint64 `json:"connected"` // ever connected
+	Sent      uint64 `json:"sent"`      // events written to clients
+	// Resuming clients: events replayed to them, and clients told to
+	// resync because they missed more than the history holds.
+	Replayed uint64 `json:"replayed"`
+	Resyncs  uint64 `json:"resyncs"`
+	// Disconnections by the hub: clients too slow to keep up (a full queue
+	// or a write timeout), clients that stopped answering pings, and clients
+	// whose writes failed otherwise.
+	Dropped  uint64 `json:"dropped"`
+	TimedOut uint64 `json:"timedout"`
+	Failed   uint64 `json:"failed"`
 }
 
 type Hub struct {
-	mu    sync.Mutex
-	conns map[*websocket.Conn]struct{}
+	queueSize    int
+	writeTimeout time.Duration
+	pingInterval time.Duration
+	revealPath   func(string) (string, bool)
+
+	mu        sync.Mutex
+	clients   map[*client]struct{}
+	listeners []func(Event)
+	epoch     string // tells event IDs of this hub from those of earlier runs
+	seq       uint64 // the number of the last event
+	history   history
+	sessions  map[string]*session // presenter sessions by code
+	closed    bool
+
+	connected, sent, replayed, resyncs, dropped, timedOut, failed atomic.Uint64
+}
+
+// client is one WebSocket or Server-Sent Events connection. Events are
+// queued on send and written by the client's own goroutine, so a stalled
+// connection only stalls itself.
+type client struct {
+	conn      *websocket.Conn // nil for SSE clients
+	send      chan message
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Guarded by Hub.mu. topics is nil until the first subscription.
+	topics  map[string]struct{}
+	session string // the code of the session c presents, if any
+}
+
+// message is an encoded event waiting to be written. id is the event's ID,
+// or "" if it is not numbered.
+type message struct {
+	id   string
+	data []byte
+}
+
+// wants reports whether c is subscribed to any of topics.
+func (c *client) wants(topics []string) bool {
+	if c.topics == nil {
+		return true
+	}
+	if _, ok := c.topics[TopicAll]; ok {
+		return true
+	}
+	for _, t := range topics {
+		if _, ok := c.topics[t]; ok {
+			return true
+		}
+	}
+	return false
 }
 
 func NewHub() *Hub {
-	return &Hub{conns: make(map[*websocket.Conn]struct{})}
+	return NewHubWithOptions(HubOptions{})
+}
+
+func NewHubWithOptions(opts HubOptions) *Hub {
+	h := &Hub{
+		queueSize:    opts.QueueSize,
+		writeTimeout: opts.WriteTimeout,
+		pingInterval: opts.PingInterval,
+		epoch:        strconv.FormatInt(time.Now().UnixNano(), 36),
+		revealPath:   opts.RevealPath,
+		clients:      make(map[*client]struct{}),
+		sessions:     make(map[string]*session),
+	}
+	size := opts.History
+	if size <= 0 {
+		size = DefaultHistory
+	}
+	h.history.buf = make([]record, size)
+	if h.queueSize <= 0 {
+		h.queueSize = DefaultQueueSize
+	}
+	if h.writeTimeout <= 0 {
+		h.writeTimeout = DefaultWriteTimeout
+	}
+	if h.pingInterval <= 0 {
+		h.pingInterval = DefaultPingInterval
+	}
+	return h
 }
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// Localhost only by default; still allow browser connections.
-		return true
-	},
+	// Events carry document contents: refuse pages from other origins.
+	CheckOrigin: util.SameOrigin,
 }
 
+// ServeWS serves live updates over a WebSocket. Like ServeSSE it takes
+// "topic" query parameters to subscribe from the start, and a client
+// reconnecting with "since" set to the last event ID it saw is first sent
+// the events it missed, or a "resync" event.
 func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
-	c, err := upgrader.Upgrade(w, r, nil)
+	since, resume, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		http.Error(w, "bad since", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	c := h.newClient(conn, topicParams(r))
+	if !h.add(c, since, resume) {
+		_ = conn.Close()
+		return
+	}
+
+	go h.writeLoop(c)
+	go h.readLoop(c)
+}
+
+func (h *Hub) newClient(conn *websocket.Conn, topics map[string]struct{}) *client {
+	return &client{
+		conn:   conn,
+		send:   make(chan message, h.queueSize),
+		done:   make(chan struct{}),
+		topics: topics,
+	}
+}
 
+// topicParams reads the "topic" query parameters; nil means none.
+func topicParams(r *http.Request) map[string]struct{} {
+	ts := r.URL.Query()["topic"]
+	if len(ts) == 0 {
+		return nil
+	}
+	topics := make(map[string]struct{})
+	for _, t := range ts {
+		if len(topics) < maxTopics {
+			topics[t] = struct{}{}
+		}
+	}
+	return topics
+}
+
+// cursor is the ID of the last event a resuming client saw.
+type cursor struct {
+	epoch string
+	seq   uint64
+}
+
+// parseSince reads the ID of the last event a resuming client saw; empty
+// means the client is not resuming. An ID without an epoch, or one of 0,
+// matches no epoch.
+func parseSince(v string) (since cursor, resume bool, err error) {
+	if v == "" {
+		return cursor{}, false, nil
+	}
+	epoch, seq, ok := strings.Cut(v, "-")
+	if !ok {
+		epoch, seq = "", v
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return cursor{epoch: epoch, seq: n}, err == nil, err
+}
+
+// eventID returns the ID of the event numbered seq.
+func (h *Hub) eventID(seq uint64) string {
+	return h.epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+// add registers c, unless the hub is closed. With resume set, c is first
+// sent the events after since that it is subscribed to, or a "resync" event
+// if they are no longer all in the history or since is from another run of
+// the server.
+func (h *Hub) add(c *client, since cursor, resume bool) bool {
 	h.mu.Lock()
-	h.conns[c] = struct{}{}
-	h.mu.Unlock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return false
+	}
+	h.clients[c] = struct{}{}
+	h.connected.Add(1)
+	if resume {
+		h.replay(c, since)
+	}
+	for t := range c.topics {
+		h.joined(c, t)
+	}
+	return true
+}
 
-	// Read loop: we don't handle client messages, but this detects disconnects.
-	go func() {
-		defer func() {
+// replay queues the events after since for c. h.mu must be held.
+func (h *Hub) replay(c *client, since cursor) {
+	if since.epoch != h.epoch {
+		h.resync(c)
+		return
+	}
+	missed, ok := h.history.since(since.seq, h.seq)
+	if !ok {
+		h.resync(c)
+		return
+	}
+	for _, r := range missed {
+		if !c.wants(r.topics) {
+			continue
+		}
+		select {
+		case c.send <- r.msg:
+			h.replayed.Add(1)
+		default:
+			// More than fit in the queue: start over instead.
+			for len(c.send) > 0 {
+				<-c.send
+			}
+			h.resync(c)
+			return
+		}
+	}
+}
+
+// resync tells c, whose queue is empty, that it missed events that can no
+// longer be replayed, so it must reload everything. h.mu must be held.
+func (h *Hub) resync(c *client) {
+	id := h.eventID(h.seq)
+	data, _ := json.Marshal(Event{ID: id, Type: "resync"})
+	c.send <- message{id: id, data: data}
+	h.resyncs.Add(1)
+}
+
+// readLoop applies subscription messages; reading is also what processes
+// pongs and notices disconnects.
+func (h *Hub) readLoop(c *client) {
+	defer h.remove(c)
+	c.conn.SetReadLimit(4096)
+	wait := 2 * h.pingInterval
+	_ = c.conn.SetReadDeadline(time.Now().Add(wait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wait))
+	})
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if isTimeout(err) && h.remove(c) {
+				h.timedOut.Add(1)
+			}
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(wait))
+		var msg clientMessage
+		if json.Unmarshal(data, &msg) == nil {
+			h.handleMessage(c, msg)
+		}
+	}
+}
+
+// handleMessage applies a subscribe, unsubscribe, presenter or reveal
+// message; others are ignored.
+func (h *Hub) handleMessage(c *client, msg clientMessage) {
+	if msg.Type == "reveal" {
+		// Checking the path may read the disk, so it happens unlocked.
+		if rel, ok := h.revealTarget(msg.Path, msg.Line); ok {
 			h.mu.Lock()
-			delete(h.conns, c)
+			h.reveal(c, rel, msg.Line)
 			h.mu.Unlock()
-			_ = c.Close()
-		}()
-		for {
-			if _, _, err := c.ReadMessage(); err != nil {
+		}
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch msg.Type {
+	case "subscribe":
+		if c.topics == nil {
+			c.topics = make(map[string]struct{})
+		}
+		for _, t := range msg.Topics {
+			if _, ok := c.topics[t]; !ok && len(c.topics) < maxTopics {
+				c.topics[t] = struct{}{}
+				h.joined(c, t)
+			}
+		}
+	case "unsubscribe":
+		// A client that never subscribed keeps receiving everything.
+		for _, t := range msg.Topics {
+			delete(c.topics, t)
+		}
+	case "present":
+		h.present(c)
+	case "position":
+		h.position(c, msg)
+	case "stop":
+		h.endSession(c)
+	}
+}
+
+// writeLoop writes queued events and pings to c until it is removed or a
+// write fails.
+func (h *Hub) writeLoop(c *client) {
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg.data); err != nil {
+				h.writeFailed(c, err)
 				return
 			}
+			h.sent.Add(1)
+		case <-ping.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				h.writeFailed(c, err)
+				return
+			}
+		}
+	}
+}
+
+// writeFailed disconnects c after a failed write. A write that ran out of
+// time means the client is not reading: it counts as dropped.
+func (h *Hub) writeFailed(c *client, err error) {
+	if !h.remove(c) {
+		return
+	}
+	if isTimeout(err) {
+		h.dropped.Add(1)
+	} else {
+		h.failed.Add(1)
+	}
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// remove disconnects c and reports whether it was still connected.
+func (h *Hub) remove(c *client) bool {
+	h.mu.Lock()
+	_, ok := h.clients[c]
+	delete(h.clients, c)
+	h.endSession(c)
+	h.mu.Unlock()
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.conn != nil {
+			_ = c.conn.Close()
 		}
-	}()
+	})
+	return ok
+}
+
+// Close disconnects every client, WebSocket and SSE alike, and turns away
+// new ones. A server shutting down must call it: an SSE stream otherwise
+// only ends with its request.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	clients := make([]*client, 0, len(h.clients))
+	for c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.Unlock()
+	for _, c := range clients {
+		h.remove(c)
+	}
+}
+
+// Listen registers an in-process callback that receives every broadcast
+// event. Callbacks run synchronously on the broadcasting goroutine (usually
+// the watcher loop), so they must not block.
+func (h *Hub) Listen(fn func(Event)) {
+	h.mu.Lock()
+	h.listeners = append(h.listeners, fn)
+	h.mu.Unlock()
 }
 
+// Broadcast sends ev to the listeners, numbers it, and queues it for every
+// client subscribed to it. It never waits on a client: one whose queue is
+// full is disconnected (the browser reconnects and resumes).
 func (h *Hub) Broadcast(ev Event) {
-	payload, _ := json.Marshal(ev)
+	h.mu.Lock()
+	listeners := h.listeners
+	h.mu.Unlock()
+	for _, fn := range listeners {
+		fn(ev)
+	}
+
+	topics := ev.topics()
+	var slow []*client
+	h.mu.Lock()
+	// Numbering and queueing under one lock keeps every client's events in
+	// ID order.
+	h.seq++
+	ev.ID = h.eventID(h.seq)
+	data, _ := json.Marshal(ev)
+	msg := message{id: ev.ID, data: data}
+	h.history.add(record{msg: msg, topics: topics})
+	for c := range h.clients {
+		if !c.wants(topics) {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.Unlock()
+	for _, c := range slow {
+		if h.remove(c) {
+			h.dropped.Add(1)
+		}
+	}
+}
+
+// Push sends ev to the clients subscribed to topic itself, without
+// numbering it or keeping it in the history, and skips clients whose queue
+// is full. It suits large events that only matter until the next one, such
+// as "rendered": a client that misses one still has the numbered event
+// that announced the change, and can refetch.
+func (h *Hub) Push(topic string, ev Event) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	for c := range h.conns {
-		_ = c.WriteMessage(websocket.TextMessage, payload)
+	h.publish(topic, data)
+}
+
+// Subscribed reports whether any client subscribed to topic itself, as
+// opposed to receiving it for not having subscribed to anything.
+func (h *Hub) Subscribed(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.clients {
+		if _, ok := c.topics[topic]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Stats returns the hub's connection counters.
+func (h *Hub) Stats() HubStats {
+	h.mu.Lock()
+	n := len(h.clients)
+	h.mu.Unlock()
+	return HubStats{
+		Clients:   n,
+		Connected: h.connected.Load(),
+		Sent:      h.sent.Load(),
+		Replayed:  h.replayed.Load(),
+		Resyncs:   h.resyncs.Load(),
+		Dropped:   h.dropped.Load(),
+		TimedOut:  h.timedOut.Load(),
+		Failed:    h.failed.Load(),
 	}
 }
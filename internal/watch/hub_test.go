@@ -1,9 +1,15 @@
 package watch
 
 import (
+	"bufio"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,26 +18,584 @@ import (
 
 func TestHub_Broadcast(t *testing.T) {
 	h := NewHub()
+	c := dial(t, serveHub(t, h))
+	waitFor(t, "client", func() bool { return h.Stats().Clients == 1 })
 
+	h.Broadcast(Event{Type: "file-changed", Path: "README.md"})
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, msg, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !strings.Contains(string(msg), "file-changed") {
+		t.Fatalf("expected event type in message, got %s", string(msg))
+	}
+}
+
+func TestHub_SlowClientDoesNotBlockBroadcast(t *testing.T) {
+	h := NewHubWithOptions(HubOptions{QueueSize: 4, WriteTimeout: 200 * time.Millisecond})
+	url := serveHub(t, h)
+
+	var got atomic.Int64
+	fast := dial(t, url)
+	go func() {
+		for {
+			if _, _, err := fast.ReadMessage(); err != nil {
+				return
+			}
+			got.Add(1)
+		}
+	}()
+	// Never reads: its socket buffers fill up, then its queue.
+	_ = dial(t, url)
+	waitFor(t, "both clients", func() bool { return h.Stats().Clients == 2 })
+
+	// Big events fill the slow client's buffers quickly. Each is broadcast
+	// once the fast client has the previous one, so only the slow client
+	// falls behind. Were Broadcast to wait on it, this would never finish.
+	const n = 1000
+	ev := Event{Type: "file-changed", Path: strings.Repeat("x", 32<<10)}
+	done := make(chan bool, 1)
+	go func() {
+		for i := 1; i <= n; i++ {
+			h.Broadcast(ev)
+			deadline := time.Now().Add(5 * time.Second)
+			for got.Load() < int64(i) {
+				if time.Now().After(deadline) {
+					done <- false
+					return
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}
+		done <- true
+	}()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Fatalf("the fast client stopped receiving events")
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("broadcasting was held up by the slow client")
+	}
+
+	waitFor(t, "slow client dropped", func() bool { return h.Stats().Clients == 1 })
+	st := h.Stats()
+	if st.Connected != 2 || st.Dropped != 1 || st.TimedOut != 0 || st.Failed != 0 {
+		t.Fatalf("Stats() = %+v, want 2 connected, 1 dropped", st)
+	}
+	if st.Sent < n {
+		t.Fatalf("Stats().Sent = %d, want at least %d", st.Sent, n)
+	}
+}
+
+func TestHub_DropsClientsThatStopAnsweringPings(t *testing.T) {
+	h := NewHubWithOptions(HubOptions{PingInterval: 50 * time.Millisecond})
+	url := serveHub(t, h)
+
+	// Reading answers pings.
+	alive := dial(t, url)
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	_ = dial(t, url)
+
+	waitFor(t, "silent client dropped", func() bool { return h.Stats().TimedOut == 1 })
+	time.Sleep(300 * time.Millisecond)
+	if st := h.Stats(); st.Clients != 1 || st.TimedOut != 1 {
+		t.Fatalf("Stats() = %+v, want the answering client to stay", st)
+	}
+
+	h.Broadcast(Event{Type: "tree-updated"})
+	waitFor(t, "event sent", func() bool { return h.Stats().Sent == 1 })
+}
+
+func serveHub(t *testing.T, h *Hub) string {
+	t.Helper()
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", h.ServeWS)
 	srv := httptest.NewServer(mux)
-	defer srv.Close()
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
 
-	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
-	c, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+func dial(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
 	if err != nil {
 		t.Fatalf("dial: %v", err)
 	}
-	defer func() { _ = c.Close() }()
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
 
-	h.Broadcast(Event{Type: "file-changed", Path: "README.md"})
-	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
-	_, msg, err := c.ReadMessage()
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHub_Subscriptions(t *testing.T) {
+	h := NewHub()
+	h.epoch = "e"
+	url := serveHub(t, h)
+	all := dial(t, url)
+	doc := dial(t, url)
+	waitFor(t, "both clients", func() bool { return h.Stats().Clients == 2 })
+
+	send := func(msg string, want int) {
+		t.Helper()
+		if err := doc.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		waitFor(t, "subscription", func() bool {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			for c := range h.clients {
+				if c.topics != nil && len(c.topics) == want {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	read := func(c *websocket.Conn) []string {
+		t.Helper()
+		// A final marker event that every client receives ends the batch.
+		var got []string
+		for {
+			_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if strings.Contains(string(msg), `"end"`) {
+				return got
+			}
+			got = append(got, string(msg))
+		}
+	}
+	broadcast := func() {
+		h.Broadcast(Event{Type: "file-changed", Path: "b.md", Change: ChangeModified})
+		h.Broadcast(Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+		h.Broadcast(Event{Type: "file-changed", Path: "c.md", Change: ChangeRenamed, From: "a.md"})
+		h.Broadcast(Event{Type: "tree-updated"})
+		h.Broadcast(Event{Type: "file-changed", Path: "end"})
+	}
+
+	send(`{"type":"subscribe","topics":["file:a.md","file:end"]}`, 2)
+	if !h.Subscribed(FileTopic("a.md")) || h.Subscribed(FileTopic("b.md")) || h.Subscribed(TopicTree) {
+		t.Fatalf("Subscribed should only report the topics clients asked for")
+	}
+	broadcast()
+	if got := read(all); len(got) != 4 {
+		t.Fatalf("unsubscribed client got %q, want every event", got)
+	}
+	want := []string{
+		`{"id":"e-2","type":"file-changed","path":"a.md","change":"modified"}`,
+		`{"id":"e-3","type":"file-changed","path":"c.md","change":"renamed","from":"a.md"}`,
+	}
+	if got := read(doc); !reflect.DeepEqual(got, want) {
+		t.Fatalf("subscribed client got %q, want %q", got, want)
+	}
+
+	send(`{"type":"subscribe","topics":["tree"]}`, 3)
+	send(`{"type":"unsubscribe","topics":["file:a.md"]}`, 2)
+	broadcast()
+	_ = read(all)
+	if got := read(doc); !reflect.DeepEqual(got, []string{`{"id":"e-9","type":"tree-updated"}`}) {
+		t.Fatalf("after resubscribing got %q, want the tree update", got)
+	}
+}
+
+func TestHub_SSE(t *testing.T) {
+	h := NewHubWithOptions(HubOptions{History: 3})
+	h.epoch = "e"
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", h.ServeSSE)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	// open connects and returns a function reading the next event's "id"
+	// and "data" lines.
+	open := func(query, lastID string) func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events"+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("GET /events: %v", err)
+		}
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+			t.Fatalf("Content-Type = %q", ct)
+		}
+		r := bufio.NewReader(resp.Body)
+		return func() string {
+			t.Helper()
+			var lines []string
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					t.Fatalf("read: %v", err)
+				}
+				line = strings.TrimSuffix(line, "\n")
+				if line == "" && len(lines) > 0 {
+					return strings.Join(lines, "|")
+				}
+				if line != "" && !strings.HasPrefix(line, ":") {
+					lines = append(lines, line)
+				}
+			}
+		}
+	}
+
+	next := open("?topic=tree", "")
+	waitFor(t, "client", func() bool { return h.Stats().Clients == 1 })
+	h.Broadcast(Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+	h.Broadcast(Event{Type: "tree-updated"})
+	if got, want := next(), `id: e-2|data: {"id":"e-2","type":"tree-updated"}`; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Resuming replays what was missed, in order.
+	h.Broadcast(Event{Type: "file-changed", Path: "b.md", Change: ChangeCreated})
+	next = open("", "e-1")
+	for _, want := range []string{
+		`id: e-2|data: {"id":"e-2","type":"tree-updated"}`,
+		`id: e-3|data: {"id":"e-3","type":"file-changed","path":"b.md","change":"created"}`,
+	} {
+		if got := next(); got != want {
+			t.Fatalf("got %q, want %q", got, want)
+		}
+	}
+
+	// Too far behind for the history, ahead of the hub, or from an earlier
+	// run of the server: resync.
+	h.Broadcast(Event{Type: "tree-updated"})
+	for _, last := range []string{"e-0", "e-9", "d-3", "3"} {
+		next = open("", last)
+		if got, want := next(), `id: e-4|data: {"id":"e-4","type":"resync"}`; got != want {
+			t.Fatalf("Last-Event-ID %s: got %q, want %q", last, got, want)
+		}
+	}
+}
+
+func TestHub_ResumeWebSocket(t *testing.T) {
+	h := NewHubWithOptions(HubOptions{History: 4})
+	h.epoch = "e"
+	url := serveHub(t, h)
+	for i := 0; i < 6; i++ {
+		h.Broadcast(Event{Type: "file-changed", Path: fmt.Sprintf("%d.md", i), Change: ChangeModified})
+	}
+	h.Broadcast(Event{Type: "tree-updated"})
+
+	read := func(c *websocket.Conn, n int) []string {
+		t.Helper()
+		var got []string
+		for len(got) < n {
+			_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+			_, msg, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			got = append(got, string(msg))
+		}
+		return got
+	}
+
+	// Events 5 to 7 are still kept; the topics filter the replay.
+	c := dial(t, url+"?since=e-4&topic=tree&topic=file:4.md")
+	want := []string{
+		`{"id":"e-5","type":"file-changed","path":"4.md","change":"modified"}`,
+		`{"id":"e-7","type":"tree-updated"}`,
+	}
+	if got := read(c, 2); !reflect.DeepEqual(got, want) {
+		t.Fatalf("resumed client got %q, want %q", got, want)
+	}
+	// Live events follow the replay.
+	h.Broadcast(Event{Type: "tree-updated"})
+	if got := read(c, 1); got[0] != `{"id":"e-8","type":"tree-updated"}` {
+		t.Fatalf("got %q after the replay", got)
+	}
+
+	// Event 3 fell out of the history.
+	c = dial(t, url+"?since=e-2")
+	if got := read(c, 1); got[0] != `{"id":"e-8","type":"resync"}` {
+		t.Fatalf("got %q, want a resync", got)
+	}
+	if st := h.Stats(); st.Replayed != 2 || st.Resyncs != 1 {
+		t.Fatalf("Stats() = %+v, want 2 replayed and 1 resync", st)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var h history
+	h.buf = make([]record, 3)
+	ids := func(rs []record) []uint64 {
+		var out []uint64
+		for _, r := range rs {
+			n, _ := strconv.ParseUint(r.msg.id, 10, 64)
+			out = append(out, n)
+		}
+		return out
+	}
+	for id := uint64(1); id <= 5; id++ {
+		h.add(record{msg: message{id: strconv.FormatUint(id, 10)}})
+	}
+	for _, tc := range []struct {
+		since uint64
+		want  []uint64
+		ok    bool
+	}{
+		{since: 5, want: nil, ok: true},
+		{since: 3, want: []uint64{4, 5}, ok: true},
+		{since: 2, want: []uint64{3, 4, 5}, ok: true},
+		{since: 1, ok: false},
+		{since: 6, ok: false},
+	} {
+		got, ok := h.since(tc.since, 5)
+		if ok != tc.ok || !reflect.DeepEqual(ids(got), tc.want) {
+			t.Errorf("since(%d) = %v, %v; want %v, %v", tc.since, ids(got), ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestHub_PresenterSession(t *testing.T) {
+	h := NewHub()
+	url := serveHub(t, h)
+	send := func(c *websocket.Conn, msg string) {
+		t.Helper()
+		if err := c.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	next := func(c *websocket.Conn) Event {
+		t.Helper()
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var ev Event
+		if err := c.ReadJSON(&ev); err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		return ev
+	}
+
+	presenter := dial(t, url)
+	send(presenter, `{"type":"present"}`)
+	ev := next(presenter)
+	if ev.Type != "session" || len(ev.Session) != 6 {
+		t.Fatalf("got %+v, want a session code", ev)
+	}
+	code := ev.Session
+
+	early := dial(t, url+"?topic="+SessionTopic(code))
+	waitFor(t, "follower", func() bool { return h.Stats().Clients == 2 })
+	send(presenter, `{"type":"position","path":"docs/a.md","anchor":"install","scroll":0.25}`)
+	want := Event{Type: "position", Session: code, Path: "docs/a.md", Anchor: "install", Scroll: 0.25}
+	if got := next(early); !reflect.DeepEqual(got, want) {
+		t.Fatalf("follower got %+v, want %+v", got, want)
+	}
+
+	// A late follower starts at the current position; others cannot drive.
+	late := dial(t, url)
+	send(late, `{"type":"position","path":"elsewhere.md"}`)
+	send(late, `{"type":"subscribe","topics":["`+SessionTopic(code)+`"]}`)
+	if got := next(late); !reflect.DeepEqual(got, want) {
+		t.Fatalf("late follower got %+v, want %+v", got, want)
+	}
+
+	// Detached followers miss positions until they rejoin.
+	send(late, `{"type":"unsubscribe","topics":["`+SessionTopic(code)+`"]}`)
+	waitFor(t, "detach", func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			if c.topics != nil && len(c.topics) == 0 {
+				return true
+			}
+		}
+		return false
+	})
+	send(presenter, `{"type":"position","path":"docs/b.md","scroll":1}`)
+	want = Event{Type: "position", Session: code, Path: "docs/b.md", Scroll: 1}
+	if got := next(early); !reflect.DeepEqual(got, want) {
+		t.Fatalf("follower got %+v, want %+v", got, want)
+	}
+	send(late, `{"type":"subscribe","topics":["`+SessionTopic(code)+`"]}`)
+	if got := next(late); !reflect.DeepEqual(got, want) {
+		t.Fatalf("rejoining follower got %+v, want %+v", got, want)
+	}
+
+	// The session ends with the presenter's connection.
+	_ = presenter.Close()
+	ended := Event{Type: "session-ended", Session: code}
+	for _, c := range []*websocket.Conn{early, late} {
+		if got := next(c); !reflect.DeepEqual(got, ended) {
+			t.Fatalf("got %+v, want %+v", got, ended)
+		}
+	}
+	late2 := dial(t, url+"?topic="+SessionTopic(code))
+	if got := next(late2); !reflect.DeepEqual(got, ended) {
+		t.Fatalf("joining an ended session got %+v, want %+v", got, ended)
+	}
+}
+
+func TestHub_Reveal(t *testing.T) {
+	h := NewHubWithOptions(HubOptions{RevealPath: func(p string) (string, bool) {
+		return p, !strings.HasPrefix(p, "private/")
+	}})
+	url := serveHub(t, h)
+	editor := dial(t, url)
+	viewer := dial(t, url+"?topic=file:other.md")
+	waitFor(t, "clients", func() bool { return h.Stats().Clients == 2 })
+
+	// Reveal events ignore subscriptions, and are not sent back to an
+	// editor revealing over its WebSocket. Its paths are checked like
+	// those passed to Reveal.
+	for _, msg := range []string{
+		`{"type":"reveal","path":"private/a.md","line":12}`,
+		`{"type":"reveal","path":"docs/a.md","line":12}`,
+	} {
+		if err := editor.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	want := Event{Type: "reveal", Path: "docs/a.md", Line: 12}
+	_ = viewer.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var got Event
+	if err := viewer.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v (%v), want %+v", got, err, want)
+	}
+
+	if _, _, ok := h.Reveal("docs/a.md", 0); ok {
+		t.Fatalf("revealed line 0")
+	}
+	if _, _, ok := h.Reveal("private/a.md", 1); ok {
+		t.Fatalf("revealed a rejected path")
+	}
+	if rel, n, ok := h.Reveal("docs/b.md", 3); !ok || rel != "docs/b.md" || n != 2 {
+		t.Fatalf("Reveal = %q, %d, %v; want docs/b.md reaching 2 clients", rel, n, ok)
+	}
+	want = Event{Type: "reveal", Path: "docs/b.md", Line: 3}
+	for _, c := range []*websocket.Conn{editor, viewer} {
+		_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		var got Event
+		if err := c.ReadJSON(&got); err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v (%v), want %+v", got, err, want)
+		}
+	}
+}
+
+func TestHub_RefusesOtherOrigins(t *testing.T) {
+	h := NewHub()
+	url := serveHub(t, h)
+	hdr := http.Header{"Origin": {"https://example.com"}}
+	if c, _, err := websocket.DefaultDialer.Dial(url, hdr); err == nil {
+		_ = c.Close()
+		t.Fatalf("connected from another origin")
+	}
+	hdr.Set("Origin", "http://"+strings.TrimPrefix(strings.TrimSuffix(url, "/ws"), "ws://"))
+	connect := func() error {
+		c, _, err := websocket.DefaultDialer.Dial(url, hdr)
+		if err == nil {
+			_ = c.Close()
+		}
+		return err
+	}
+	if err := connect(); err != nil {
+		t.Fatalf("same origin: %v", err)
+	}
+}
+
+func TestHub_PushIsNotKept(t *testing.T) {
+	h := NewHub()
+	h.epoch = "e"
+	url := serveHub(t, h)
+	doc := dial(t, url+"?topic=file:a.md")
+	waitFor(t, "client", func() bool { return h.Subscribed(FileTopic("a.md")) })
+
+	h.Broadcast(Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+	h.Push(FileTopic("a.md"), Event{Type: "rendered", Path: "a.md", Render: []byte(`{"html":"x"}`)})
+	want := []string{
+		`{"id":"e-1","type":"file-changed","path":"a.md","change":"modified"}`,
+		`{"type":"rendered","path":"a.md","render":{"html":"x"}}`,
+	}
+	var got []string
+	for range want {
+		_ = doc.SetReadDeadline(time.Now().Add(3 * time.Second))
+		_, data, err := doc.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		got = append(got, string(data))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// A resuming client is replayed the change, not the render.
+	late := dial(t, url+"?since=e-0&topic=file:a.md")
+	_ = late.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, data, err := late.ReadMessage(); err != nil || string(data) != want[0] {
+		t.Fatalf("replayed %q (%v), want %q", data, err, want[0])
+	}
+	if n := h.history.n; n != 1 {
+		t.Fatalf("history holds %d events, want 1", n)
+	}
+}
+
+func TestHub_Close(t *testing.T) {
+	h := NewHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", h.ServeWS)
+	mux.HandleFunc("/events", h.ServeSSE)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	ws := dial(t, "ws"+strings.TrimPrefix(srv.URL, "http")+"/ws")
+	resp, err := http.Get(srv.URL + "/events")
 	if err != nil {
-		t.Fatalf("read: %v", err)
+		t.Fatalf("GET /events: %v", err)
 	}
-	if !strings.Contains(string(msg), "file-changed") {
-		t.Fatalf("expected event type in message, got %s", string(msg))
+	defer func() { _ = resp.Body.Close() }()
+	waitFor(t, "clients", func() bool { return h.Stats().Clients == 2 })
+
+	h.Close()
+	// Both streams end without waiting for their requests.
+	ended := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(io.Discard, resp.Body)
+		ended <- err
+	}()
+	select {
+	case err := <-ended:
+		if err != nil {
+			t.Fatalf("SSE stream ended with %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("SSE stream still open after Close")
+	}
+	_ = ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if _, _, err := ws.ReadMessage(); err == nil {
+		t.Fatalf("WebSocket still open after Close")
+	} else if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		t.Fatalf("WebSocket still open after Close")
+	}
+
+	if resp, err := http.Get(srv.URL + "/events"); err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("new stream after Close: %v, %v", resp, err)
+	} else {
+		_ = resp.Body.Close()
 	}
 }
@@ -0,0 +1,110 @@
+package watch
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"repobook/internal/scan"
+)
+
+// Status describes how the watcher notices changes, for display.
+type Status struct {
+	Mode string `json:"mode"`
+	// Limited is set when the system ran out of watches and only the
+	// directories leading to markdown files are watched.
+	Limited bool `json:"limited,omitempty"`
+	// Warning explains the last fallback, if any.
+	Warning string `json:"warning,omitempty"`
+}
+
+// Status returns the current watch mode and any fallback warning.
+func (w *Watcher) Status() Status {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return Status{Mode: w.mode, Limited: w.limited, Warning: w.warning}
+}
+
+// errWatchLimit is returned by add when the system has no watches left
+// (ENOSPC from inotify: fs.inotify.max_user_watches is exhausted).
+var errWatchLimit = errors.New("file watch limit reached")
+
+// maxWatches, if positive, caps the number of watches, so tests can run
+// into the limit.
+var maxWatches int
+
+// add watches dir with fsnotify. w.mu must be held and w.w set.
+func (w *Watcher) add(dir string) error {
+	if maxWatches > 0 && len(w.watched)+len(w.extra) >= maxWatches {
+		return errWatchLimit
+	}
+	err := w.w.Add(dir)
+	if errors.Is(err, syscall.ENOSPC) {
+		return errWatchLimit
+	}
+	return err
+}
+
+// sync runs syncWatches, backing off when the system runs out of watches:
+// first to watching only the directories that lead to markdown files, then
+// to polling.
+func (w *Watcher) sync() error {
+	err := w.syncWatches()
+	if !errors.Is(err, errWatchLimit) {
+		return err
+	}
+	w.mu.Lock()
+	limited := w.limited
+	w.limited = true
+	w.mu.Unlock()
+	if !limited {
+		w.warn("file watch limit reached (see fs.inotify.max_user_watches); watching only directories with markdown files")
+		if err = w.syncWatches(); !errors.Is(err, errWatchLimit) {
+			return err
+		}
+	}
+	w.fallBackToPoll("file watch limit reached (see fs.inotify.max_user_watches)")
+	return nil
+}
+
+// markdownDirs returns the directories of the book tree, as absolute paths:
+// those holding a reported file directly or below them, and the root.
+func (w *Watcher) markdownDirs() (map[string]struct{}, error) {
+	root, err := scan.BuildTree(scan.Options{
+		RootAbs:  w.rootAbs,
+		Ignore:   w.ignore.Matcher(),
+		AllFiles: w.allFiles.Load(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	dirs := map[string]struct{}{w.rootAbs: {}}
+	var visit func(n scan.Node)
+	visit = func(n scan.Node) {
+		for _, c := range n.Children {
+			if c.Type == "dir" {
+				dirs[filepath.Join(w.rootAbs, filepath.FromSlash(c.Path))] = struct{}{}
+				visit(c)
+			}
+		}
+	}
+	visit(root)
+	return dirs, nil
+}
+
+// fallBackToPoll stops fsnotify and polls instead, explaining why.
+func (w *Watcher) fallBackToPoll(reason string) {
+	w.switchToPoll()
+	w.warn(fmt.Sprintf("%s; polling for changes every %s", reason, w.interval))
+}
+
+// warn records msg for Status and passes it to WatcherOptions.Warn.
+func (w *Watcher) warn(msg string) {
+	w.mu.Lock()
+	w.warning = msg
+	w.mu.Unlock()
+	if w.onWarn != nil {
+		w.onWarn(msg)
+	}
+}
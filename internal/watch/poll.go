@@ -0,0 +1,222 @@
+package watch
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// fileStat is what polling compares between two scans of a path.
+type fileStat struct {
+	size  int64
+	mtime int64 // UnixNano
+	dir   bool
+}
+
+func statOf(info fs.FileInfo) fileStat {
+	return fileStat{size: info.Size(), mtime: info.ModTime().UnixNano()}
+}
+
+// snapshot scans the paths polling cares about: the non-ignored directories
+// of the tree, the reported files and ordering files in them, and the ignore
+// files both inside and outside the tree. Paths inside the tree are keyed by
+// rel path, ignore files outside it by absolute path.
+func (w *Watcher) snapshot() (tree, outside map[string]fileStat) {
+	m := w.ignore.Matcher()
+	tree = make(map[string]fileStat)
+	_ = filepath.WalkDir(w.rootAbs, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Vanished or unreadable: it shows up in the next scan, if any.
+			return nil
+		}
+		rel := w.rel(p)
+		if rel == "" {
+			return nil
+		}
+		if d.IsDir() {
+			if m.IsIgnored(rel, true) {
+				return fs.SkipDir
+			}
+			tree[rel] = fileStat{dir: true}
+			return nil
+		}
+		name := d.Name()
+		keep := name == ".order" || name == ".pages" ||
+			(w.ignore != nil && w.ignore.IsIgnoreFile(p)) ||
+			(w.reports(name) && !m.IsIgnored(rel, false))
+		if !keep {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		tree[rel] = statOf(info)
+		return nil
+	})
+
+	outside = make(map[string]fileStat)
+	for _, src := range m.Sources() {
+		if info, err := os.Stat(src); err == nil {
+			outside[src] = statOf(info)
+		}
+	}
+	return tree, outside
+}
+
+// diff compares two scans and returns the fsnotify events that would have
+// described the difference, so polling reuses handle and flush as is.
+// Files inside a new directory get no events of their own, as with a
+// directory moved in under fsnotify. A file that disappeared while another
+// with the same size and mtime appeared is reported as renamed away.
+func (w *Watcher) diff(tree, outside map[string]fileStat) []fsnotify.Event {
+	abs := func(rel string) string {
+		return filepath.Join(w.rootAbs, filepath.FromSlash(rel))
+	}
+	var added, changed, removed []string
+	for rel, st := range tree {
+		old, ok := w.snap[rel]
+		switch {
+		case !ok:
+			added = append(added, rel)
+		case old.dir != st.dir:
+			removed = append(removed, rel)
+			added = append(added, rel)
+		case old != st:
+			changed = append(changed, rel)
+		}
+	}
+	for rel := range w.snap {
+		if _, ok := tree[rel]; !ok {
+			removed = append(removed, rel)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(changed)
+	sort.Strings(removed)
+
+	var evs []fsnotify.Event
+	var newDirs []string
+	appeared := make(map[fileStat]int)
+	for _, rel := range added {
+		if under(rel, newDirs) {
+			continue
+		}
+		st := tree[rel]
+		if st.dir {
+			newDirs = append(newDirs, rel)
+		} else {
+			appeared[st]++
+		}
+	}
+	for _, rel := range removed {
+		op := fsnotify.Remove
+		if st := w.snap[rel]; !st.dir && appeared[st] > 0 {
+			appeared[st]--
+			op = fsnotify.Rename
+		}
+		evs = append(evs, fsnotify.Event{Name: abs(rel), Op: op})
+	}
+	for _, rel := range added {
+		if !under(rel, newDirs) {
+			evs = append(evs, fsnotify.Event{Name: abs(rel), Op: fsnotify.Create})
+		}
+	}
+	for _, rel := range changed {
+		evs = append(evs, fsnotify.Event{Name: abs(rel), Op: fsnotify.Write})
+	}
+
+	// Ignore files outside the tree: any difference reloads the rules.
+	for p, st := range outside {
+		if old, ok := w.ignoreSnap[p]; !ok || old != st {
+			return append(evs, fsnotify.Event{Name: p, Op: fsnotify.Write})
+		}
+	}
+	for p := range w.ignoreSnap {
+		if _, ok := outside[p]; !ok {
+			return append(evs, fsnotify.Event{Name: p, Op: fsnotify.Remove})
+		}
+	}
+	return evs
+}
+
+// under reports whether rel lies inside one of dirs.
+func under(rel string, dirs []string) bool {
+	for _, d := range dirs {
+		if strings.HasPrefix(rel, d+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// poll scans the tree and records what changed since the previous scan. It
+// reports whether polling should go on.
+//
+// In ModeAuto, polling runs alongside fsnotify until one of them proves the
+// point: any fsnotify event means fsnotify works and polling stops, while
+// changes seen by two scans in a row with no fsnotify event in between mean
+// it does not, and the watcher switches to polling for good. The second scan
+// gives fsnotify one poll interval to catch up. A tree that stays quiet for
+// autoProbe is trusted to fsnotify, so it is not scanned forever.
+func (w *Watcher) poll(now time.Time) bool {
+	if w.Mode() == ModeAuto && (w.sawEvent || !w.suspect && now.After(w.probeUntil)) {
+		w.setMode(ModeNotify)
+		w.snap, w.ignoreSnap = nil, nil
+		return false
+	}
+	tree, outside := w.snapshot()
+	evs := w.diff(tree, outside)
+	if len(evs) == 0 {
+		w.snap, w.ignoreSnap = tree, outside
+		w.suspect = false
+		return true
+	}
+	if w.Mode() == ModeAuto {
+		if !w.suspect {
+			// Keep the previous scan, so the next one sees these changes
+			// again if fsnotify misses them.
+			w.suspect = true
+			return true
+		}
+		w.fallBackToPoll("no file system notifications arrived for changes found by polling")
+	}
+	w.snap, w.ignoreSnap = tree, outside
+	for _, ev := range evs {
+		w.handle(ev, now)
+	}
+	return true
+}
+
+// autoProbe bounds how long ModeAuto polls alongside fsnotify without
+// evidence either way; a variable so tests can shorten it.
+var autoProbe = 2 * time.Minute
+
+// scanned is a snapshot of the tree and of the ignore files outside it.
+type scanned struct {
+	tree, outside map[string]fileStat
+}
+
+// switchToPoll stops fsnotify and has the loop poll instead. The tree is
+// scanned before fsnotify stops, so no change falls in between.
+func (w *Watcher) switchToPoll() {
+	tree, outside := w.snapshot()
+	w.mu.Lock()
+	fw := w.w
+	w.w = nil
+	w.mode = ModePoll
+	w.extra = make(map[string]struct{})
+	w.mu.Unlock()
+	if fw != nil {
+		_ = fw.Close()
+	}
+	select {
+	case w.pollStart <- scanned{tree, outside}:
+	default:
+	}
+}
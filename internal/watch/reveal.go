@@ -0,0 +1,55 @@
+package watch
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Reveal asks the viewers to show the block at line (1-based) of the
+// document at path, so an editor plugin can drive the preview from its
+// cursor. Editors call it through the server's /api/reveal endpoint, or
+// send
+//
+//	{"type": "reveal", "path": "docs/a.md", "line": 42}
+//
+// over their WebSocket. Both are checked the same way, by
+// HubOptions.RevealPath. Every client is sent a "reveal" event, whatever it
+// subscribed to; like session events, it is not numbered or kept in the
+// history, since only the latest one matters. Reveal returns the path sent
+// and how many clients it was queued for; ok is false if the request was
+// rejected.
+func (h *Hub) Reveal(path string, line int) (rel string, n int, ok bool) {
+	rel, ok = h.revealTarget(path, line)
+	if !ok {
+		return "", 0, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return rel, h.reveal(nil, rel, line), true
+}
+
+// revealTarget checks a reveal request and returns the path to send.
+func (h *Hub) revealTarget(path string, line int) (string, bool) {
+	if line < 1 {
+		return "", false
+	}
+	if h.revealPath != nil {
+		return h.revealPath(path)
+	}
+	path = strings.TrimPrefix(path, "/")
+	return path, path != ""
+}
+
+// reveal sends a "reveal" event to every client but from. h.mu must be
+// held.
+func (h *Hub) reveal(from *client, path string, line int) int {
+	data, _ := json.Marshal(Event{Type: "reveal", Path: path, Line: line})
+	n := 0
+	for c := range h.clients {
+		if c != from {
+			trySend(c, data)
+			n++
+		}
+	}
+	return n
+}
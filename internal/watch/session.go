@@ -0,0 +1,142 @@
+package watch
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+)
+
+// Presenter sessions let one client drive and others follow along. Over its
+// WebSocket, a presenter sends
+//
+//	{"type": "present"}
+//
+// and is answered with a "session" event carrying the session code. It then
+// sends its position whenever it changes:
+//
+//	{"type": "position", "path": "docs/a.md", "anchor": "install", "scroll": 0.4}
+//
+// and {"type": "stop"} when done. Followers join by subscribing to
+// SessionTopic(code), over /ws or /events, and detach by unsubscribing. They
+// receive "position" events, starting with the presenter's current one,
+// and "session-ended" when the presenter stops or disconnects.
+//
+// Session events are not numbered or kept in the history: only the latest
+// position matters, and a rejoining follower is sent it again.
+
+// SessionTopic returns the topic followers of the session with code
+// subscribe to.
+func SessionTopic(code string) string {
+	return sessionPrefix + code
+}
+
+const sessionPrefix = "session:"
+
+// sessionAlphabet leaves out letters and digits that are easily confused
+// when a code is read out.
+const sessionAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+type session struct {
+	presenter *client
+	last      []byte // the latest position event
+}
+
+// present starts a session with c as the presenter, or finds the one it
+// already has, and sends c the code. h.mu must be held.
+func (h *Hub) present(c *client) {
+	if c.session == "" {
+		code := newSessionCode()
+		for h.sessions[code] != nil {
+			code = newSessionCode()
+		}
+		h.sessions[code] = &session{presenter: c}
+		c.session = code
+	}
+	sendNow(c, Event{Type: "session", Session: c.session})
+}
+
+// position relays the presenter's position to the followers. h.mu must be
+// held.
+func (h *Hub) position(c *client, msg clientMessage) {
+	s := h.sessions[c.session]
+	if s == nil || s.presenter != c {
+		return
+	}
+	ev := Event{Type: "position", Session: c.session, Path: msg.Path, Anchor: msg.Anchor, Scroll: min(max(msg.Scroll, 0), 1)}
+	s.last, _ = json.Marshal(ev)
+	h.publish(SessionTopic(c.session), s.last)
+}
+
+// endSession tells the followers of c's session that it ended. h.mu must
+// be held.
+func (h *Hub) endSession(c *client) {
+	if c.session == "" {
+		return
+	}
+	delete(h.sessions, c.session)
+	data, _ := json.Marshal(Event{Type: "session-ended", Session: c.session})
+	h.publish(SessionTopic(c.session), data)
+	c.session = ""
+}
+
+// joined sends a client that just subscribed to topic what it needs to
+// catch up: for a session, the presenter's position, or "session-ended"
+// if there is no such session. h.mu must be held.
+func (h *Hub) joined(c *client, topic string) {
+	code, ok := strings.CutPrefix(topic, sessionPrefix)
+	if !ok {
+		return
+	}
+	s := h.sessions[code]
+	switch {
+	case s == nil:
+		sendNow(c, Event{Type: "session-ended", Session: code})
+	case s.last != nil:
+		trySend(c, s.last)
+	}
+}
+
+// publish sends data to the clients subscribed to topic by name, skipping
+// any whose queue is full. h.mu must be held.
+func (h *Hub) publish(topic string, data []byte) {
+	for c := range h.clients {
+		if _, ok := c.topics[topic]; ok {
+			trySend(c, data)
+		}
+	}
+}
+
+func sendNow(c *client, ev Event) {
+	data, _ := json.Marshal(ev)
+	trySend(c, data)
+}
+
+// trySend queues an unnumbered event for c unless its queue is full; such
+// events are superseded by the next one anyway.
+func trySend(c *client, data []byte) {
+	select {
+	case c.send <- message{data: data}:
+	default:
+	}
+}
+
+// newSessionCode draws six characters uniformly from sessionAlphabet,
+// dropping random bytes past the largest multiple of its length so that
+// the modulo does not favor the first letters.
+func newSessionCode() string {
+	const n = len(sessionAlphabet)
+	code := make([]byte, 0, 6)
+	buf := make([]byte, 16)
+	for len(code) < cap(code) {
+		_, _ = rand.Read(buf)
+		for _, b := range buf {
+			if int(b) >= 256/n*n {
+				continue
+			}
+			if code = append(code, sessionAlphabet[int(b)%n]); len(code) == cap(code) {
+				break
+			}
+		}
+	}
+	return string(code)
+}
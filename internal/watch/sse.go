@@ -0,0 +1,94 @@
+package watch
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"repobook/internal/util"
+)
+
+// ServeSSE streams events as Server-Sent Events, for browsers behind proxies
+// that do not pass WebSocket upgrades. SSE is one-way, so the topics are
+// given up front as repeated "topic" query parameters; without any, every
+// event is sent. Each event carries its ID, and a client that
+// reconnects with Last-Event-ID (the header EventSource sends, or the
+// "lastEventId" query parameter) is first sent the events it missed, or a
+// "resync" event if they are no longer all kept.
+func (h *Hub) ServeSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !util.SameOrigin(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last == "" {
+		last = r.URL.Query().Get("lastEventId")
+	}
+	since, resume, err := parseSince(last)
+	if err != nil {
+		http.Error(w, "bad Last-Event-ID", http.StatusBadRequest)
+		return
+	}
+
+	c := h.newClient(nil, topicParams(r))
+	if !h.add(c, since, resume) {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.remove(c)
+
+	rc := http.NewResponseController(w)
+	// The stream outlives the server's read timeout, which would otherwise
+	// cancel the request.
+	_ = rc.SetReadDeadline(time.Time{})
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	// Ask nginx-style proxies not to buffer the stream.
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ping := time.NewTicker(h.pingInterval)
+	defer ping.Stop()
+	for {
+		var chunk string
+		select {
+		case <-r.Context().Done():
+			return
+		case <-c.done:
+			return
+		case msg := <-c.send:
+			// Unnumbered events leave the browser's Last-Event-ID alone.
+			chunk = fmt.Sprintf("data: %s\n\n", msg.data)
+			if msg.id != "" {
+				chunk = fmt.Sprintf("id: %s\n%s", msg.id, chunk)
+			}
+		case <-ping.C:
+			// A comment keeps proxies from timing out the idle stream.
+			chunk = ": ping\n\n"
+		}
+		_ = rc.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		if _, err := fmt.Fprint(w, chunk); err != nil {
+			h.writeFailed(c, err)
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			h.writeFailed(c, err)
+			return
+		}
+		if chunk[0] != ':' {
+			h.sent.Add(1)
+		}
+	}
+}
@@ -1,138 +1,705 @@
 package watch
 
 import (
+	"errors"
+	"fmt"
 	"io/fs"
+	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 
+	"repobook/internal/frontmatter"
 	"repobook/internal/ignore"
 	"repobook/internal/util"
 )
 
+type WatcherOptions struct {
+	RootAbs string
+	Hub     *Hub
+	// Ignore is reloaded by the watcher whenever an ignore file changes.
+	Ignore *ignore.Live
+
+	// AllFiles reports changes to every file rather than only markdown,
+	// matching a tree built with scan.Options.AllFiles. ReportAllFiles
+	// turns it on later.
+	AllFiles bool
+
+	// Debounce is how long a path must be quiet before its changes are
+	// reported; 0 means DefaultDebounce. A path that keeps changing is
+	// reported after at most ten times as long.
+	Debounce time.Duration
+
+	// Mode selects how changes are noticed: ModeNotify, ModePoll or, by
+	// default, ModeAuto.
+	Mode string
+	// PollInterval is how often ModePoll scans the tree; 0 means
+	// DefaultPollInterval.
+	PollInterval time.Duration
+
+	// Warn, if set, is called when the watcher falls back to a less precise
+	// mode: when the system runs out of file watches, or when fsnotify
+	// turns out not to deliver events. Status reports the same.
+	Warn func(msg string)
+}
+
+// Watch modes. fsnotify does not see changes made on network file systems
+// (NFS, SMB) or, often, through Docker bind mounts; polling compares the
+// size and modification time of every watched path at an interval instead.
+// ModeAuto uses fsnotify, and switches to polling if it turns out to miss
+// changes.
+const (
+	ModeAuto   = "auto"
+	ModeNotify = "fsnotify"
+	ModePoll   = "poll"
+)
+
+// DefaultPollInterval keeps the cost of scanning a large tree low while
+// still feeling live.
+const DefaultPollInterval = 2 * time.Second
+
+// DefaultDebounce is long enough to cover the burst of events of an editor
+// saving through a temporary file and a rename.
+const DefaultDebounce = 100 * time.Millisecond
+
+// Changes reported in Event.Change for "file-changed" events.
+const (
+	ChangeCreated  = "created"
+	ChangeModified = "modified"
+	ChangeDeleted  = "deleted"
+	ChangeRenamed  = "renamed"
+)
+
 type Watcher struct {
-	rootAbs string
-	ignore  *ignore.Matcher
-	hub     *Hub
-	w       *fsnotify.Watcher
-	done    chan struct{}
+	rootAbs  string
+	ignore   *ignore.Live
+	hub      *Hub
+	allFiles atomic.Bool
+	debounce time.Duration
+	interval time.Duration
+	onWarn   func(string)
+	done     chan struct{}
+	// pollStart tells the loop to start polling after a fallback.
+	pollStart chan scanned
+	// allStart tells the loop to start reporting all files.
+	allStart chan struct{}
+
+	mu      sync.Mutex
+	w       *fsnotify.Watcher // nil when polling
+	mode    string
+	limited bool // watching only the directories of the book tree
+	warning string
+	watched map[string]struct{}  // directories inside the root
+	extra   map[string]struct{}  // directories holding ignore files outside the tree
+	files   map[string]knownFile // reported files known to exist, by rel path
+
+	// Owned by the loop goroutine.
+	pending    map[string]*pendingChange // by rel path
+	snap       map[string]fileStat       // the last poll scan of the tree
+	ignoreSnap map[string]fileStat       // and of the ignore files outside it
+	sawEvent   bool                      // fsnotify has delivered an event
+	suspect    bool                      // ModeAuto: a poll saw changes fsnotify did not
+	probeUntil time.Time                 // ModeAuto: when to stop polling alongside fsnotify
 }
 
-func NewWatcher(rootAbs string, hub *Hub, ig *ignore.Matcher) (*Watcher, error) {
-	w, err := fsnotify.NewWatcher()
-	if err != nil {
-		return nil, err
+// knownFile is what flush compares a reported file against.
+type knownFile struct {
+	weight string   // front matter weight, which orders it in the tree
+	stat   fileStat // to recognize it under a new name
+}
+
+// pendingChange accumulates the raw events of one path until it is quiet.
+type pendingChange struct {
+	first, ops  fsnotify.Op
+	since, last time.Time
+	treeOnly    bool // a directory or ordering file: only the tree changes
+}
+
+func NewWatcher(opts WatcherOptions) (*Watcher, error) {
+	mode := opts.Mode
+	switch mode {
+	case "":
+		mode = ModeAuto
+	case ModeAuto, ModeNotify, ModePoll:
+	default:
+		return nil, fmt.Errorf("unknown watch mode %q (want %s, %s or %s)", mode, ModeAuto, ModeNotify, ModePoll)
+	}
+	var w *fsnotify.Watcher
+	if mode != ModePoll {
+		var err error
+		if w, err = fsnotify.NewWatcher(); err != nil {
+			return nil, err
+		}
 	}
 
-	ww := &Watcher{rootAbs: rootAbs, ignore: ig, hub: hub, w: w, done: make(chan struct{})}
+	debounce := opts.Debounce
+	if debounce <= 0 {
+		debounce = DefaultDebounce
+	}
+	interval := opts.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	ww := &Watcher{
+		rootAbs:   opts.RootAbs,
+		ignore:    opts.Ignore,
+		hub:       opts.Hub,
+		debounce:  debounce,
+		interval:  interval,
+		w:         w,
+		mode:      mode,
+		onWarn:    opts.Warn,
+		done:      make(chan struct{}),
+		pollStart: make(chan scanned, 1),
+		allStart:  make(chan struct{}, 1),
+		watched:   make(map[string]struct{}),
+		extra:     make(map[string]struct{}),
+		files:     make(map[string]knownFile),
+		pending:   make(map[string]*pendingChange),
+	}
+
+	ww.allFiles.Store(opts.AllFiles)
+	if mode != ModeNotify {
+		ww.snap, ww.ignoreSnap = ww.snapshot()
+	}
+	if mode == ModeAuto {
+		ww.probeUntil = time.Now().Add(autoProbe)
+	}
 
 	// Start the event loop before adding watches to prevent deadlock on Windows
 	// where fsnotify may send events synchronously during Add()
-	go ww.loop()
+	go ww.loop(mode != ModeNotify)
 
 	// Watch all directories initially (fsnotify is not recursive).
-	err = filepath.WalkDir(rootAbs, func(p string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
+	if err := ww.sync(); err != nil {
+		_ = ww.Close()
+		return nil, err
+	}
+	ww.watchIgnoreSources()
+
+	return ww, nil
+}
+
+func (w *Watcher) Close() error {
+	close(w.done)
+	w.mu.Lock()
+	fw := w.w
+	w.w = nil
+	w.mu.Unlock()
+	if fw == nil {
+		return nil
+	}
+	return fw.Close()
+}
+
+// Mode returns how changes are being noticed: ModeNotify or ModePoll, or
+// ModeAuto while it is not yet known whether fsnotify works.
+func (w *Watcher) Mode() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.mode
+}
+
+func (w *Watcher) setMode(mode string) {
+	w.mu.Lock()
+	w.mode = mode
+	w.mu.Unlock()
+}
+
+// syncWatches makes the set of watched directories match the non-ignored
+// directories of the tree: new ones are added, newly ignored ones removed.
+// It also records which reported files exist, to tell created files from
+// replaced ones. When polling, the set only tracks which directories exist.
+// When limited, only the directories of the book tree are watched.
+func (w *Watcher) syncWatches() error {
+	want, files, err := w.walk(w.rootAbs)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	limited := w.limited
+	w.mu.Unlock()
+	if limited {
+		if want, err = w.markdownDirs(); err != nil {
+			return err
 		}
-		if d.IsDir() {
-			name := d.Name()
-			if name == ".git" || name == "node_modules" || name == "vendor" {
-				return fs.SkipDir
-			}
+	}
 
-			relOS, err := filepath.Rel(rootAbs, p)
-			if err != nil {
-				return nil
-			}
-			rel := filepath.ToSlash(relOS)
-			if rel == "." {
-				rel = ""
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files = files
+	// Remove first, to make room for the new watches.
+	for p := range w.watched {
+		if _, ok := want[p]; !ok {
+			if w.w != nil {
+				_ = w.w.Remove(p)
 			}
-			if ww.ignore != nil && rel != "" && ww.ignore.IsIgnored(rel, true) {
-				return fs.SkipDir
+			delete(w.watched, p)
+		}
+	}
+	for p := range want {
+		if _, ok := w.watched[p]; ok {
+			continue
+		}
+		if w.w != nil {
+			if err := w.add(p); err != nil {
+				return err
 			}
+		}
+		w.watched[p] = struct{}{}
+	}
+	return nil
+}
 
-			return w.Add(p)
+// walk returns the non-ignored directories under dir (absolute paths, dir
+// included) and the reported files in them (rel paths).
+func (w *Watcher) walk(dir string) (map[string]struct{}, map[string]knownFile, error) {
+	m := w.ignore.Matcher()
+	dirs := make(map[string]struct{})
+	files := make(map[string]knownFile)
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		rel := w.rel(p)
+		if !d.IsDir() {
+			if w.reports(d.Name()) && !m.IsIgnored(rel, false) {
+				if info, err := d.Info(); err == nil {
+					files[rel] = knownFile{weight: weight(p), stat: statOf(info)}
+				}
+			}
+			return nil
+		}
+		if rel != "" && m.IsIgnored(rel, true) {
+			return fs.SkipDir
 		}
+		dirs[p] = struct{}{}
 		return nil
 	})
+	return dirs, files, err
+}
+
+// weight returns the front matter weight of the file at abs, which orders
+// it in the tree, or "" if it has none or is not markdown.
+func weight(abs string) string {
+	if !util.IsMarkdownFileName(abs) {
+		return ""
+	}
+	meta, err := frontmatter.ReadFile(abs)
 	if err != nil {
-		_ = w.Close()
-		return nil, err
+		return ""
+	}
+	if n, ok := meta.Int("weight"); ok {
+		return strconv.Itoa(n)
 	}
+	return ""
+}
 
-	return ww, nil
+// reports tells whether changes to a file named name are reported as
+// "file-changed" events.
+func (w *Watcher) reports(name string) bool {
+	return w.allFiles.Load() || util.IsMarkdownFileName(name)
 }
 
-func (w *Watcher) Close() error {
-	close(w.done)
-	return w.w.Close()
+// ReportAllFiles makes the watcher report changes to every file from now
+// on, for clients that asked for a tree with all files.
+func (w *Watcher) ReportAllFiles() {
+	if w.allFiles.Swap(true) {
+		return
+	}
+	select {
+	case w.allStart <- struct{}{}:
+	default:
+	}
+}
+
+// watchIgnoreSources watches the directories of ignore files that live
+// outside the watched tree (global excludes, .git/info/exclude, parents of
+// the root), so edits to them are noticed too. For a directory that does
+// not exist yet, its nearest existing parent is watched until it appears.
+func (w *Watcher) watchIgnoreSources() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.w == nil {
+		// Polling scans the ignore files directly.
+		return
+	}
+	for _, src := range w.ignore.Matcher().Sources() {
+		dir := nearestDir(filepath.Dir(src))
+		if dir == "" {
+			continue
+		}
+		if _, ok := w.watched[dir]; ok {
+			continue
+		}
+		if _, ok := w.extra[dir]; ok {
+			continue
+		}
+		if err := w.add(dir); err == nil {
+			w.extra[dir] = struct{}{}
+		}
+	}
 }
 
-func (w *Watcher) loop() {
+// nearestDir returns dir, or its closest parent, that exists, or "" if
+// none does.
+func nearestDir(dir string) string {
+	for {
+		if st, err := util.Stat(dir); err == nil && st.IsDir() {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// awaitsIgnoreSource reports whether the directory at abs leads to the
+// directory of an ignore file outside the watched tree that is not watched
+// yet, because it did not exist.
+func (w *Watcher) awaitsIgnoreSource(abs string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, src := range w.ignore.Matcher().Sources() {
+		dir := filepath.Dir(src)
+		if dir != abs && !strings.HasPrefix(dir, abs+string(filepath.Separator)) {
+			continue
+		}
+		_, watched := w.watched[dir]
+		_, extra := w.extra[dir]
+		if !watched && !extra {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadIgnore swaps in fresh ignore rules and updates the watch set to
+// match, then schedules a "tree-updated" event so clients refetch the tree.
+func (w *Watcher) reloadIgnore() {
+	if err := w.ignore.Reload(); err != nil {
+		// Keep the previous rules; a half-written file will be retried on
+		// its next write.
+		return
+	}
+	_ = w.sync()
+	w.watchIgnoreSources()
+	// The root itself never has events of its own, so it stands for the
+	// ignore rules.
+	w.record("", fsnotify.Write, time.Now(), true)
+}
+
+// loop handles fsnotify events, debouncing and, if poll is set or after a
+// fallback, polling.
+func (w *Watcher) loop(poll bool) {
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	armed := false
+	arm := func() {
+		if !armed && len(w.pending) > 0 {
+			timer.Reset(w.debounce)
+			armed = true
+		}
+	}
+
+	var events <-chan fsnotify.Event
+	var errs <-chan error
+	w.mu.Lock()
+	if w.w != nil {
+		events, errs = w.w.Events, w.w.Errors
+	}
+	w.mu.Unlock()
+	var ticker *time.Ticker
+	var ticks <-chan time.Time
+	startPolling := func() {
+		if ticker == nil {
+			ticker = time.NewTicker(w.interval)
+			ticks = ticker.C
+		}
+	}
+	if poll {
+		startPolling()
+	}
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+
 	for {
 		select {
 		case <-w.done:
+			timer.Stop()
 			return
-		case ev, ok := <-w.w.Events:
+		case ev, ok := <-events:
 			if !ok {
-				return
+				// Closed by Close, or by switchToPoll.
+				events, errs = nil, nil
+				continue
+			}
+			w.sawEvent = true
+			w.handle(ev, time.Now())
+			arm()
+		case <-w.allStart:
+			// Files that were not reported so far are known from now on,
+			// without events of their own.
+			_ = w.sync()
+			if ticker != nil {
+				w.snap, w.ignoreSnap = w.snapshot()
+			}
+		case s := <-w.pollStart:
+			if ticker == nil {
+				w.snap, w.ignoreSnap = s.tree, s.outside
+				startPolling()
+			}
+		case now := <-ticks:
+			if !w.poll(now) {
+				ticker.Stop()
+				ticker, ticks = nil, nil
+			}
+			arm()
+		case now := <-timer.C:
+			armed = false
+			if next := w.flush(now); next > 0 {
+				timer.Reset(next)
+				armed = true
+			}
+		case _, ok := <-errs:
+			// Errors are ignored.
+			if !ok {
+				errs = nil
 			}
-			w.handle(ev)
-		case <-w.w.Errors:
-			// ignore
 		}
 	}
 }
 
-func (w *Watcher) handle(ev fsnotify.Event) {
-	// If a new directory appears, start watching it.
-	if ev.Op&fsnotify.Create != 0 {
-		if st, err := util.Stat(ev.Name); err == nil && st.IsDir() {
-			relOS, err := filepath.Rel(w.rootAbs, ev.Name)
-			if err == nil {
-				rel := filepath.ToSlash(relOS)
-				if rel == "." {
-					rel = ""
-				}
-				if w.ignore != nil && rel != "" && w.ignore.IsIgnored(rel, true) {
-					return
-				}
-			}
-			_ = w.w.Add(ev.Name)
-			w.hub.Broadcast(Event{Type: "tree-updated"})
-			return
-		}
+// handle records a raw fsnotify event. Events are reported by flush once
+// their path has been quiet for the debounce window.
+func (w *Watcher) handle(ev fsnotify.Event, now time.Time) {
+	if w.ignore != nil && w.ignore.IsIgnoreFile(ev.Name) {
+		w.reloadIgnore()
+		return
+	}
+	if w.ignore != nil && ev.Op&fsnotify.Create != 0 && w.awaitsIgnoreSource(ev.Name) {
+		// Watch the new directory before reading the rules, so an ignore
+		// file written into it meanwhile is not missed.
+		w.watchIgnoreSources()
+		w.reloadIgnore()
 	}
 
 	relOS, err := filepath.Rel(w.rootAbs, ev.Name)
-	if err != nil {
+	if err != nil || relOS == ".." || strings.HasPrefix(relOS, ".."+string(filepath.Separator)) {
+		// Events from directories watched only for ignore files.
 		return
 	}
 	rel := filepath.ToSlash(relOS)
 	if rel == "." {
-		rel = ""
+		return
 	}
-	if w.ignore != nil && rel != "" {
-		if st, err := util.Stat(ev.Name); err == nil {
-			if w.ignore.IsIgnored(rel, st.IsDir()) {
-				return
+	m := w.ignore.Matcher()
+	st, statErr := util.Stat(ev.Name)
+	isDir := statErr == nil && st.IsDir()
+	if m.IsIgnored(rel, isDir) {
+		return
+	}
+
+	// A new directory is watched right away so changes inside it are not
+	// missed; files already in it (moved in, or created meanwhile) become
+	// known without events of their own.
+	if ev.Op&fsnotify.Create != 0 && isDir {
+		if dirs, files, err := w.walk(ev.Name); err == nil {
+			full := false
+			w.mu.Lock()
+			for p := range dirs {
+				if _, ok := w.watched[p]; !ok {
+					if w.w != nil {
+						if err := w.add(p); err != nil {
+							full = full || errors.Is(err, errWatchLimit)
+							continue
+						}
+					}
+					w.watched[p] = struct{}{}
+				}
+			}
+			for f, k := range files {
+				w.files[f] = k
+			}
+			w.mu.Unlock()
+			if full {
+				_ = w.sync()
 			}
 		}
+		w.record(rel, ev.Op, now, true)
+		return
 	}
-	name := filepath.Base(ev.Name)
-	if util.IsMarkdownFileName(name) {
-		w.hub.Broadcast(Event{Type: "file-changed", Path: rel})
-		if ev.Op&(fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
-			w.hub.Broadcast(Event{Type: "tree-updated"})
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		w.mu.Lock()
+		_, wasDir := w.watched[ev.Name]
+		delete(w.watched, ev.Name)
+		w.mu.Unlock()
+		if wasDir {
+			w.record(rel, ev.Op, now, true)
+			return
 		}
+	}
+
+	name := path.Base(rel)
+	if name == ".order" || name == ".pages" {
+		// Ordering files only affect the tree.
+		w.record(rel, ev.Op, now, true)
 		return
 	}
+	if !isDir && w.reports(name) {
+		w.record(rel, ev.Op, now, false)
+	}
+}
 
-	// If a markdown file was removed/renamed, tree may change.
-	if strings.HasSuffix(strings.ToLower(name), ".md") && ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+func (w *Watcher) record(rel string, op fsnotify.Op, now time.Time, treeOnly bool) {
+	pc, ok := w.pending[rel]
+	if !ok {
+		pc = &pendingChange{first: op, since: now, treeOnly: treeOnly}
+		w.pending[rel] = pc
+	}
+	pc.ops |= op
+	pc.last = now
+}
+
+// flush reports the pending paths that have been quiet for the debounce
+// window, or waited too long, and returns how long until the next one is
+// due (0 if none is left).
+//
+// Each path yields at most one "file-changed" event, whose Change compares
+// the path before the burst with the file system now: a known file that
+// still exists was modified, even if an editor replaced it through a
+// rename. A file that went away through a rename, reported together with a
+// new file of the same size and modification time, is reported as renamed
+// to it. Any change to the set of files, a directory, an ordering file or
+// the weight of a file adds one "tree-updated" event after the others.
+func (w *Watcher) flush(now time.Time) time.Duration {
+	maxWait := 10 * w.debounce
+	var due []string
+	var next time.Duration
+	creating := false
+	for rel, pc := range w.pending {
+		wait := min(pc.last.Add(w.debounce).Sub(now), pc.since.Add(maxWait).Sub(now))
+		if wait <= 0 {
+			due = append(due, rel)
+			continue
+		}
+		if next == 0 || wait < next {
+			next = wait
+		}
+		if pc.first&fsnotify.Create != 0 {
+			creating = true
+		}
+	}
+	if creating {
+		// A file renamed away waits for the files still being created, so
+		// both halves of a rename are reported together.
+		kept := due[:0]
+		for _, rel := range due {
+			if pc := w.pending[rel]; pc.ops&fsnotify.Rename == 0 || now.Sub(pc.since) >= maxWait {
+				kept = append(kept, rel)
+			}
+		}
+		due = kept
+	}
+	sort.Strings(due)
+
+	tree := false
+	var events []Event
+	// Halves of renames: indexes into events, with the file's stat.
+	type half struct {
+		ev int
+		st fileStat
+	}
+	var created, renamedAway []half
+	w.mu.Lock()
+	for _, rel := range due {
+		pc := w.pending[rel]
+		delete(w.pending, rel)
+		if pc.treeOnly {
+			tree = true
+			continue
+		}
+		abs := filepath.Join(w.rootAbs, filepath.FromSlash(rel))
+		old, known := w.files[rel]
+		info, err := util.Stat(abs)
+		exists := err == nil
+		var change string
+		switch {
+		case known && exists:
+			change = ChangeModified
+			cur := knownFile{weight: weight(abs), stat: statOf(info)}
+			if cur.weight != old.weight {
+				tree = true
+			}
+			w.files[rel] = cur
+		case known:
+			change = ChangeDeleted
+			delete(w.files, rel)
+			if pc.ops&fsnotify.Rename != 0 {
+				renamedAway = append(renamedAway, half{len(events), old.stat})
+			}
+		case exists:
+			change = ChangeCreated
+			cur := knownFile{weight: weight(abs), stat: statOf(info)}
+			w.files[rel] = cur
+			if pc.first&fsnotify.Create != 0 {
+				created = append(created, half{len(events), cur.stat})
+			}
+		default:
+			// Created and removed within the window, like a temp file.
+			continue
+		}
+		if change != ChangeModified {
+			tree = true
+		}
+		events = append(events, Event{Type: "file-changed", Path: rel, Change: change})
+	}
+	w.mu.Unlock()
+
+	// Pair files renamed away with files that appeared looking the same;
+	// the others stay deleted and created.
+	for _, away := range renamedAway {
+		for i, c := range created {
+			if c.st != away.st {
+				continue
+			}
+			from, to := &events[away.ev], &events[c.ev]
+			to.Change, to.From = ChangeRenamed, from.Path
+			from.Type = ""
+			created = append(created[:i], created[i+1:]...)
+			break
+		}
+	}
+	for _, ev := range events {
+		if ev.Type != "" {
+			w.hub.Broadcast(ev)
+		}
+	}
+	if tree {
 		w.hub.Broadcast(Event{Type: "tree-updated"})
 	}
+	return next
+}
+
+func (w *Watcher) rel(abs string) string {
+	relOS, err := filepath.Rel(w.rootAbs, abs)
+	if err != nil {
+		return ""
+	}
+	rel := filepath.ToSlash(relOS)
+	if rel == "." {
+		return ""
+	}
+	return rel
 }
@@ -0,0 +1,468 @@
+package watch
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"repobook/internal/ignore"
+)
+
+func TestWatcher_ReloadsIgnoreRules(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "private"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	hub := NewHub()
+	c := dial(t, serveHub(t, hub))
+
+	w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: hub, Ignore: ig})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+
+	if ig.Matcher().IsIgnored("private/a.md", false) {
+		t.Fatalf("did not expect private to be ignored yet")
+	}
+
+	if err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("private/\n"), 0o644); err != nil {
+		t.Fatalf("write .gitignore: %v", err)
+	}
+	waitForEvent(t, c, "tree-updated")
+
+	if !ig.Matcher().IsIgnored("private/a.md", false) {
+		t.Fatalf("expected new .gitignore rules to be live")
+	}
+	w.mu.Lock()
+	_, watched := w.watched[filepath.Join(root, "private")]
+	w.mu.Unlock()
+	if watched {
+		t.Fatalf("expected newly ignored directory to be unwatched")
+	}
+}
+
+func TestWatcher_WaitsForMissingIgnoreDirs(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("USERPROFILE", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_GLOBAL", "")
+
+	root := t.TempDir()
+	for _, dir := range []string{".git", "private"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: NewHub(), Ignore: ig, Mode: ModeNotify})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+
+	// Neither the global excludes file nor .git/info exist yet.
+	write := func(abs, body string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(abs, []byte(body), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	write(filepath.Join(home, ".config", "git", "ignore"), "private/\n")
+	waitFor(t, "global excludes", func() bool { return ig.Matcher().IsIgnored("private/a.md", false) })
+
+	write(filepath.Join(root, ".git", "info", "exclude"), "drafts/\n")
+	waitFor(t, ".git/info/exclude", func() bool { return ig.Matcher().IsIgnored("drafts/a.md", false) })
+}
+
+// eventLog collects the events broadcast on a hub.
+type eventLog struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func listen(h *Hub) *eventLog {
+	l := &eventLog{}
+	h.Listen(func(ev Event) {
+		l.mu.Lock()
+		l.events = append(l.events, ev)
+		l.mu.Unlock()
+	})
+	return l
+}
+
+// settle waits until no event has arrived for a while and returns and
+// clears the events so far.
+func (l *eventLog) settle(t *testing.T, quiet time.Duration) []Event {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	n := -1
+	for time.Now().Before(deadline) {
+		time.Sleep(quiet)
+		l.mu.Lock()
+		cur := len(l.events)
+		l.mu.Unlock()
+		if cur == n && cur > 0 {
+			break
+		}
+		n = cur
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := l.events
+	l.events = nil
+	return out
+}
+
+func TestWatcher_CoalescesChanges(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, body string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, rel), []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	write("a.md", "# A\n")
+
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	hub := NewHub()
+	log := listen(hub)
+	w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: hub, Ignore: ig, Debounce: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+
+	check := func(step string, want ...Event) {
+		t.Helper()
+		if got := log.settle(t, 150*time.Millisecond); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %+v, want %+v", step, got, want)
+		}
+	}
+
+	// An editor saving through a temp file and a rename: one modification,
+	// no tree update.
+	write("a.md.tmp", "# A\n\nmore\n")
+	if err := os.Rename(filepath.Join(root, "a.md.tmp"), filepath.Join(root, "a.md")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	write("a.md", "# A\n\neven more\n")
+	check("save", Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+
+	// A new weight moves the file in the tree.
+	write("a.md", "---\nweight: 2\n---\n# A\n\neven more\n")
+	check("weight", Event{Type: "file-changed", Path: "a.md", Change: ChangeModified}, Event{Type: "tree-updated"})
+	write("a.md", "---\nweight: 2\n---\n# A\n")
+	check("same weight", Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+
+	write("b.md", "# B\n")
+	write("b.md", "# B\n\nbody\n")
+	check("create", Event{Type: "file-changed", Path: "b.md", Change: ChangeCreated}, Event{Type: "tree-updated"})
+
+	if err := os.Rename(filepath.Join(root, "b.md"), filepath.Join(root, "c.md")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	check("rename", Event{Type: "file-changed", Path: "c.md", Change: ChangeRenamed, From: "b.md"}, Event{Type: "tree-updated"})
+
+	if err := os.Remove(filepath.Join(root, "c.md")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	check("delete", Event{Type: "file-changed", Path: "c.md", Change: ChangeDeleted}, Event{Type: "tree-updated"})
+
+	// A file moved out of the tree is not taken for an unrelated new one.
+	write("e.md", "# E\n")
+	check("create e", Event{Type: "file-changed", Path: "e.md", Change: ChangeCreated}, Event{Type: "tree-updated"})
+	if err := os.Rename(filepath.Join(root, "e.md"), filepath.Join(t.TempDir(), "e.md")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	write("f.md", "# F, unrelated\n")
+	check("move out", Event{Type: "file-changed", Path: "e.md", Change: ChangeDeleted},
+		Event{Type: "file-changed", Path: "f.md", Change: ChangeCreated}, Event{Type: "tree-updated"})
+
+	// A file created and removed within the window is not reported.
+	write("tmp.md", "x")
+	if err := os.Remove(filepath.Join(root, "tmp.md")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	write("a.md", "---\nweight: 2\n---\n# A\n\nagain\n")
+	check("transient", Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+}
+
+func TestWatcher_Poll(t *testing.T) {
+	root := t.TempDir()
+	write := func(rel, body string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, rel), []byte(body), 0o644); err != nil {
+			t.Fatalf("write %s: %v", rel, err)
+		}
+	}
+	write("a.md", "# A\n")
+
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	hub := NewHub()
+	log := listen(hub)
+	w, err := NewWatcher(WatcherOptions{
+		RootAbs:      root,
+		Hub:          hub,
+		Ignore:       ig,
+		Debounce:     20 * time.Millisecond,
+		Mode:         ModePoll,
+		PollInterval: 30 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+	if got := w.Mode(); got != ModePoll {
+		t.Fatalf("Mode() = %q, want %q", got, ModePoll)
+	}
+
+	check := func(step string, want ...Event) {
+		t.Helper()
+		if got := log.settle(t, 200*time.Millisecond); !reflect.DeepEqual(got, want) {
+			t.Fatalf("%s: got %+v, want %+v", step, got, want)
+		}
+	}
+
+	write("a.md", "# A\n\nmore\n")
+	check("modify", Event{Type: "file-changed", Path: "a.md", Change: ChangeModified})
+
+	write("b.md", "# B\n")
+	check("create", Event{Type: "file-changed", Path: "b.md", Change: ChangeCreated}, Event{Type: "tree-updated"})
+
+	if err := os.Rename(filepath.Join(root, "b.md"), filepath.Join(root, "c.md")); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	check("rename", Event{Type: "file-changed", Path: "c.md", Change: ChangeRenamed, From: "b.md"}, Event{Type: "tree-updated"})
+
+	if err := os.Remove(filepath.Join(root, "c.md")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	check("delete", Event{Type: "file-changed", Path: "c.md", Change: ChangeDeleted}, Event{Type: "tree-updated"})
+
+	if err := os.Mkdir(filepath.Join(root, "docs"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	check("mkdir", Event{Type: "tree-updated"})
+
+	write(".gitignore", "docs/\n")
+	check("ignore", Event{Type: "tree-updated"})
+	if !ig.Matcher().IsIgnored("docs/a.md", false) {
+		t.Fatalf("expected new .gitignore rules to be live")
+	}
+}
+
+func TestWatcher_ReportAllFiles(t *testing.T) {
+	for _, mode := range []string{ModeNotify, ModePoll} {
+		t.Run(mode, func(t *testing.T) {
+			root := t.TempDir()
+			write := func(rel, body string) {
+				t.Helper()
+				if err := os.WriteFile(filepath.Join(root, rel), []byte(body), 0o644); err != nil {
+					t.Fatalf("write %s: %v", rel, err)
+				}
+			}
+			write("old.txt", "a")
+
+			ig, err := ignore.NewLive(root, ignore.Options{})
+			if err != nil {
+				t.Fatalf("NewLive: %v", err)
+			}
+			hub := NewHub()
+			log := listen(hub)
+			w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: hub, Ignore: ig, Mode: mode, Debounce: 50 * time.Millisecond, PollInterval: 20 * time.Millisecond})
+			if err != nil {
+				t.Fatalf("NewWatcher: %v", err)
+			}
+			defer func() { _ = w.Close() }()
+
+			check := func(step string, want ...Event) {
+				t.Helper()
+				if got := log.settle(t, 150*time.Millisecond); !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: got %+v, want %+v", step, got, want)
+				}
+			}
+
+			w.ReportAllFiles()
+			// Let the loop learn about the files it now reports.
+			time.Sleep(100 * time.Millisecond)
+			write("old.txt", "ab")
+			check("modify", Event{Type: "file-changed", Path: "old.txt", Change: ChangeModified})
+			write("new.txt", "a")
+			check("create", Event{Type: "file-changed", Path: "new.txt", Change: ChangeCreated}, Event{Type: "tree-updated"})
+		})
+	}
+}
+
+func TestWatcher_AutoKeepsWorkingFsnotify(t *testing.T) {
+	root := t.TempDir()
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: NewHub(), Ignore: ig, PollInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+	if got := w.Mode(); got != ModeAuto {
+		t.Fatalf("Mode() = %q, want %q", got, ModeAuto)
+	}
+
+	if err := os.WriteFile(filepath.Join(root, "a.md"), []byte("# A\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for w.Mode() == ModeAuto && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := w.Mode(); got != ModeNotify {
+		t.Fatalf("Mode() = %q, want %q", got, ModeNotify)
+	}
+}
+
+func TestWatcher_AutoStopsProbingQuietTree(t *testing.T) {
+	defer func(d time.Duration) { autoProbe = d }(autoProbe)
+	autoProbe = 100 * time.Millisecond
+
+	root := t.TempDir()
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	w, err := NewWatcher(WatcherOptions{RootAbs: root, Hub: NewHub(), Ignore: ig, PollInterval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer func() { _ = w.Close() }()
+
+	// Nothing changes, so there is no evidence either way; polling still
+	// stops once the probe period is over.
+	deadline := time.Now().Add(3 * time.Second)
+	for w.Mode() == ModeAuto && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := w.Mode(); got != ModeNotify {
+		t.Fatalf("Mode() = %q, want %q", got, ModeNotify)
+	}
+}
+
+func TestWatcher_WatchLimit(t *testing.T) {
+	root := t.TempDir()
+	for _, d := range []string{"docs", "empty", "code"} {
+		if err := os.MkdirAll(filepath.Join(root, d), 0o755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(root, "docs", "a.md"), []byte("# A\n"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	ig, err := ignore.NewLive(root, ignore.Options{})
+	if err != nil {
+		t.Fatalf("NewLive: %v", err)
+	}
+	start := func(limit int) (*Watcher, *eventLog, []string) {
+		t.Helper()
+		maxWatches = limit
+		t.Cleanup(func() { maxWatches = 0 })
+		hub := NewHub()
+		log := listen(hub)
+		var warnings []string
+		w, err := NewWatcher(WatcherOptions{
+			RootAbs:      root,
+			Hub:          hub,
+			Ignore:       ig,
+			Debounce:     20 * time.Millisecond,
+			Mode:         ModeNotify,
+			PollInterval: 30 * time.Millisecond,
+			Warn:         func(msg string) { warnings = append(warnings, msg) },
+		})
+		if err != nil {
+			t.Fatalf("NewWatcher: %v", err)
+		}
+		t.Cleanup(func() { _ = w.Close() })
+		return w, log, warnings
+	}
+	touch := func(log *eventLog) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, "docs", "a.md"), []byte("# A\n\nmore\n"), 0o644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		want := []Event{{Type: "file-changed", Path: "docs/a.md", Change: ChangeModified}}
+		if got := log.settle(t, 200*time.Millisecond); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %+v, want %+v", got, want)
+		}
+	}
+
+	// Room for the root and docs, but not every directory.
+	w, log, warnings := start(2)
+	if st := w.Status(); st.Mode != ModeNotify || !st.Limited || st.Warning == "" {
+		t.Fatalf("Status() = %+v, want limited fsnotify with a warning", st)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("warnings = %q, want one", warnings)
+	}
+	w.mu.Lock()
+	_, docs := w.watched[filepath.Join(root, "docs")]
+	_, empty := w.watched[filepath.Join(root, "empty")]
+	w.mu.Unlock()
+	if !docs || empty {
+		t.Fatalf("expected only directories with markdown to be watched")
+	}
+	touch(log)
+
+	// Not even that: poll.
+	w, log, warnings = start(1)
+	if st := w.Status(); st.Mode != ModePoll || st.Warning == "" {
+		t.Fatalf("Status() = %+v, want polling with a warning", st)
+	}
+	if len(warnings) != 2 {
+		t.Fatalf("warnings = %q, want two", warnings)
+	}
+	touch(log)
+}
+
+func TestNewWatcher_RejectsUnknownMode(t *testing.T) {
+	if _, err := NewWatcher(WatcherOptions{RootAbs: t.TempDir(), Hub: NewHub(), Mode: "inotify"}); err == nil {
+		t.Fatalf("expected an error for an unknown mode")
+	}
+}
+
+func waitForEvent(t *testing.T, c *websocket.Conn, typ string) string {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_ = c.SetReadDeadline(deadline)
+		_, msg, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("waiting for %s: %v", typ, err)
+		}
+		if strings.Contains(string(msg), `"type":"`+typ+`"`) {
+			return string(msg)
+		}
+	}
+}
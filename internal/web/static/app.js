@@ -7,16 +7,36 @@
 	const elSearch = document.getElementById('search')
 	const elResults = document.getElementById('results')
 	const elSearchMeta = document.getElementById('searchMeta')
+	const elSearchOptions = document.getElementById('searchOptions')
 	const elNavToggle = document.getElementById('navToggle')
+	const elQuickOpen = document.getElementById('quickOpen')
+	const elQuickOpenInput = document.getElementById('quickOpenInput')
+	const elQuickOpenList = document.getElementById('quickOpenList')
+	const elSession = document.getElementById('session')
 
 	let tree = null
 	let currentPath = ''
 	let currentMTime = 0
+	let currentHTML = '' // the rendered HTML as served, before any scripting
+	let currentRev = '' // git revision shown instead of the working tree
 	let scrollSpyDisconnect = null
 	let searchTimer = null
 	let lastQuery = ''
+	let searchAbort = null
+	let searchShown = null // the results on screen, with their paging state
+	const searchOpts = { case: false, word: false, regex: false }
+	let pendingHighlight = ''
 	const openDirPaths = new Set()
 	let navCollapsed = false
+	let liveSocket = null // the live-update WebSocket, once open
+	let liveSource = null // the EventSource used instead where proxies block WebSockets
+	let liveTopic = '' // the document topic subscribed to
+	let liveLastID = 0 // the ID of the last live event
+	let liveFallback = null // refetch timer in case no render is pushed
+	let sessionCode = '' // the presenter session presented or followed
+	let sessionRole = '' // 'present' or 'follow'
+	let sessionDetached = false // following, but not moving along
+	let positionTimer = null // throttles the presenter's position updates
 
 	function syncNavToggle() {
 		if (!elNavToggle) return
@@ -49,9 +69,19 @@
     return ''
   }
 
+	// getRouteRev is the git revision of a document opened from a history
+	// search result, or '' for the working tree.
+	function getRouteRev() {
+		return new URLSearchParams(location.search).get('rev') || ''
+	}
+
   async function fetchJSON(url) {
     const res = await fetch(url, { cache: 'no-store' })
-    if (!res.ok) throw new Error(await res.text())
+    if (!res.ok) {
+      const err = new Error(await res.text())
+      err.status = res.status
+      throw err
+    }
     return res.json()
   }
 
@@ -85,18 +115,49 @@
     })
   }
 
+	function isMarkdownPath(p) {
+		const lower = String(p || '').toLowerCase()
+		return lower.endsWith('.md') || lower.endsWith('.markdown')
+	}
+
+	function findTreeNode(node, p) {
+		if (!node) return null
+		if (node.type === 'file') return node.path === p ? node : null
+		for (const c of node.children || []) {
+			if (c.type === 'dir' && !isPathInDir(p, c.path)) continue
+			const found = findTreeNode(c, p)
+			if (found) return found
+		}
+		return null
+	}
+
+	function formatSize(n) {
+		if (!n) return ''
+		if (n < 1024) return `${n} B`
+		if (n < 1024 * 1024) return `${(n / 1024).toFixed(1)} KB`
+		return `${(n / (1024 * 1024)).toFixed(1)} MB`
+	}
+
 	function renderTreeNode(node) {
 		if (node.type === 'file') {
 			const active = node.path === currentPath ? ' is-active' : ''
+			const kind = node.kind || 'markdown'
+			const title = node.size ? ` title="${esc(formatSize(node.size))}"` : ''
+			// Markdown and text open in the viewer; images, PDFs and other binaries
+			// open from the repo asset server in a new tab.
+			const link = (kind === 'markdown' || kind === 'text')
+				? `<a class="nav-link"${title} href="/file/${encodeURI(node.path)}">${esc(node.name)}</a>`
+				: `<a class="nav-link"${title} href="/repo/${encodeURI(node.path)}" target="_blank" rel="noopener noreferrer">${esc(node.name)}</a>`
 			return (
-				`<div class="nav-item file${active}">` +
-					`<a class="nav-link" href="/file/${encodeURI(node.path)}">${esc(node.name)}</a>` +
+				`<div class="nav-item file kind-${esc(kind)}${active}">` +
+					link +
 				`</div>`
 			)
 		}
 
 		const hasReadme = !!(node.children || []).find((c) => {
-			return c && c.type === 'file' && typeof c.name === 'string' && c.name.toLowerCase() === 'readme.md'
+			// Match on the path: display names may be rewritten (prefix stripping, .pages titles).
+			return c && c.type === 'file' && typeof c.path === 'string' && c.path.split('/').pop().toLowerCase() === 'readme.md'
 		})
 
 		const active = isPathInDir(currentPath, node.path) ? ' is-active' : ''
@@ -210,40 +271,240 @@
 			elResults.innerHTML = '<div class="toc-empty">No results</div>'
 			return
 		}
-		elResults.innerHTML = data.results.map((r) => {
-			const href = `/file/${encodeURI(r.path)}`
+		const counts = new Map((data.files || []).map((f) => [f.path, f.count]))
+		let prevPath = ''
+		elResults.innerHTML = renderFacets(data.facets) + data.results.map((r) => {
+			// Deep-link to the enclosing section when the server knows it;
+			// history hits open the revision that has the line.
+			const href = `/file/${encodeURI(r.path)}` +
+				(r.commit ? `?rev=${encodeURIComponent(r.commit.rev)}` : '') +
+				(r.anchor ? `#${encodeURIComponent(r.anchor)}` : '')
+			const term = matchedText(r.preview, r.matches)
+			const section = r.heading ? `<div class="result-section">§ ${esc(r.heading)}</div>` : ''
+			// The first hit of a run from one file carries the file's total.
+			const n = r.path !== prevPath ? counts.get(r.path) : 0
+			prevPath = r.path
+			const count = n > 1 ? `<div class="result-count">${esc(n)} matches in file</div>` : ''
 			return (
-				`<a class="result" href="${href}">` +
+				`<a class="result" href="${href}" data-highlight="${esc(term)}">` +
 					`<div class="result-top">` +
 						`<div class="result-path">${esc(r.path)}</div>` +
 						`<div class="result-line">L${esc(r.line)}</div>` +
 					`</div>` +
-					`<div class="result-preview">${esc(r.preview)}</div>` +
+					count +
+					(r.commit ? resultCommit(r.commit) : '') +
+					(r.title ? `<div class="result-title">${esc(r.title)}</div>` : '') +
+					section +
+					resultContext(r.before) +
+					`<div class="result-preview">${highlightPreview(r.preview, r.matches)}</div>` +
+					resultContext(r.after) +
 				`</a>`
 			)
 		}).join('')
-		if (data.truncated) {
+		if (data.next) {
+			elResults.innerHTML += `<button class="results-more" type="button">Load more</button>`
+		} else if (data.truncated) {
 			elResults.innerHTML += '<div class="toc-empty">Results truncated</div>'
 		}
 	}
 
+	function resultContext(lines) {
+		if (!lines || !lines.length) return ''
+		return lines
+			.map((l) => `<div class="result-context">${highlightPreview(l.text, l.matches) || '&nbsp;'}</div>`)
+			.join('')
+	}
+
+	function resultCommit(c) {
+		const sign = c.change === 'removed' ? '−' : '+'
+		const date = c.date ? new Date(c.date).toLocaleDateString() : ''
+		return (
+			`<div class="result-commit is-${esc(c.change)}" title="${esc(c.hash)}">` +
+				`${sign} ${esc(c.hash.slice(0, 7))} · ${esc(date)} · ${esc(c.subject)}` +
+			`</div>`
+		)
+	}
+
+	// Facet chips add a filter to the query; values with spaces cannot be
+	// written as filters and are left out.
+	function renderFacets(facets) {
+		if (!facets) return ''
+		const groups = [
+			['tags', 'tag:', 'Tags'],
+			['dirs', 'path:', 'Folders'],
+			['authors', 'author:', 'Authors'],
+		]
+		const q = elSearch ? elSearch.value : ''
+		const html = groups.map(([key, prefix, label]) => {
+			const chips = (facets[key] || [])
+				.filter((f) => !/\s/.test(f.value) && !q.includes(prefix + f.value))
+				.map((f) => `<button class="facet" type="button" data-filter="${esc(prefix + f.value)}">${esc(f.value)} <span>${esc(f.count)}</span></button>`)
+				.join('')
+			return chips ? `<div class="facet-group"><span class="facet-label">${label}</span>${chips}</div>` : ''
+		}).join('')
+		return html ? `<div class="facets">${html}</div>` : ''
+	}
+
+	function addSearchFilter(filter) {
+		if (!elSearch) return
+		elSearch.value = `${elSearch.value.trim()} ${filter}`.trim()
+		runSearch(elSearch.value)
+	}
+
+	function resultsMeta(data) {
+		const total = data.total || data.results.length
+		const more = data.estimated ? '+' : ''
+		if (total > data.results.length) return `${data.results.length} of ${total}${more} results`
+		return `${data.results.length}${more} results`
+	}
+
+	// Fetch the page after the one shown and append it.
+	async function loadMoreResults() {
+		const shown = searchShown
+		if (!shown || !shown.next) return
+		setSearchMeta('Loading…')
+		try {
+			const data = await fetchJSON(`${shown.url}&cursor=${encodeURIComponent(shown.next)}`)
+			if (searchShown !== shown) return
+			shown.results = shown.results.concat(data.results)
+			shown.files = data.files
+			shown.next = data.next
+			shown.total = data.total
+			shown.estimated = data.estimated
+			shown.truncated = data.truncated
+			renderResults(shown)
+			setSearchMeta(resultsMeta(shown))
+		} catch (err) {
+			setSearchMeta('Search failed')
+		}
+	}
+
+	// Match ranges are UTF-8 byte offsets; slice on bytes, not UTF-16 units.
+	function highlightPreview(preview, matches) {
+		preview = String(preview || '')
+		if (!matches || !matches.length) return esc(preview)
+		const bytes = new TextEncoder().encode(preview)
+		const dec = new TextDecoder()
+		let out = ''
+		let pos = 0
+		for (const m of matches) {
+			if (m.start < pos || m.end > bytes.length || m.end <= m.start) continue
+			out += esc(dec.decode(bytes.slice(pos, m.start)))
+			out += `<mark>${esc(dec.decode(bytes.slice(m.start, m.end)))}</mark>`
+			pos = m.end
+		}
+		return out + esc(dec.decode(bytes.slice(pos)))
+	}
+
+	function matchedText(preview, matches) {
+		if (!matches || !matches.length) return ''
+		const bytes = new TextEncoder().encode(String(preview || ''))
+		const m = matches[0]
+		return new TextDecoder().decode(bytes.slice(m.start, m.end))
+	}
+
+	// Wrap occurrences of term in the rendered document with <mark> and
+	// return the first one.
+	function highlightInViewer(term) {
+		if (!term) return null
+		const needle = term.toLowerCase()
+		const walker = document.createTreeWalker(elViewer, NodeFilter.SHOW_TEXT)
+		const hits = []
+		while (walker.nextNode()) {
+			const n = walker.currentNode
+			if (n.parentElement && n.parentElement.closest('script,style,.mermaid')) continue
+			if (n.nodeValue.toLowerCase().includes(needle)) hits.push(n)
+		}
+		let first = null
+		for (const n of hits.slice(0, 200)) {
+			const text = n.nodeValue
+			const lower = text.toLowerCase()
+			const frag = document.createDocumentFragment()
+			let pos = 0
+			let i
+			while ((i = lower.indexOf(needle, pos)) >= 0) {
+				frag.appendChild(document.createTextNode(text.slice(pos, i)))
+				const mark = document.createElement('mark')
+				mark.className = 'search-hit'
+				mark.textContent = text.slice(i, i + needle.length)
+				frag.appendChild(mark)
+				if (!first) first = mark
+				pos = i + needle.length
+			}
+			frag.appendChild(document.createTextNode(text.slice(pos)))
+			n.parentNode.replaceChild(frag, n)
+		}
+		return first
+	}
+
+	// searchURL builds the /api/search request for q and the option toggles.
+	function searchURL(q) {
+		// One line of context on each side of a hit.
+		const params = new URLSearchParams({ q, context: '1' })
+		if (searchOpts.case) params.set('case', 'sensitive')
+		if (searchOpts.word) params.set('word', '1')
+		if (searchOpts.regex) params.set('regex', '1')
+		if (searchOpts.history) params.set('mode', 'history')
+		return `/api/search?${params}`
+	}
+
+	// readNDJSON calls onEvent for each JSON line of a streamed response and
+	// onChunk after each network read.
+	async function readNDJSON(res, onEvent, onChunk) {
+		const reader = res.body.getReader()
+		const dec = new TextDecoder()
+		let buf = ''
+		for (;;) {
+			const { value, done } = await reader.read()
+			if (done) break
+			buf += dec.decode(value, { stream: true })
+			let i
+			while ((i = buf.indexOf('\n')) >= 0) {
+				const line = buf.slice(0, i).trim()
+				buf = buf.slice(i + 1)
+				if (line) onEvent(JSON.parse(line))
+			}
+			onChunk()
+		}
+	}
+
 	async function runSearch(q) {
 		q = (q || '').trim()
-		lastQuery = q
+		const url = searchURL(q)
+		lastQuery = url
+		// Cancel the superseded query; the server stops its search too.
+		if (searchAbort) searchAbort.abort()
+		searchAbort = null
+		searchShown = null
 		if (!q) {
 			setSearchMeta('')
 			showResults(false)
 			return
 		}
+		const ctrl = new AbortController()
+		searchAbort = ctrl
 		setSearchMeta('Searching…')
 		showResults(true)
+		const results = []
+		let summary = null
 		try {
-			const data = await fetchJSON(`/api/search?q=${encodeURIComponent(q)}`)
-			if (lastQuery !== q) return
-			renderResults(data)
-			setSearchMeta(`${data.results.length}${data.truncated ? '+' : ''} results`)
+			const res = await fetch(`${url}&stream=1`, { cache: 'no-store', signal: ctrl.signal })
+			if (!res.ok) throw new Error(await res.text())
+			await readNDJSON(res, (ev) => {
+				if (ev.type === 'result') results.push(ev.result)
+				if (ev.type === 'summary') summary = ev
+			}, () => {
+				if (lastQuery !== url || !results.length) return
+				renderResults({ results, truncated: false })
+				setSearchMeta(`${results.length} results…`)
+			})
+			if (lastQuery !== url) return
+			if (summary && summary.error) throw new Error(summary.error)
+			searchShown = { url, results, ...(summary || {}) }
+			renderResults(searchShown)
+			setSearchMeta(resultsMeta(searchShown))
 		} catch (err) {
-			if (lastQuery !== q) return
+			if (ctrl.signal.aborted || lastQuery !== url) return
 			if (elResults) {
 				elResults.innerHTML = `<pre class="error">${esc(err && err.message ? err.message : String(err))}</pre>`
 			}
@@ -361,14 +622,45 @@
 
 	async function loadDoc(relPath, opts) {
     const anchor = (opts && opts.anchor) || ''
+		const rev = (opts && opts.rev) || ''
     setStatus('Loading…')
-    const data = await fetchJSON(`/api/render?path=${encodeURIComponent(relPath)}`)
+    // Non-markdown text files (all-files tree mode) use the source view.
+    const node = findTreeNode(tree, relPath)
+    const isSource = node ? node.kind === 'text' : (relPath.split('/').pop().includes('.') && !isMarkdownPath(relPath))
+    const endpoint = isSource ? '/api/source' : '/api/render'
+		const revParam = rev ? `&rev=${encodeURIComponent(rev)}` : ''
+    let data
+    try {
+      data = await fetchJSON(`${rev ? '/api/render' : endpoint}?path=${encodeURIComponent(relPath)}${revParam}`)
+    } catch (e) {
+      // The tree only knows kinds by file name; the source view tells
+      // binary files apart.
+      if (!isSource || rev || e.status !== 415) throw e
+      currentPath = relPath
+      currentRev = ''
+      syncLiveTopic()
+      currentMTime = 0
+      currentHTML = ''
+      document.title = `repobook • ${relPath}`
+      setCrumb(relPath)
+      elViewer.innerHTML = `<div class="empty">Binary file · <a href="/repo/${encodeURI(relPath)}" target="_blank" rel="noopener noreferrer">Open it from the repository</a></div>`
+      elToc.innerHTML = ''
+      renderTree()
+      setStatus('')
+      return
+    }
     currentPath = data.path
+		currentRev = data.rev || ''
+		syncLiveTopic()
     currentMTime = data.mtime || 0
+		currentHTML = data.html
     document.title = `repobook • ${data.title || data.path}`
     setCrumb(data.path)
 
-    elViewer.innerHTML = `<article class="markdown-body">${data.html}</article>`
+		const banner = data.rev
+			? `<div class="revision-banner">Revision ${esc(data.rev.slice(0, 7))} from git history · <a href="/file/${encodeURI(data.path)}">Open the current version</a></div>`
+			: ''
+    elViewer.innerHTML = `${banner}<article class="markdown-body">${data.html}</article>`
 
     // Render Mermaid diagrams if the runtime is available. This supports
     // different mermaid API variants across versions and is tolerant to
@@ -380,15 +672,25 @@
 		setupScrollSpy()
 		setStatus('')
 
+    // Highlight the term of a clicked search result.
+    const firstHit = highlightInViewer(pendingHighlight)
+    pendingHighlight = ''
+
     const target = anchor || location.hash
+    let scrolled = false
     if (target && target.startsWith('#')) {
       // goldmark auto heading IDs are plain strings; they might contain spaces.
       const id = decodeURIComponent(target.slice(1))
       const el = document.getElementById(id)
       if (el) {
         setTimeout(() => el.scrollIntoView({ block: 'start' }), 0)
+        scrolled = true
 	}
     }
+    if (!scrolled && firstHit) {
+      setTimeout(() => firstHit.scrollIntoView({ block: 'center' }), 0)
+    }
+		schedulePosition()
   }
 
   async function ensureHome() {
@@ -416,7 +718,7 @@
       await ensureHome()
       return
     }
-    await loadDoc(p)
+    await loadDoc(p, { rev: getRouteRev() })
   }
 
 	function setupLinkInterception() {
@@ -432,11 +734,12 @@
         const u = new URL(href, location.origin)
         if (u.origin === location.origin && u.pathname.startsWith('/file/')) {
           e.preventDefault()
+				pendingHighlight = a.getAttribute('data-highlight') || ''
 				if (elSearch && elSearch.value) {
 					elSearch.value = ''
 					runSearch('')
 				}
-          navigate(u.pathname + u.hash, false)
+          navigate(u.pathname + u.search + u.hash, false)
 	}
       } catch (_) {
         // ignore
@@ -457,27 +760,441 @@
 				runSearch(q)
 			}, 200)
 		})
+		if (elResults) {
+			elResults.addEventListener('click', (e) => {
+				if (e.target.closest('.results-more')) loadMoreResults()
+				const facet = e.target.closest('.facet')
+				if (facet) addSearchFilter(facet.dataset.filter)
+			})
+		}
+		if (elSearchOptions) {
+			elSearchOptions.addEventListener('click', (e) => {
+				const btn = e.target.closest('button[data-opt]')
+				if (!btn) return
+				const opt = btn.dataset.opt
+				searchOpts[opt] = !searchOpts[opt]
+				btn.setAttribute('aria-pressed', String(searchOpts[opt]))
+				runSearch(elSearch.value)
+			})
+		}
+	}
+
+	// Mark the characters at rune positions (code points, as /api/find
+	// reports them).
+	function highlightPositions(text, positions) {
+		const chars = Array.from(String(text || ''))
+		if (!positions || !positions.length) return esc(chars.join(''))
+		const at = new Set(positions)
+		return chars.map((c, i) => (at.has(i) ? `<mark>${esc(c)}</mark>` : esc(c))).join('')
+	}
+
+	function setupQuickOpen() {
+		if (!elQuickOpen || !elQuickOpenInput || !elQuickOpenList) return
+		let timer = null
+		let last = ''
+		let selected = 0
+
+		const items = () => Array.from(elQuickOpenList.querySelectorAll('a.quick-open-item'))
+		const select = (i) => {
+			const all = items()
+			if (!all.length) return
+			selected = (i + all.length) % all.length
+			all.forEach((a, j) => a.classList.toggle('is-selected', j === selected))
+			all[selected].scrollIntoView({ block: 'nearest' })
+		}
+
+		const run = async (q) => {
+			q = q.trim()
+			last = q
+			if (!q) {
+				elQuickOpenList.innerHTML = ''
+				return
+			}
+			const data = await fetchJSON(`/api/find?q=${encodeURIComponent(q)}`)
+			if (last !== q) return
+			if (!data.results.length) {
+				elQuickOpenList.innerHTML = '<div class="toc-empty">No matches</div>'
+				return
+			}
+			elQuickOpenList.innerHTML = data.results.map((t) => {
+				const href = `/file/${encodeURI(t.path)}` + (t.anchor ? `#${encodeURIComponent(t.anchor)}` : '')
+				const label = t.kind === 'heading' ? t.heading : t.title
+				const pos = t.positions || {}
+				const sub = t.kind === 'heading' ? `${esc(t.title)} · ` : ''
+				return (
+					`<a class="quick-open-item kind-${esc(t.kind)}" role="option" href="${href}">` +
+						`<div class="quick-open-label">${t.kind === 'heading' ? '§ ' : ''}${highlightPositions(label, pos.label)}</div>` +
+						`<div class="quick-open-path">${sub}${highlightPositions(t.path, pos.path)}</div>` +
+					`</a>`
+				)
+			}).join('')
+			select(0)
+		}
+
+		const open = () => {
+			if (elQuickOpen.open) return
+			elQuickOpen.showModal()
+			elQuickOpenInput.select()
+			run(elQuickOpenInput.value).catch(() => {})
+		}
+
+		document.addEventListener('keydown', (e) => {
+			const key = e.key.toLowerCase()
+			if ((e.ctrlKey || e.metaKey) && (key === 'k' || key === 'p')) {
+				e.preventDefault()
+				open()
+			}
+		})
+		elQuickOpenInput.addEventListener('input', () => {
+			if (timer) clearTimeout(timer)
+			timer = setTimeout(() => {
+				run(elQuickOpenInput.value).catch(() => {})
+			}, 80)
+		})
+		elQuickOpenInput.addEventListener('keydown', (e) => {
+			if (e.key === 'ArrowDown' || e.key === 'ArrowUp') {
+				e.preventDefault()
+				select(selected + (e.key === 'ArrowDown' ? 1 : -1))
+			} else if (e.key === 'Enter') {
+				e.preventDefault()
+				const a = items()[selected]
+				if (a) a.click()
+			}
+		})
+		// Navigation goes through the regular link interception.
+		elQuickOpenList.addEventListener('click', (e) => {
+			if (e.target.closest('a.quick-open-item')) elQuickOpen.close()
+		})
+		elQuickOpen.addEventListener('click', (e) => {
+			if (e.target === elQuickOpen) elQuickOpen.close()
+		})
 	}
 
   function setupLiveUpdates() {
     const proto = location.protocol === 'https:' ? 'wss' : 'ws'
-    const ws = new WebSocket(`${proto}://${location.host}/ws`)
-    ws.onmessage = (msg) => {
-      let ev
-      try { ev = JSON.parse(msg.data) } catch (_) { return }
-      if (!ev || !ev.type) return
-      if (ev.type === 'tree-updated') {
-        loadTree().catch(() => {})
+    // The server drops connections that fall behind or stop answering pings,
+    // and laptops sleep; reconnect with backoff and have the server replay
+    // what was missed (or send "resync").
+    let delay = 500
+    let reconnecting = false
+    let failures = 0
+    const connect = () => {
+      liveTopic = currentPath ? `file:${currentPath}` : ''
+      const params = liveParams()
+      if (reconnecting) params.set('since', String(liveLastID))
+      const ws = new WebSocket(`${proto}://${location.host}/ws?${params}`)
+      let opened = false
+      ws.onopen = () => {
+        opened = true
+        failures = 0
+        delay = 500
+        reconnecting = false
+        liveSocket = ws
+        syncLiveTopic()
+        renderSession()
       }
-      if (ev.type === 'file-changed' && ev.path && ev.path === currentPath) {
-        // Avoid spamming reloads when multiple events fire.
-        setTimeout(() => {
-          loadDoc(currentPath, { anchor: location.hash }).catch(() => {})
-        }, 100)
+      ws.onclose = () => {
+        if (liveSocket === ws) liveSocket = null
+        if (sessionRole === 'present') {
+          // The session ends with the connection it was started on.
+          endSession('Presenting stopped: the connection was lost')
+        }
+        renderSession()
+        if (!opened && ++failures >= 2) {
+          // The upgrade never gets through: use Server-Sent Events.
+          openLiveSource()
+          return
+        }
+        reconnecting = true
+        setTimeout(connect, delay)
+        delay = Math.min(delay * 2, 10000)
       }
+      ws.onmessage = onLiveMessage
+    }
+    connect()
+  }
+
+	// syncLiveTopic subscribes to changes of the document on screen only, so
+	// edits elsewhere in a large repo cause no traffic.
+	function syncLiveTopic() {
+		const topic = currentPath ? `file:${currentPath}` : ''
+		if (topic === liveTopic) return
+		if (liveSource) {
+			// Server-Sent Events are one-way: reconnect with the new topics,
+			// resuming after the last event seen.
+			liveTopic = topic
+			openLiveSource()
+			return
+		}
+		if (!liveSocket) return
+		if (liveTopic) liveSocket.send(JSON.stringify({ type: 'unsubscribe', topics: [liveTopic] }))
+		if (topic) liveSocket.send(JSON.stringify({ type: 'subscribe', topics: [topic] }))
+		liveTopic = topic
+	}
+
+	// liveParams returns the query parameters subscribing to the tree and
+	// liveTopic from the start.
+	function liveParams() {
+		const params = new URLSearchParams()
+		params.append('topic', 'tree')
+		if (liveTopic) params.append('topic', liveTopic)
+		if (sessionRole === 'follow' && !sessionDetached) params.append('topic', `session:${sessionCode}`)
+		return params
+	}
+
+	// openLiveSource (re)opens the /events stream. EventSource reconnects by
+	// itself and resumes with Last-Event-ID.
+	function openLiveSource() {
+		if (liveSource) liveSource.close()
+		const params = liveParams()
+		if (liveLastID) params.set('lastEventId', String(liveLastID))
+		liveSource = new EventSource(`/events?${params}`)
+		liveSource.onmessage = onLiveMessage
+	}
+
+  function onLiveMessage(msg) {
+    let ev
+    try { ev = JSON.parse(msg.data) } catch (_) { return }
+    if (!ev || !ev.type) return
+		if (ev.id) liveLastID = ev.id
+		if (ev.session) {
+			onSessionEvent(ev)
+			return
+		}
+		if (ev.type === 'reveal') {
+			// Followers go where the presenter goes instead.
+			if (sessionRole !== 'follow' || sessionDetached) revealLine(ev.path, ev.line).catch(() => {})
+			return
+		}
+		if (ev.type === 'resync') {
+			// Too many events were missed to replay them: reload everything.
+			loadTree().catch(() => {})
+			if (currentPath && !currentRev) loadDoc(currentPath, { anchor: location.hash }).catch(() => {})
+			return
+		}
+    if (ev.type === 'tree-updated') {
+      loadTree().catch(() => {})
     }
+		if (currentRev || !ev.path) return
+		if (ev.type === 'rendered' && ev.path === currentPath && ev.render) {
+			clearTimeout(liveFallback)
+			if ((ev.render.mtime || 0) >= currentMTime) applyRender(ev.render)
+			return
+		}
+		if (ev.type !== 'file-changed') return
+		// The server coalesces bursts of changes into one event per file.
+		if (ev.change === 'renamed' && ev.from === currentPath) {
+			navigate(`/file/${encodeURI(ev.path)}${location.hash}`, true)
+		} else if (ev.change === 'deleted' && ev.path === currentPath) {
+			setStatus('This file was deleted')
+		} else if (ev.path === currentPath && !isMarkdownPath(currentPath)) {
+			loadDoc(currentPath, { anchor: location.hash }).catch(() => {})
+		} else if (ev.path === currentPath) {
+			// The server pushes the new render right after; refetch only if it
+			// does not arrive.
+			clearTimeout(liveFallback)
+			liveFallback = setTimeout(() => {
+				loadDoc(currentPath, { anchor: location.hash }).catch(() => {})
+			}, 2000)
+		}
   }
 
+	// applyRender swaps in a pushed render of the document on screen. Unlike
+	// loadDoc it keeps the scroll position, and it marks the top-level blocks
+	// that are new or changed.
+	function applyRender(data) {
+		const article = elViewer.querySelector('article.markdown-body')
+		if (!article) return
+		// Compare with the HTML as served: diagrams and search marks change the
+		// DOM on screen.
+		const prev = document.createElement('template')
+		prev.innerHTML = currentHTML
+		const old = new Map()
+		for (const el of prev.content.children) {
+			const key = blockKey(el)
+			old.set(key, (old.get(key) || 0) + 1)
+		}
+
+		const top = elViewer.scrollTop
+		article.innerHTML = data.html
+		currentMTime = data.mtime || 0
+		currentHTML = data.html
+		document.title = `repobook • ${data.title || data.path}`
+		for (const el of article.children) {
+			const key = blockKey(el)
+			const n = old.get(key) || 0
+			if (n > 0) {
+				old.set(key, n - 1)
+			} else {
+				el.classList.add('live-changed')
+			}
+		}
+		renderMermaidElements()
+		renderTOC(data.toc || [])
+		setupScrollSpy()
+		elViewer.scrollTop = top
+	}
+
+	// Presenter sessions: a presenter's document, scroll position and
+	// focused heading are relayed to followers who joined with the code.
+	// Presenting needs the WebSocket; following works over either transport.
+	function setupSession() {
+		const code = new URLSearchParams(location.search).get('follow')
+		if (code) {
+			sessionRole = 'follow'
+			sessionCode = code.trim().toUpperCase()
+		}
+		elSession.addEventListener('click', (e) => {
+			const b = e.target && e.target.closest ? e.target.closest('button[data-action]') : null
+			if (!b) return
+			const action = b.getAttribute('data-action')
+			if (action === 'present' && liveSocket) {
+				liveSocket.send(JSON.stringify({ type: 'present' }))
+			} else if (action === 'stop') {
+				if (liveSocket) liveSocket.send(JSON.stringify({ type: 'stop' }))
+				endSession('')
+			} else if (action === 'follow') {
+				const input = window.prompt('Session code')
+				if (!input || !input.trim()) return
+				sessionRole = 'follow'
+				sessionCode = input.trim().toUpperCase()
+				sessionDetached = false
+				syncSessionTopic(true)
+			} else if (action === 'detach' || action === 'rejoin') {
+				sessionDetached = action === 'detach'
+				syncSessionTopic(!sessionDetached)
+			} else if (action === 'leave') {
+				syncSessionTopic(false)
+				endSession('')
+			}
+			renderSession()
+		})
+		elViewer.addEventListener('scroll', schedulePosition, { passive: true })
+		renderSession()
+	}
+
+	function renderSession() {
+		const code = `<span class="session-code">${esc(sessionCode)}</span>`
+		if (sessionRole === 'present') {
+			elSession.innerHTML = sessionCode
+				? `Presenting ${code} <button type="button" data-action="stop">Stop</button>`
+				: 'Starting…'
+		} else if (sessionRole === 'follow' && sessionDetached) {
+			elSession.innerHTML = `Detached from ${code} <button type="button" data-action="rejoin">Rejoin</button> <button type="button" data-action="leave">Leave</button>`
+		} else if (sessionRole === 'follow') {
+			elSession.innerHTML = `Following ${code} <button type="button" data-action="detach">Detach</button> <button type="button" data-action="leave">Leave</button>`
+		} else {
+			const off = liveSocket ? '' : ' disabled title="Needs a WebSocket connection"'
+			elSession.innerHTML = `<button type="button" data-action="present"${off}>Present</button> <button type="button" data-action="follow">Follow…</button>`
+		}
+	}
+
+	// syncSessionTopic subscribes to or unsubscribes from the followed
+	// session. Subscribing again sends the presenter's current position.
+	function syncSessionTopic(on) {
+		if (sessionRole !== 'follow') return
+		if (liveSource) {
+			openLiveSource()
+			return
+		}
+		if (!liveSocket) return
+		const topics = [`session:${sessionCode}`]
+		liveSocket.send(JSON.stringify({ type: on ? 'subscribe' : 'unsubscribe', topics }))
+	}
+
+	function endSession(msg) {
+		sessionRole = ''
+		sessionCode = ''
+		sessionDetached = false
+		clearTimeout(positionTimer)
+		positionTimer = null
+		elViewer.querySelectorAll('.session-focus').forEach((x) => x.classList.remove('session-focus'))
+		if (msg) setStatus(msg)
+		renderSession()
+	}
+
+	function onSessionEvent(ev) {
+		if (ev.type === 'session') {
+			sessionRole = 'present'
+			sessionCode = ev.session
+			renderSession()
+			sendPosition()
+			return
+		}
+		if (sessionRole !== 'follow' || ev.session !== sessionCode) return
+		if (ev.type === 'session-ended') {
+			endSession(`Session ${ev.session} ended`)
+		} else if (ev.type === 'position' && !sessionDetached) {
+			followPosition(ev).catch(() => {})
+		}
+	}
+
+	// schedulePosition sends the presenter's position at most every 150ms
+	// while scrolling.
+	function schedulePosition() {
+		if (sessionRole !== 'present' || !sessionCode || positionTimer) return
+		positionTimer = setTimeout(() => {
+			positionTimer = null
+			sendPosition()
+		}, 150)
+	}
+
+	function sendPosition() {
+		if (sessionRole !== 'present' || !sessionCode || !liveSocket || !currentPath) return
+		const range = elViewer.scrollHeight - elViewer.clientHeight
+		const active = elToc.querySelector('a.toc-item.is-active')
+		liveSocket.send(JSON.stringify({
+			type: 'position',
+			path: currentPath,
+			anchor: active ? active.getAttribute('data-id') || '' : '',
+			scroll: range > 0 ? elViewer.scrollTop / range : 0,
+		}))
+	}
+
+	async function followPosition(ev) {
+		if (ev.path && (ev.path !== currentPath || currentRev)) {
+			history.pushState({}, '', `/file/${encodeURI(ev.path)}`)
+			await loadDoc(ev.path)
+		}
+		elViewer.scrollTop = (ev.scroll || 0) * (elViewer.scrollHeight - elViewer.clientHeight)
+		elViewer.querySelectorAll('.session-focus').forEach((x) => x.classList.remove('session-focus'))
+		const el = ev.anchor ? document.getElementById(ev.anchor) : null
+		if (el && elViewer.contains(el)) el.classList.add('session-focus')
+	}
+
+	// blockKey identifies a rendered block by its content, ignoring the
+	// source lines that shift when lines are added above it.
+	function blockKey(el) {
+		const c = el.cloneNode(true)
+		c.removeAttribute('data-source-line')
+		c.querySelectorAll('[data-source-line]').forEach((x) => x.removeAttribute('data-source-line'))
+		return c.outerHTML
+	}
+
+	// revealLine shows the block holding a source line, for editors driving
+	// the preview (see /api/reveal): the last block starting at or above it.
+	async function revealLine(relPath, line) {
+		if (!relPath || !line) return
+		if (relPath !== currentPath || currentRev) {
+			history.pushState({}, '', `/file/${encodeURI(relPath)}`)
+			await loadDoc(relPath)
+		}
+		let best = null
+		let bestLine = 0
+		elViewer.querySelectorAll('article.markdown-body [data-source-line]').forEach((el) => {
+			const n = Number(el.getAttribute('data-source-line'))
+			if (n <= line && n >= bestLine) {
+				best = el
+				bestLine = n
+			}
+		})
+		if (!best) return
+		best.scrollIntoView({ block: 'center' })
+		best.classList.remove('revealed')
+		void best.offsetWidth // restart the animation
+		best.classList.add('revealed')
+	}
+
   async function loadTree() {
     tree = await fetchJSON('/api/tree')
     renderTree()
@@ -488,6 +1205,8 @@
     setupTOCBehavior()
     setupNavToggle()
     setupSearch()
+    setupQuickOpen()
+    setupSession()
     // Load mermaid runtime lazily. Prefer a vendored local copy embedded into
     // the app (served under /app/vendor/mermaid.min.js) so offline/CI runs can
     // work without network access. Fall back to CDN if a local file is missing.